@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// File next to config.json that holds the API secret of this install
+const apiSecretFile = "api-secret"
+
+// Header that carries the API secret. EventSource cannot set headers, so
+// /api/events and the main script, which is loaded by a <script> tag, take
+// the "secret" query parameter instead.
+const apiSecretHeader = "X-External-Player-Secret"
+
+// apiSecret must accompany every /api/ request. The userscript stub and the
+// local pages embed it, so websites the user visits cannot drive the player.
+var apiSecret string
+
+// loadAPISecret reads the API secret, creating one on the first start
+func loadAPISecret(configDir string) error {
+	path := filepath.Join(configDir, apiSecretFile)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if secret := strings.TrimSpace(string(data)); secret != "" {
+			apiSecret = secret
+			return nil
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return err
+	}
+	apiSecret = hex.EncodeToString(buf)
+	if err := os.WriteFile(path, []byte(apiSecret+"\n"), 0600); err != nil {
+		return err
+	}
+	log.Printf("API secret created in %s", path)
+	return nil
+}
+
+// validSecret reports whether a request carries the API secret in its header
+func validSecret(r *http.Request) bool {
+	return isAPISecret(r.Header.Get(apiSecretHeader))
+}
+
+// validQuerySecret reports whether a request carries the API secret in its
+// URL. It is only accepted where a header cannot be set, as URLs end up in
+// browser history and request logs.
+func validQuerySecret(r *http.Request) bool {
+	return isAPISecret(r.URL.Query().Get("secret"))
+}
+
+func isAPISecret(secret string) bool {
+	return secret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(apiSecret)) == 1
+}
+
+// csrfToken returns the token the HTML forms post back. It is derived from
+// the API secret, so it stays valid across restarts.
+func csrfToken() string {
+	mac := hmac.New(sha256.New, []byte(apiSecret))
+	mac.Write([]byte("csrf"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validCSRFToken reports whether a form post carries the CSRF token
+func validCSRFToken(r *http.Request) bool {
+	token := r.PostFormValue("csrf_token")
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(csrfToken())) == 1
+}
+
+// isLocalHost reports whether a host (with port) names this server on the
+// loopback interface
+func isLocalHost(host string) bool {
+	name, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return false
+	}
+	configMu.RLock()
+	localPort := fmt.Sprint(config.Port)
+	configMu.RUnlock()
+	return port == localPort && (name == "localhost" || name == "127.0.0.1" || name == "::1")
+}
+
+// isAllowedOrigin reports whether a page of origin may call the API: the
+// local pages, the Jellyfin servers of Config.ServerURLs and the servers
+// credentials are stored for. Other origins are refused, also while no
+// server is known yet.
+func isAllowedOrigin(origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if u.Scheme == "http" && isLocalHost(u.Host) {
+		return true
+	}
+
+	configMu.RLock()
+	patterns := append([]string{}, config.ServerURLs...)
+	configMu.RUnlock()
+	for _, c := range credentials.list() {
+		patterns = append(patterns, c.ServerURL)
+	}
+	if len(patterns) == 0 {
+		log.Printf("API: no server URLs are configured; add the Jellyfin server on the config page")
+		return false
+	}
+	for _, pattern := range patterns {
+		// Server URLs are userscript @include patterns such as
+		// "http://myserver:8096/*"; only the scheme and host count
+		s, err := url.Parse(strings.TrimSuffix(pattern, "*"))
+		if err != nil {
+			continue
+		}
+		if strings.EqualFold(s.Scheme, u.Scheme) && strings.EqualFold(s.Host, u.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+// requireSecret sets the CORS headers of an API endpoint and answers CORS
+// preflights, which carry no secret. Other requests are refused if they come
+// from an origin that is not allowed or lack the API secret.
+func requireSecret(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+		if origin := r.Header.Get("Origin"); origin != "" {
+			if !isAllowedOrigin(origin) {
+				log.Printf("API: refused %s %s from origin %s", r.Method, r.URL.Path, origin)
+				http.Error(w, "origin not allowed", http.StatusForbidden)
+				return
+			}
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, "+apiSecretHeader)
+		}
+		if r.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		// EventSource cannot send the header
+		if !validSecret(r) && !(r.URL.Path == "/api/events" && validQuerySecret(r)) {
+			debugLog("API: refused %s %s without the API secret", r.Method, r.URL.Path)
+			http.Error(w, "missing or wrong API secret", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// localOnly refuses requests whose Host is not this server on the loopback
+// interface, so a website cannot reach the local pages through a DNS name
+// that resolves to 127.0.0.1
+func localOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isLocalHost(r.Host) {
+			log.Printf("Refused request for host %q", r.Host)
+			http.Error(w, "unknown host", http.StatusMisdirectedRequest)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// crossSiteRequest reports whether the browser says a request comes from
+// another site, e.g. a <script> tag on a website the user visits
+func crossSiteRequest(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "cross-site", "same-site":
+		return true
+	}
+	return false
+}
+
+// apiFetchScript is the JavaScript helper the local pages call the API with
+func apiFetchScript() string {
+	return `
+        // Local API requests carry the API secret
+        function apiFetch(url, options = {}) {
+            const headers = Object.assign({}, options.headers, { '` + apiSecretHeader + `': '` + apiSecret + `' });
+            return fetch(url, Object.assign({}, options, { headers: headers }));
+        }
+`
+}
+
+// csrfField is the hidden input the local forms post the CSRF token in
+func csrfField() string {
+	return `<input type="hidden" name="csrf_token" value="` + csrfToken() + `">`
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// The userscript stub carries the API secret, so a request for another
+// host is refused even without Sec-Fetch-Site, as sent by older browsers
+// and non-browser clients on the LAN
+func TestUserscriptRefusesForeignHost(t *testing.T) {
+	configMu.Lock()
+	config.Port = 9998
+	configMu.Unlock()
+	apiSecret = "test-secret"
+
+	for _, handler := range []http.Handler{
+		http.HandlerFunc(userscriptHandler),
+		localOnly(http.HandlerFunc(userscriptHandler)),
+	} {
+		req := httptest.NewRequest("GET", "http://192.168.1.5:9998/jellyfin-external-player.user.js", nil)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code == http.StatusOK {
+			t.Errorf("foreign host: status %d, want it refused", rec.Code)
+		}
+		if strings.Contains(rec.Body.String(), apiSecret) {
+			t.Errorf("foreign host: response carries the API secret")
+		}
+	}
+
+	req := httptest.NewRequest("GET", "http://localhost:9998/jellyfin-external-player.user.js", nil)
+	rec := httptest.NewRecorder()
+	localOnly(http.HandlerFunc(userscriptHandler)).ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), apiSecret) {
+		t.Errorf("localhost: status %d, want the stub with the API secret", rec.Code)
+	}
+}
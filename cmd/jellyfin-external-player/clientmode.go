@@ -0,0 +1,491 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClientConfig configures native client mode, in which this program logs
+// into a Jellyfin server as its own device and can be controlled from any
+// Jellyfin app ("Play on" / cast).
+// The access token of the login is kept in the credential store under
+// ServerURL.
+type ClientConfig struct {
+	Enabled    bool   `json:"enabled"`
+	ServerURL  string `json:"server_url"`
+	Username   string `json:"username"`
+	DeviceId   string `json:"device_id"`   // Generated once so the server keeps one device entry
+	DeviceName string `json:"device_name"` // Shown in Jellyfin apps (default: host name)
+}
+
+const (
+	// Delay before reconnecting after the WebSocket drops; doubled on each failure
+	clientReconnectMin = 5 * time.Second
+	clientReconnectMax = 2 * time.Minute
+	// KeepAlive interval used until the server sends ForceKeepAlive
+	clientKeepAliveDefault = 30 * time.Second
+	// Volume step for VolumeUp/VolumeDown, as in the Jellyfin web client
+	clientVolumeStep = 2
+)
+
+// General commands advertised to the server
+var clientSupportedCommands = []string{
+	"SetVolume", "VolumeUp", "VolumeDown", "Mute", "Unmute", "ToggleMute", "DisplayMessage",
+	"ToggleFullscreen", "TakeScreenshot",
+}
+
+var clientMode struct {
+	mu   sync.Mutex
+	stop chan struct{} // Closed to end the running session
+}
+
+// newDeviceId returns a random device ID
+func newDeviceId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("jellyfin-external-player-%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// clientCredential returns the stored login of client mode: the credential
+// of its server, if it belongs to its user
+func clientCredential(cc ClientConfig) (serverCredential, bool) {
+	if cc.ServerURL == "" {
+		return serverCredential{}, false
+	}
+	cred, ok := credentials.lookup(cc.ServerURL)
+	if !ok || cred.AccessToken == "" {
+		return serverCredential{}, false
+	}
+	if cred.UserName != "" && !strings.EqualFold(cred.UserName, cc.Username) {
+		return serverCredential{}, false
+	}
+	return cred, true
+}
+
+// clientModeClient returns the API client for client mode, or false if
+// client mode is disabled or not logged in
+func clientModeClient() (*jellyfinClient, bool) {
+	configMu.RLock()
+	cc := config.Client
+	configMu.RUnlock()
+
+	if !cc.Enabled || cc.DeviceId == "" {
+		return nil, false
+	}
+	cred, ok := clientCredential(cc)
+	if !ok {
+		return nil, false
+	}
+	return &jellyfinClient{
+		ServerURL:  cred.ServerURL,
+		UserId:     cred.UserId,
+		Token:      cred.AccessToken,
+		DeviceId:   cc.DeviceId,
+		DeviceName: cc.DeviceName,
+	}, true
+}
+
+// migrateClientToken moves the client mode login that older versions kept
+// in config.json to the credential store, and saves the config without it
+func migrateClientToken() {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return
+	}
+	var old struct {
+		Client struct {
+			ServerURL   string `json:"server_url"`
+			Username    string `json:"username"`
+			UserId      string `json:"user_id"`
+			AccessToken string `json:"access_token"`
+		} `json:"client"`
+	}
+	if json.Unmarshal(data, &old) != nil || old.Client.AccessToken == "" || old.Client.ServerURL == "" {
+		return
+	}
+
+	err = credentials.put(serverCredential{
+		ServerURL:   old.Client.ServerURL,
+		UserId:      old.Client.UserId,
+		UserName:    old.Client.Username,
+		AccessToken: old.Client.AccessToken,
+	})
+	if err != nil {
+		log.Printf("Client mode: failed to move the access token to the credential store: %v", err)
+		return
+	}
+	if err := saveConfig(); err != nil {
+		log.Printf("Client mode: failed to remove the access token from the config: %v", err)
+		return
+	}
+	log.Printf("Client mode: moved the access token of %s to the credential store", old.Client.ServerURL)
+}
+
+// restartClientMode ends the running client session, if any, and starts a
+// new one if client mode is enabled. Called at startup and when the client
+// settings change.
+func restartClientMode() {
+	clientMode.mu.Lock()
+	defer clientMode.mu.Unlock()
+
+	if clientMode.stop != nil {
+		close(clientMode.stop)
+		clientMode.stop = nil
+	}
+
+	c, ok := clientModeClient()
+	if !ok {
+		return
+	}
+	stop := make(chan struct{})
+	clientMode.stop = stop
+	go runClientMode(c, stop)
+}
+
+// runClientMode keeps a client session open, reconnecting with backoff,
+// until stop is closed
+func runClientMode(c *jellyfinClient, stop <-chan struct{}) {
+	log.Printf("Client mode: connecting to %s as device %q", c.ServerURL, c.DeviceId)
+	backoff := clientReconnectMin
+
+	for {
+		started := time.Now()
+		err := runClientSession(c, stop)
+
+		select {
+		case <-stop:
+			log.Printf("Client mode: stopped")
+			return
+		default:
+		}
+
+		if time.Since(started) > time.Minute {
+			backoff = clientReconnectMin
+		}
+		log.Printf("Client mode: disconnected (%v), reconnecting in %v", err, backoff)
+
+		select {
+		case <-stop:
+			log.Printf("Client mode: stopped")
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > clientReconnectMax {
+			backoff = clientReconnectMax
+		}
+	}
+}
+
+// clientMessage is a message on the Jellyfin /socket WebSocket
+type clientMessage struct {
+	MessageType string          `json:"MessageType"`
+	Data        json.RawMessage `json:"Data,omitempty"`
+}
+
+// runClientSession announces our capabilities, then handles remote control
+// messages until the WebSocket closes or stop is closed
+func runClientSession(c *jellyfinClient, stop <-chan struct{}) error {
+	capabilities := map[string]interface{}{
+		"PlayableMediaTypes":           []string{"Video"},
+		"SupportedCommands":            clientSupportedCommands,
+		"SupportsMediaControl":         true,
+		"SupportsPersistentIdentifier": true,
+	}
+	if err := c.do("POST", "/Sessions/Capabilities/Full", capabilities, nil); err != nil {
+		return err
+	}
+
+	wsURL, err := webSocketURL(c.ServerURL, "/socket", url.Values{
+		"api_key":  {c.Token},
+		"deviceId": {c.DeviceId},
+	})
+	if err != nil {
+		return err
+	}
+	ws, err := dialWebSocket(wsURL, http.Header{"Authorization": {c.authHeader()}})
+	if err != nil {
+		return err
+	}
+	log.Printf("Client mode: connected to %s", c.ServerURL)
+
+	// Close the socket when asked to stop, which ends the read loop
+	ended := make(chan struct{})
+	defer close(ended)
+	keepAlive := make(chan time.Duration, 1)
+	go func() {
+		interval := clientKeepAliveDefault
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				ws.Close()
+				return
+			case <-ended:
+				ws.Close()
+				return
+			case interval = <-keepAlive:
+				ticker.Reset(interval)
+			case <-ticker.C:
+				// A failed write means the connection is gone; closing it
+				// ends the read loop, so the session reconnects
+				if err := ws.WriteMessage([]byte(`{"MessageType":"KeepAlive"}`)); err != nil {
+					log.Printf("Client mode: keepalive failed, reconnecting: %v", err)
+					ws.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	// Without a frame for two keepalive intervals the connection counts as
+	// dropped, e.g. by a NAT or proxy that did not close it
+	ws.SetReadTimeout(2 * clientKeepAliveDefault)
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			return err
+		}
+
+		var msg clientMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			debugLog("Client mode: ignoring malformed message: %v", err)
+			continue
+		}
+
+		switch msg.MessageType {
+		case "ForceKeepAlive":
+			// Data is the server's timeout in seconds; send at half of it
+			var seconds float64
+			if json.Unmarshal(msg.Data, &seconds) == nil && seconds > 0 {
+				interval := time.Duration(seconds * float64(time.Second) / 2)
+				ws.SetReadTimeout(2 * interval)
+				select {
+				case keepAlive <- interval:
+				default:
+				}
+			}
+		case "KeepAlive":
+		case "Play":
+			go handleClientPlay(c, msg.Data)
+		case "Playstate":
+			handleClientPlaystate(msg.Data)
+		case "GeneralCommand":
+			handleClientGeneralCommand(msg.Data)
+		default:
+			debugLog("Client mode: ignoring %s message", msg.MessageType)
+		}
+	}
+}
+
+// handleClientPlay starts playback of the items in a Play message,
+// replacing whatever is playing
+func handleClientPlay(c *jellyfinClient, data json.RawMessage) {
+	var req struct {
+		ItemIds             []string `json:"ItemIds"`
+		StartPositionTicks  int64    `json:"StartPositionTicks"`
+		PlayCommand         string   `json:"PlayCommand"` // PlayNow, PlayNext, PlayLast, ...
+		MediaSourceId       string   `json:"MediaSourceId"`
+		AudioStreamIndex    *int     `json:"AudioStreamIndex"`
+		SubtitleStreamIndex *int     `json:"SubtitleStreamIndex"`
+		StartIndex          int      `json:"StartIndex"`
+	}
+	if err := json.Unmarshal(data, &req); err != nil {
+		log.Printf("Client mode: invalid Play message: %v", err)
+		return
+	}
+	log.Printf("Client mode: %s %d item(s)", req.PlayCommand, len(req.ItemIds))
+
+	// Client mode plays on the default display
+	running := sessions.onDisplay("")
+	queue := running != nil && (req.PlayCommand == "PlayNext" || req.PlayCommand == "PlayLast")
+
+	if req.StartIndex > 0 && req.StartIndex < len(req.ItemIds) {
+		req.ItemIds = req.ItemIds[req.StartIndex:]
+	}
+	if len(req.ItemIds) == 0 {
+		return
+	}
+
+	items, err := c.getItems(req.ItemIds)
+	if err != nil {
+		log.Printf("Client mode: failed to look up items: %v", err)
+		return
+	}
+	if len(items) == 0 {
+		log.Printf("Client mode: none of the requested items were found")
+		return
+	}
+
+	var plist []PlaylistItem
+	for _, item := range items {
+		plist = append(plist, newPlaylistItem(item, ""))
+	}
+	// The version and tracks picked in the app apply to the first item
+	plist[0] = newPlaylistItem(items[0], req.MediaSourceId)
+	plist[0].AudioStreamIndex = req.AudioStreamIndex
+	plist[0].SubtitleStreamIndex = req.SubtitleStreamIndex
+
+	if queue && normalizeServerURL(running.serverURL) != normalizeServerURL(c.ServerURL) {
+		// Its reports would go to the other server
+		log.Printf("Client mode: session %s plays from another server, replacing it", running.ID)
+		queue = false
+	}
+	if queue {
+		if err := queueAdd(running, plist, req.PlayCommand == "PlayNext"); err != nil {
+			log.Printf("Client mode: %s failed: %v", req.PlayCommand, err)
+		}
+		return
+	}
+
+	// Replace the running player, whatever the instance policy: the app
+	// asked to play this now
+	startMu.Lock()
+	defer startMu.Unlock()
+	if running := sessions.onDisplay(""); running != nil {
+		replacePlayer(running)
+	}
+
+	_, err = startPlaylist(PlaylistRequest{
+		Items:              plist,
+		ServerURL:          c.ServerURL,
+		UserID:             c.UserId,
+		Token:              c.Token,
+		StartPositionTicks: req.StartPositionTicks,
+	})
+	if err != nil {
+		log.Printf("Client mode: failed to start player: %v", err)
+	}
+}
+
+// handleClientPlaystate handles pause, seek, stop and track changes
+func handleClientPlaystate(data json.RawMessage) {
+	var req struct {
+		Command           string `json:"Command"`
+		SeekPositionTicks int64  `json:"SeekPositionTicks"`
+	}
+	if err := json.Unmarshal(data, &req); err != nil {
+		log.Printf("Client mode: invalid Playstate message: %v", err)
+		return
+	}
+	debugLog("Client mode: Playstate %s", req.Command)
+
+	if req.Command == "Stop" {
+		stopPlayer(sessions.onDisplay(""))
+		return
+	}
+
+	s := sessions.onDisplay("")
+	if s == nil {
+		debugLog("Client mode: Playstate %s ignored, nothing is playing", req.Command)
+		return
+	}
+
+	var err error
+	switch req.Command {
+	case "Pause":
+		err = controlPlayer(s, "pause", 0)
+	case "Unpause":
+		err = controlPlayer(s, "resume", 0)
+	case "PlayPause":
+		err = controlPlayer(s, "toggle-pause", 0)
+	case "Seek":
+		err = controlPlayer(s, "seek", float64(req.SeekPositionTicks)/10000000)
+	case "NextTrack":
+		err = controlPlayer(s, "next", 0)
+	case "PreviousTrack":
+		err = controlPlayer(s, "previous", 0)
+	case "FastForward":
+		// Same steps as the Jellyfin web client
+		err = controlPlayer(s, "seek-relative", 30)
+	case "Rewind":
+		err = controlPlayer(s, "seek-relative", -10)
+	default:
+		debugLog("Client mode: ignoring Playstate %s", req.Command)
+		return
+	}
+	if err != nil {
+		log.Printf("Client mode: Playstate %s failed: %v", req.Command, err)
+	}
+}
+
+// handleClientGeneralCommand handles volume and message commands
+func handleClientGeneralCommand(data json.RawMessage) {
+	var req struct {
+		Name      string            `json:"Name"`
+		Arguments map[string]string `json:"Arguments"`
+	}
+	if err := json.Unmarshal(data, &req); err != nil {
+		log.Printf("Client mode: invalid GeneralCommand message: %v", err)
+		return
+	}
+	debugLog("Client mode: GeneralCommand %s", req.Name)
+
+	s := sessions.onDisplay("")
+	if s == nil {
+		debugLog("Client mode: GeneralCommand %s ignored, nothing is playing", req.Name)
+		return
+	}
+
+	var err error
+	switch req.Name {
+	case "SetVolume":
+		var volume float64
+		if volume, err = strconv.ParseFloat(req.Arguments["Volume"], 64); err == nil {
+			err = controlPlayer(s, "volume", volume)
+		}
+	case "VolumeUp", "VolumeDown":
+		step := float64(clientVolumeStep)
+		if req.Name == "VolumeDown" {
+			step = -step
+		}
+		var status PlayerStatus
+		if status, err = s.player.Status(); err == nil {
+			err = controlPlayer(s, "volume", status.Volume+step)
+		}
+	case "Mute":
+		err = controlPlayer(s, "mute", 0)
+	case "Unmute":
+		err = controlPlayer(s, "unmute", 0)
+	case "ToggleMute":
+		err = controlPlayer(s, "toggle-mute", 0)
+	case "ToggleFullscreen":
+		err = controlPlayer(s, "toggle-fullscreen", 0)
+	case "TakeScreenshot":
+		err = controlPlayer(s, "screenshot", 0)
+	case "DisplayMessage":
+		transport, ok := s.player.(transportController)
+		if !ok {
+			err = errControlUnsupported
+			break
+		}
+		text := req.Arguments["Text"]
+		if header := req.Arguments["Header"]; header != "" {
+			text = header + "\n" + text
+		}
+		timeout := 5 * time.Second
+		if ms, convErr := strconv.Atoi(req.Arguments["TimeoutMs"]); convErr == nil && ms > 0 {
+			timeout = time.Duration(ms) * time.Millisecond
+		}
+		err = transport.ShowMessage(text, timeout)
+	default:
+		debugLog("Client mode: ignoring GeneralCommand %s", req.Name)
+		return
+	}
+	if err != nil {
+		log.Printf("Client mode: GeneralCommand %s failed: %v", req.Name, err)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakePlayer is a player stopped mid-item that records playlist steps
+type fakePlayer struct {
+	status PlayerStatus
+	events playerEventHub
+	next   int
+}
+
+func (p *fakePlayer) LaunchArgs() []string                           { return nil }
+func (p *fakePlayer) PlaylistArgs(req launchRequest) []string        { return nil }
+func (p *fakePlayer) Attach(cmd *exec.Cmd)                           {}
+func (p *fakePlayer) Status() (PlayerStatus, error)                  { return p.status, nil }
+func (p *fakePlayer) SetPause(paused bool) error                     { return nil }
+func (p *fakePlayer) Quit() error                                    { return nil }
+func (p *fakePlayer) PlaylistIndex() (int, error)                    { return p.status.PlaylistPos, nil }
+func (p *fakePlayer) Subscribe() (<-chan playerEvent, func())        { return p.events.subscribe() }
+func (p *fakePlayer) Close()                                         { p.events.close() }
+func (p *fakePlayer) Seek(position float64) error                    { return nil }
+func (p *fakePlayer) PlaylistNext() error                            { p.next++; return nil }
+func (p *fakePlayer) PlaylistPrev() error                            { p.next--; return nil }
+func (p *fakePlayer) SetVolume(percent float64) error                { return nil }
+func (p *fakePlayer) SetMute(muted bool) error                       { return nil }
+func (p *fakePlayer) ShowMessage(text string, d time.Duration) error { return nil }
+
+// A NextTrack from a Jellyfin remote halfway through an episode reports it
+// stopped where it was left, without marking it played
+func TestClientNextTrackDoesNotMarkPlayed(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []string
+		stopped  map[string]interface{}
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, r.URL.Path)
+		if r.URL.Path == "/Sessions/Playing/Stopped" {
+			json.NewDecoder(r.Body).Decode(&stopped)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	player := &fakePlayer{status: PlayerStatus{Playing: true, Position: 600, Duration: 1400}}
+	s := &playerSession{
+		ID:        "test-next-track",
+		player:    player,
+		serverURL: server.URL,
+		userId:    "user",
+		token:     "token",
+		exited:    make(chan struct{}),
+		playlist:  []PlaylistItem{{ItemId: "episode1"}, {ItemId: "episode2"}},
+		playback:  newPlaybackSession("episode1", "", ""),
+	}
+	sessions.add(s)
+	defer sessions.remove(s)
+
+	handleClientPlaystate(json.RawMessage(`{"Command":"NextTrack"}`))
+	if player.next != 1 {
+		t.Fatalf("player was not moved to the next entry")
+	}
+
+	// The position change mpv reports after playlist-next
+	if !playlistAdvanced(s, 1, 1400) {
+		t.Fatalf("playlist position change was ignored")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, path := range requests {
+		if strings.Contains(path, "/PlayedItems/") {
+			t.Errorf("skipped item was marked played (%s)", path)
+		}
+	}
+	if stopped == nil {
+		t.Fatalf("no stop report was sent")
+	}
+	if ticks, _ := stopped["PositionTicks"].(float64); ticks != 600*10000000 {
+		t.Errorf("stop report position = %v ticks, want %d", stopped["PositionTicks"], 600*10000000)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+var errControlUnsupported = errors.New("the player does not support this action")
+
+// controlRequest is the JSON body of /api/control
+type controlRequest struct {
+	Action string   `json:"action"`
+	Value  *float64 `json:"value"` // Seconds, volume percent or track number, depending on the action
+}
+
+// controlActions lists the actions of /api/control and whether they need a value
+var controlActions = map[string]bool{
+	"pause":             false,
+	"resume":            false,
+	"toggle-pause":      false,
+	"seek":              true, // To value seconds
+	"seek-relative":     true, // By value seconds, back if negative
+	"volume":            true, // To value percent
+	"mute":              false,
+	"unmute":            false,
+	"toggle-mute":       false,
+	"chapter-next":      false,
+	"chapter-prev":      false,
+	"next":              false, // Next playlist entry
+	"previous":          false,
+	"audio":             true, // Audio track number
+	"subtitle":          true, // Subtitle track number, 0 = off
+	"toggle-fullscreen": false,
+	"screenshot":        false,
+}
+
+// controlPlayer carries out a transport action on the player of a session
+func controlPlayer(s *playerSession, action string, value float64) error {
+	if s == nil {
+		return errNothingPlaying
+	}
+	player := s.player
+	transport, _ := player.(transportController)
+	media, _ := player.(mediaController)
+
+	switch action {
+	case "pause", "resume":
+		return player.SetPause(action == "pause")
+	case "toggle-pause":
+		status, err := player.Status()
+		if err != nil {
+			return err
+		}
+		return player.SetPause(!status.Paused)
+	}
+
+	switch action {
+	case "seek", "seek-relative", "volume", "mute", "unmute", "toggle-mute", "next", "previous":
+		if transport == nil {
+			return errControlUnsupported
+		}
+	default:
+		if media == nil {
+			return errControlUnsupported
+		}
+	}
+
+	switch action {
+	case "seek":
+		return transport.Seek(max(value, 0))
+	case "seek-relative":
+		status, err := player.Status()
+		if err != nil {
+			return err
+		}
+		return transport.Seek(max(status.Position+value, 0))
+	case "volume":
+		return transport.SetVolume(min(max(value, 0), 100))
+	case "mute", "unmute":
+		return transport.SetMute(action == "mute")
+	case "toggle-mute":
+		status, err := player.Status()
+		if err != nil {
+			return err
+		}
+		return transport.SetMute(!status.Muted)
+	case "next":
+		return playlistStep(s, transport, 1)
+	case "previous":
+		return playlistStep(s, transport, -1)
+	case "chapter-next":
+		return media.ChapterStep(1)
+	case "chapter-prev":
+		return media.ChapterStep(-1)
+	case "audio":
+		return media.SetAudioTrack(int(value))
+	case "subtitle":
+		return media.SetSubtitleTrack(int(value))
+	case "toggle-fullscreen":
+		return media.ToggleFullscreen()
+	case "screenshot":
+		return media.Screenshot()
+	}
+	return fmt.Errorf("unknown action %q", action)
+}
+
+// playlistStep moves to the next (step 1) or previous (step -1) playlist
+// entry. Like a queue jump, the position reached in the current entry is
+// reported instead of marking it finished.
+func playlistStep(s *playerSession, transport transportController, step int) error {
+	queueMu.Lock()
+	defer queueMu.Unlock()
+
+	getPlaybackInfo(s) // Updates lastPosition
+	s.mu.Lock()
+	target := s.playlistPosition + step
+	if target < 0 || target >= len(s.playlist) {
+		s.mu.Unlock()
+		return fmt.Errorf("no playlist entry %d", target)
+	}
+	s.playlistJumped = true
+	s.mu.Unlock()
+
+	var err error
+	if step > 0 {
+		err = transport.PlaylistNext()
+	} else {
+		err = transport.PlaylistPrev()
+	}
+	if err != nil {
+		s.mu.Lock()
+		s.playlistJumped = false
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// controlHandler carries out transport actions on a running player (POST
+// /api/control). The "session" parameter picks the player session; without
+// it the most recently started one is used.
+func controlHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req controlRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	needsValue, ok := controlActions[req.Action]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown action %q", req.Action), http.StatusBadRequest)
+		return
+	}
+	value := 0.0
+	if req.Value != nil {
+		value = *req.Value
+	} else if needsValue {
+		http.Error(w, fmt.Sprintf("action %q needs a value", req.Action), http.StatusBadRequest)
+		return
+	}
+
+	s := sessions.get(r.URL.Query().Get("session"))
+	if err := controlPlayer(s, req.Action, value); err != nil {
+		status := http.StatusInternalServerError
+		switch err {
+		case errNothingPlaying:
+			status = http.StatusConflict
+		case errControlUnsupported:
+			status = http.StatusNotImplemented
+		}
+		log.Printf("Control: %s failed: %v", req.Action, err)
+		http.Error(w, err.Error(), status)
+		return
+	}
+	debugLog("Control: %s on session %s", req.Action, s.ID)
+
+	playerStatus, _ := getPlaybackInfo(s)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":   "ok",
+		"session":  s.ID,
+		"paused":   playerStatus.Paused,
+		"position": playerStatus.Position,
+		"duration": playerStatus.Duration,
+		"volume":   playerStatus.Volume,
+		"muted":    playerStatus.Muted,
+	})
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// File next to config.json that holds the access token of each server
+const credentialsFile = "credentials.json"
+
+// serverCredential is what we need to act as a user on one server
+type serverCredential struct {
+	ServerURL   string    `json:"server_url"`
+	UserId      string    `json:"user_id"`
+	UserName    string    `json:"user_name,omitempty"`
+	AccessToken string    `json:"access_token"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// client returns a Jellyfin API client using the credential
+func (c serverCredential) client() *jellyfinClient {
+	return &jellyfinClient{ServerURL: c.ServerURL, UserId: c.UserId, Token: c.AccessToken}
+}
+
+// credentialStore keeps one credential per server URL, so play requests
+// only need to name the server and the item instead of carrying a token
+type credentialStore struct {
+	mu      sync.Mutex
+	path    string
+	servers map[string]serverCredential
+}
+
+var credentials = &credentialStore{servers: map[string]serverCredential{}}
+
+// normalizeServerURL returns the form server URLs are stored under
+func normalizeServerURL(serverURL string) string {
+	return strings.TrimSuffix(strings.TrimSpace(serverURL), "/")
+}
+
+// load reads the stored credentials
+func (s *credentialStore) load(configDir string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.path = filepath.Join(configDir, credentialsFile)
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Credentials: failed to read %s: %v", s.path, err)
+		}
+		return
+	}
+	var list []serverCredential
+	if err := json.Unmarshal(data, &list); err != nil {
+		log.Printf("Credentials: ignoring unreadable %s: %v", s.path, err)
+		return
+	}
+	for _, c := range list {
+		s.servers[normalizeServerURL(c.ServerURL)] = c
+	}
+	debugLog("Credentials: loaded %d server(s)", len(s.servers))
+}
+
+// saveLocked writes the store to disk. The file holds access tokens, so it
+// is only readable by the user.
+func (s *credentialStore) saveLocked() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.listLocked(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.path, data, 0600)
+}
+
+// listLocked returns the credentials sorted by server URL
+func (s *credentialStore) listLocked() []serverCredential {
+	list := make([]serverCredential, 0, len(s.servers))
+	for _, c := range s.servers {
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ServerURL < list[j].ServerURL })
+	return list
+}
+
+// list returns all stored credentials
+func (s *credentialStore) list() []serverCredential {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.listLocked()
+}
+
+// lookup returns the credential of a server. An empty server URL selects the
+// only stored server, if there is exactly one.
+func (s *credentialStore) lookup(serverURL string) (serverCredential, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if serverURL == "" {
+		if len(s.servers) != 1 {
+			return serverCredential{}, false
+		}
+		for _, c := range s.servers {
+			return c, true
+		}
+	}
+	c, ok := s.servers[normalizeServerURL(serverURL)]
+	return c, ok
+}
+
+// put stores the credential of a server, replacing any previous one
+func (s *credentialStore) put(c serverCredential) error {
+	c.ServerURL = normalizeServerURL(c.ServerURL)
+	c.UpdatedAt = time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.servers[c.ServerURL] = c
+	return s.saveLocked()
+}
+
+// remove forgets the credential of a server
+func (s *credentialStore) remove(serverURL string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := normalizeServerURL(serverURL)
+	if _, ok := s.servers[key]; !ok {
+		return false, nil
+	}
+	delete(s.servers, key)
+	return true, s.saveLocked()
+}
+
+// verifyCredential checks a token against the server and fills in the user
+// it belongs to
+func verifyCredential(serverURL, token string) (serverCredential, error) {
+	c := &jellyfinClient{ServerURL: normalizeServerURL(serverURL), Token: token}
+	var user struct {
+		Id   string `json:"Id"`
+		Name string `json:"Name"`
+	}
+	if err := c.do("GET", "/Users/Me", nil, &user); err != nil {
+		return serverCredential{}, err
+	}
+	if user.Id == "" {
+		return serverCredential{}, fmt.Errorf("server returned no user")
+	}
+	return serverCredential{ServerURL: c.ServerURL, UserId: user.Id, UserName: user.Name, AccessToken: token}, nil
+}
+
+// Query parameters and JSON fields that carry secrets
+var secretPattern = regexp.MustCompile(`(?i)((?:[?&](?:api_key|apikey|token|access_token|x-emby-token|secret)=)|(?:"(?:token|access_token|password|pw)"\s*:\s*"))[^&\s"]*`)
+
+// redact hides access tokens and passwords in text that is about to be
+// logged, such as stream URLs and player command lines
+func redact(s string) string {
+	return secretPattern.ReplaceAllString(s, "${1}REDACTED")
+}
+
+// credentialsHandler lists, adds and removes server credentials. Adding
+// takes either a token (sent by the userscript on its first request) or a
+// user name and password (the one-time login on the config page); tokens
+// are checked against the server before they are stored and never returned.
+func credentialsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		list := credentials.list()
+		servers := make([]map[string]interface{}, 0, len(list))
+		for _, c := range list {
+			servers = append(servers, map[string]interface{}{
+				"serverUrl": c.ServerURL,
+				"userId":    c.UserId,
+				"userName":  c.UserName,
+				"updatedAt": c.UpdatedAt,
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"servers": servers})
+		return
+
+	case "POST":
+		var req struct {
+			ServerURL string `json:"serverUrl"`
+			Token     string `json:"token"`
+			Username  string `json:"username"`
+			Password  string `json:"password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.ServerURL == "" {
+			http.Error(w, "missing serverUrl", http.StatusBadRequest)
+			return
+		}
+
+		token := req.Token
+		if token == "" {
+			if req.Username == "" {
+				http.Error(w, "missing token or username", http.StatusBadRequest)
+				return
+			}
+			c := &jellyfinClient{ServerURL: normalizeServerURL(req.ServerURL)}
+			if err := c.authenticateByName(req.Username, req.Password); err != nil {
+				log.Printf("Credentials: login to %s as %s failed: %v", c.ServerURL, req.Username, err)
+				http.Error(w, fmt.Sprintf("login failed: %v", err), http.StatusUnauthorized)
+				return
+			}
+			token = c.Token
+		}
+
+		cred, err := verifyCredential(req.ServerURL, token)
+		if err != nil {
+			log.Printf("Credentials: rejected token for %s: %v", normalizeServerURL(req.ServerURL), err)
+			http.Error(w, fmt.Sprintf("invalid credentials: %v", err), http.StatusUnauthorized)
+			return
+		}
+		if old, ok := credentials.lookup(cred.ServerURL); !ok || old.AccessToken != cred.AccessToken {
+			if err := credentials.put(cred); err != nil {
+				http.Error(w, fmt.Sprintf("failed to save: %v", err), http.StatusInternalServerError)
+				return
+			}
+			log.Printf("Credentials: stored %s for user %s", cred.ServerURL, cred.UserName)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"serverUrl": cred.ServerURL,
+			"userId":    cred.UserId,
+			"userName":  cred.UserName,
+		})
+		return
+
+	case "DELETE":
+		serverURL := r.URL.Query().Get("serverUrl")
+		removed, err := credentials.remove(serverURL)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to save: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if !removed {
+			http.Error(w, "unknown server", http.StatusNotFound)
+			return
+		}
+		log.Printf("Credentials: removed %s", normalizeServerURL(serverURL))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "removed"})
+		return
+	}
+
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+)
+
+// Where specials (season 0) go in a series playlist
+const (
+	specialsAired = "aired" // Where they aired, from their "airs before/after" metadata
+	specialsFirst = "first"
+	specialsLast  = "last"
+	specialsSkip  = "skip"
+)
+
+var specialsPlacements = []string{specialsAired, specialsFirst, specialsLast, specialsSkip}
+
+// getPlaylistOptions returns how series playlists are built
+func getPlaylistOptions() (skipPlayed bool, specials string) {
+	configMu.RLock()
+	defer configMu.RUnlock()
+
+	specials = config.Specials
+	switch specials {
+	case specialsFirst, specialsLast, specialsSkip:
+	default:
+		specials = specialsAired
+	}
+	return config.SkipPlayed, specials
+}
+
+// episodeKey orders episodes: by season, then by episode, with specials
+// aired before an episode coming just before it
+type episodeKey struct {
+	season  int
+	episode int
+	slot    int // -1 = special before the episode, 0 = the episode itself
+	special int // Number of the special among the specials
+}
+
+func (a episodeKey) less(b episodeKey) bool {
+	if a.season != b.season {
+		return a.season < b.season
+	}
+	if a.episode != b.episode {
+		return a.episode < b.episode
+	}
+	if a.slot != b.slot {
+		return a.slot < b.slot
+	}
+	return a.special < b.special
+}
+
+func intOr(p *int, def int) int {
+	if p == nil {
+		return def
+	}
+	return *p
+}
+
+// episodeSortKey returns where an episode goes, or false if it is a
+// special that is left out
+func episodeSortKey(e jellyfinItem, specials string) (episodeKey, bool) {
+	if intOr(e.ParentIndexNumber, -1) != 0 {
+		// Episodes without a season number go last
+		return episodeKey{season: intOr(e.ParentIndexNumber, math.MaxInt32), episode: intOr(e.IndexNumber, 0)}, true
+	}
+
+	key := episodeKey{special: intOr(e.IndexNumber, 0)}
+	switch specials {
+	case specialsSkip:
+		return key, false
+	case specialsFirst:
+		key.season = math.MinInt32
+	case specialsLast:
+		key.season = math.MaxInt32
+	default:
+		switch {
+		case e.AirsBeforeSeasonNumber != nil && e.AirsBeforeEpisodeNumber != nil:
+			key.season = *e.AirsBeforeSeasonNumber
+			key.episode = *e.AirsBeforeEpisodeNumber
+			key.slot = -1
+		case e.AirsBeforeSeasonNumber != nil:
+			key.season = *e.AirsBeforeSeasonNumber
+			key.episode = math.MinInt32
+		case e.AirsAfterSeasonNumber != nil:
+			key.season = *e.AirsAfterSeasonNumber
+			key.episode = math.MaxInt32
+		default:
+			// No air date information: after everything else
+			key.season = math.MaxInt32
+			key.episode = math.MaxInt32
+		}
+	}
+	return key, true
+}
+
+// orderEpisodes sorts episodes by season and number and places the specials
+func orderEpisodes(episodes []jellyfinItem, specials string) []jellyfinItem {
+	type keyed struct {
+		item jellyfinItem
+		key  episodeKey
+	}
+	var list []keyed
+	for _, e := range episodes {
+		if key, ok := episodeSortKey(e, specials); ok {
+			list = append(list, keyed{e, key})
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].key.less(list[j].key) })
+
+	ordered := make([]jellyfinItem, 0, len(list))
+	for _, k := range list {
+		ordered = append(ordered, k.item)
+	}
+	return ordered
+}
+
+func isPlayed(item jellyfinItem) bool {
+	return item.UserData != nil && item.UserData.Played
+}
+
+// nextUpIndex returns the episode to start at: the series' next up episode
+// if it is in the list, otherwise the first one not played yet. When all
+// of them are played, it starts over.
+func nextUpIndex(c *jellyfinClient, seriesId string, episodes []jellyfinItem) int {
+	next, ok, err := c.getNextUp(seriesId)
+	if err != nil {
+		log.Printf("Failed to get next up episode of series %s: %v", seriesId, err)
+	} else if ok {
+		for i, e := range episodes {
+			if e.Id == next.Id {
+				return i
+			}
+		}
+	}
+
+	for i, e := range episodes {
+		if !isPlayed(e) {
+			return i
+		}
+	}
+	return 0
+}
+
+// expandContainer returns the videos of a series, season, playlist or
+// collection in playing order. Series and seasons start at the next
+// episode to watch and may leave out the episodes already played.
+func expandContainer(c *jellyfinClient, container jellyfinItem) ([]jellyfinItem, error) {
+	if container.Type != "Series" && container.Type != "Season" {
+		return c.getChildren(container)
+	}
+
+	seriesId, seasonId := container.Id, ""
+	if container.Type == "Season" {
+		if container.SeriesId == "" {
+			return nil, fmt.Errorf("season %q has no series", container.Name)
+		}
+		seriesId, seasonId = container.SeriesId, container.Id
+	}
+
+	episodes, err := c.getEpisodes(seriesId, seasonId)
+	if err != nil {
+		return nil, err
+	}
+	skipPlayed, specials := getPlaylistOptions()
+	episodes = orderEpisodes(episodes, specials)
+	if len(episodes) == 0 {
+		return nil, nil
+	}
+
+	start := nextUpIndex(c, seriesId, episodes)
+	debugLog("Starting %s %q at episode %d of %d (%s)", container.Type, container.Name, start+1, len(episodes), episodes[start].Name)
+	episodes = episodes[start:]
+
+	if skipPlayed {
+		var unplayed []jellyfinItem
+		for _, e := range episodes {
+			if !isPlayed(e) {
+				unplayed = append(unplayed, e)
+			}
+		}
+		// Everything played means watching it again
+		if len(unplayed) > 0 {
+			episodes = unplayed
+		}
+	}
+	return episodes, nil
+}
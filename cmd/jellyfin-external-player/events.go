@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Event types sent on /api/events
+const (
+	stateEventLaunched         = "launched" // A player session started
+	stateEventPosition         = "position" // Playback position, at most once per positionEventInterval
+	stateEventPaused           = "paused"
+	stateEventResumed          = "resumed"
+	stateEventPlaylistAdvanced = "playlist-advanced" // Another playlist entry started
+	stateEventSubtitleChanged  = "subtitle-changed"  // The subtitle track changed (mpv)
+	stateEventExited           = "exited"            // The player exited, with its exit code
+	stateEventReportFailed     = "report-failed"     // A report to Jellyfin failed
+)
+
+const (
+	// Shortest time between two position events of a session
+	positionEventInterval = time.Second
+	// Interval of the comments that keep idle event streams open
+	eventKeepAliveInterval = 15 * time.Second
+)
+
+// stateEvent is a change of player state pushed to /api/events clients
+type stateEvent struct {
+	Type    string
+	Session string
+	Data    map[string]interface{}
+}
+
+// stateEventBroker fans state events out to the connected event streams.
+// Each subscriber may follow a single session.
+type stateEventBroker struct {
+	mu   sync.Mutex
+	subs map[chan stateEvent]string
+}
+
+var stateEvents = &stateEventBroker{subs: map[chan stateEvent]string{}}
+
+// subscribe returns a channel of the events of a session, or of all sessions
+// if session is empty, and a function to stop receiving them
+func (b *stateEventBroker) subscribe(session string) (<-chan stateEvent, func()) {
+	ch := make(chan stateEvent, 64)
+
+	b.mu.Lock()
+	b.subs[ch] = session
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		delete(b.subs, ch)
+		b.mu.Unlock()
+	}
+}
+
+// publish sends an event to its subscribers. Slow subscribers miss events
+// rather than holding up the player.
+func (b *stateEventBroker) publish(ev stateEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch, session := range b.subs {
+		if session != "" && session != ev.Session {
+			continue
+		}
+		select {
+		case ch <- ev:
+		default:
+			debugLog("Events: subscriber full, dropping %s event", ev.Type)
+		}
+	}
+}
+
+// publishEvent publishes an event of a player session
+func publishEvent(s *playerSession, eventType string, data map[string]interface{}) {
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	stateEvents.publish(stateEvent{Type: eventType, Session: s.ID, Data: data})
+}
+
+// runEventPublisher turns the player events of a session into state events
+// and publishes its position while it changes. It returns when done is
+// closed.
+func runEventPublisher(s *playerSession, done <-chan struct{}) {
+	events, unsubscribe := s.player.Subscribe()
+	defer unsubscribe()
+
+	ticker := time.NewTicker(positionEventInterval)
+	defer ticker.Stop()
+
+	lastPosition := -1.0
+	for {
+		select {
+		case <-done:
+			return
+
+		case <-ticker.C:
+			status, err := s.player.Status()
+			if err != nil || math.Abs(status.Position-lastPosition) < 0.5 {
+				continue
+			}
+			lastPosition = status.Position
+			publishEvent(s, stateEventPosition, map[string]interface{}{
+				"position": status.Position,
+				"duration": status.Duration,
+				"paused":   status.Paused,
+			})
+
+		case ev, ok := <-events:
+			if !ok {
+				events = nil // Control interface closed; wait for the process to exit
+				continue
+			}
+			switch ev.Type {
+			case playerEventPause:
+				publishEvent(s, stateEventPaused, nil)
+			case playerEventUnpause:
+				publishEvent(s, stateEventResumed, nil)
+			case playerEventSubtitle:
+				publishEvent(s, stateEventSubtitleChanged, map[string]interface{}{"subtitle": int(ev.Value)})
+			}
+		}
+	}
+}
+
+// eventsHandler streams state events as Server-Sent Events. The "session"
+// parameter limits the stream to one player session.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	events, unsubscribe := stateEvents.subscribe(r.URL.Query().Get("session"))
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+
+		case ev := <-events:
+			data := map[string]interface{}{"session": ev.Session}
+			for k, v := range ev.Data {
+				data[k] = v
+			}
+			body, err := json.Marshal(data)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, body)
+		}
+		flusher.Flush()
+	}
+}
+
+// publishReportFailed publishes a failed report to Jellyfin: the request
+// error, or the HTTP status the server answered with
+func publishReportFailed(s *playerSession, endpoint, itemId string, code int, err error) {
+	data := map[string]interface{}{
+		"endpoint": endpoint,
+		"itemId":   itemId,
+		"status":   code,
+	}
+	if err != nil {
+		data["error"] = err.Error()
+	}
+	publishEvent(s, stateEventReportFailed, data)
+}
@@ -14,8 +14,11 @@ func noConsole(cmd *exec.Cmd) {
 	// Nothing to do on Unix
 }
 
-// Default player path for Unix
-const defaultMpvPath = "mpv"
+// Default player paths for Unix
+const (
+	defaultMpvPath = "mpv"
+	defaultVlcPath = "vlc"
+)
 
 // fixPlayerPath is a no-op on Unix
 func fixPlayerPath(path string) string {
@@ -40,3 +43,11 @@ func findMpv() string {
 	}
 	return ""
 }
+
+// findVlc looks for vlc on Unix (just checks PATH)
+func findVlc() string {
+	if path, err := exec.LookPath("vlc"); err == nil {
+		return path
+	}
+	return ""
+}
@@ -42,12 +42,17 @@ func noConsole(cmd *exec.Cmd) {
 	}
 }
 
-// Default player path for Windows (use .exe to avoid console launcher)
-const defaultMpvPath = "mpv.exe"
+// Default player paths for Windows (use .exe to avoid console launcher)
+const (
+	defaultMpvPath = "mpv.exe"
+	defaultVlcPath = "vlc.exe"
+)
 
 var (
 	mpvPathCache   string
 	mpvPathChecked bool
+	vlcPathCache   string
+	vlcPathChecked bool
 )
 
 // fixPlayerPath ensures we use .exe on Windows to avoid console launchers
@@ -68,6 +73,21 @@ func fixPlayerPath(path string) string {
 		}
 		return "mpv.exe"
 	}
+	if path == "vlc" || path == "vlc.exe" {
+		if !vlcPathChecked {
+			vlcPathChecked = true
+			vlcPathCache = findVlc()
+			if vlcPathCache != "" {
+				log.Printf("Found vlc at: %s", vlcPathCache)
+			} else {
+				log.Printf("Warning: vlc not found in common locations. Install VLC or set full path in config.")
+			}
+		}
+		if vlcPathCache != "" {
+			return vlcPathCache
+		}
+		return "vlc.exe"
+	}
 	return path
 }
 
@@ -109,6 +129,24 @@ func findMpv() string {
 	return ""
 }
 
+// findVlc looks for vlc.exe in PATH and the standard VideoLAN install location
+func findVlc() string {
+	if path, err := exec.LookPath("vlc.exe"); err == nil {
+		return path
+	}
+
+	for _, pf := range []string{os.Getenv("ProgramFiles"), os.Getenv("ProgramFiles(x86)")} {
+		if pf != "" {
+			pfPath := filepath.Join(pf, "VideoLAN", "VLC", "vlc.exe")
+			if _, err := os.Stat(pfPath); err == nil {
+				return pfPath
+			}
+		}
+	}
+
+	return ""
+}
+
 // logToStderr returns false on Windows GUI apps (no console)
 func logToStderr() bool {
 	return false
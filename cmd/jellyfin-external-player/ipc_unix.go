@@ -3,7 +3,9 @@
 package main
 
 import (
+	"fmt"
 	"net"
+	"os"
 	"time"
 )
 
@@ -12,7 +14,7 @@ func connectMpvIPC(pipePath string) (net.Conn, error) {
 	return net.DialTimeout("unix", pipePath, 500*time.Millisecond)
 }
 
-// getMpvIPCPath returns the IPC socket path for mpv on Unix systems
-func getMpvIPCPath() string {
-	return "/tmp/jellyfin-external-player-mpv.sock"
+// getMpvIPCPath returns the IPC socket path of a session's mpv on Unix systems
+func getMpvIPCPath(sessionID string) string {
+	return fmt.Sprintf("/tmp/jellyfin-external-player-mpv-%d-%s.sock", os.Getpid(), sessionID)
 }
@@ -3,7 +3,9 @@
 package main
 
 import (
+	"fmt"
 	"net"
+	"os"
 
 	"github.com/Microsoft/go-winio"
 )
@@ -13,7 +15,7 @@ func connectMpvIPC(pipePath string) (net.Conn, error) {
 	return winio.DialPipe(pipePath, nil)
 }
 
-// getMpvIPCPath returns the IPC path for mpv on Windows
-func getMpvIPCPath() string {
-	return `\\.\pipe\jellyfin-external-player-mpv`
+// getMpvIPCPath returns the IPC path of a session's mpv on Windows
+func getMpvIPCPath(sessionID string) string {
+	return fmt.Sprintf(`\\.\pipe\jellyfin-external-player-mpv-%d-%s`, os.Getpid(), sessionID)
 }
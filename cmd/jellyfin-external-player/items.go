@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Item types played directly
+var videoItemTypes = []string{"Movie", "Episode", "MusicVideo", "Video", "Trailer"}
+
+// Item types expanded into a playlist of their videos
+var containerItemTypes = []string{"Season", "Series", "Playlist", "BoxSet"}
+
+func isVideoItemType(t string) bool {
+	for _, v := range videoItemTypes {
+		if v == t {
+			return true
+		}
+	}
+	return false
+}
+
+func isContainerItemType(t string) bool {
+	for _, v := range containerItemTypes {
+		if v == t {
+			return true
+		}
+	}
+	return false
+}
+
+// unsupportedItemError is returned for items that are neither videos nor
+// containers of videos, which callers should leave to Jellyfin's own player
+type unsupportedItemError struct {
+	Type string
+}
+
+func (e *unsupportedItemError) Error() string {
+	return fmt.Sprintf("unsupported item type %q", e.Type)
+}
+
+// sourcePath returns the server-side path of one of an item's media
+// sources, or of the item itself
+func sourcePath(item jellyfinItem, mediaSourceId string) string {
+	if mediaSourceId != "" {
+		for _, src := range item.MediaSources {
+			if src.Id == mediaSourceId && src.Path != "" {
+				return src.Path
+			}
+		}
+	}
+	if item.Path != "" || len(item.MediaSources) == 0 {
+		return item.Path
+	}
+	return item.MediaSources[0].Path
+}
+
+// newPlaylistItem returns the playlist entry for a video item
+func newPlaylistItem(item jellyfinItem, mediaSourceId string) PlaylistItem {
+	return PlaylistItem{
+		Path:          sourcePath(item, mediaSourceId),
+		ItemId:        item.Id,
+		MediaSourceId: mediaSourceId,
+		Title:         item.Name,
+		seriesId:      item.SeriesId,
+	}
+}
+
+// resolveItem looks up an item and returns it with the videos to play: the
+// item itself, or the children of a container
+func resolveItem(c *jellyfinClient, itemId string) (jellyfinItem, []jellyfinItem, error) {
+	item, err := c.getItem(itemId)
+	if err != nil {
+		return item, nil, err
+	}
+
+	switch {
+	case isVideoItemType(item.Type):
+		return item, []jellyfinItem{item}, nil
+	case isContainerItemType(item.Type):
+		children, err := expandContainer(c, item)
+		if err != nil {
+			return item, nil, err
+		}
+		if len(children) == 0 {
+			return item, nil, fmt.Errorf("%s %q has no videos", item.Type, item.Name)
+		}
+		debugLog("Resolved %s %q to %d item(s)", item.Type, item.Name, len(children))
+		return item, children, nil
+	}
+	return item, nil, &unsupportedItemError{Type: item.Type}
+}
+
+// itemHandler shows how an item resolves: its type, versions, chapters and
+// the videos /api/play would play for it
+func itemHandler(w http.ResponseWriter, r *http.Request) {
+	itemId := r.URL.Query().Get("itemId")
+	if itemId == "" {
+		http.Error(w, "missing 'itemId' parameter", http.StatusBadRequest)
+		return
+	}
+	cred, ok := credentials.lookup(r.URL.Query().Get("serverUrl"))
+	if !ok {
+		http.Error(w, "no credentials stored for this server", http.StatusUnauthorized)
+		return
+	}
+
+	c := cred.client()
+	item, videos, err := resolveItem(c, itemId)
+	if err != nil {
+		if _, unsupported := err.(*unsupportedItemError); !unsupported {
+			http.Error(w, fmt.Sprintf("failed to resolve item: %v", err), http.StatusBadGateway)
+			return
+		}
+	}
+
+	chapters := make([]map[string]interface{}, 0, len(item.Chapters))
+	for _, ch := range item.Chapters {
+		chapters = append(chapters, map[string]interface{}{
+			"name":  ch.Name,
+			"start": float64(ch.StartPositionTicks) / 10000000,
+		})
+	}
+	sources := make([]map[string]string, 0, len(item.MediaSources))
+	for _, src := range item.MediaSources {
+		sources = append(sources, map[string]string{
+			"id":   src.Id,
+			"name": src.Name,
+			"path": src.Path,
+		})
+	}
+	items := make([]map[string]string, 0, len(videos))
+	for _, v := range videos {
+		pi := newPlaylistItem(v, "")
+		translated, mapped := translatePath(pi.Path, itemScope(c, &pi))
+		if !mapped {
+			translated = ""
+		}
+		items = append(items, map[string]string{
+			"itemId":         v.Id,
+			"name":           v.Name,
+			"type":           v.Type,
+			"path":           pi.Path,
+			"library":        pi.library,
+			"translatedPath": translated,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"itemId":       item.Id,
+		"name":         item.Name,
+		"type":         item.Type,
+		"path":         item.Path,
+		"playable":     err == nil,
+		"mediaSources": sources,
+		"chapters":     chapters,
+		"items":        items,
+	})
+}
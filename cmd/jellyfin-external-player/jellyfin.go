@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Client name reported to Jellyfin in the Authorization header
+const jellyfinClientName = "Jellyfin External Player"
+
+// jellyfinClient calls the Jellyfin API as one user
+type jellyfinClient struct {
+	ServerURL  string
+	UserId     string
+	Token      string
+	DeviceId   string // Only needed when acting as our own client device
+	DeviceName string
+}
+
+// authHeader returns the MediaBrowser Authorization header identifying
+// this program as a client device
+func (c *jellyfinClient) authHeader() string {
+	device := c.DeviceName
+	if device == "" {
+		device, _ = os.Hostname()
+	}
+	quote := func(s string) string {
+		return `"` + url.QueryEscape(s) + `"`
+	}
+	h := "MediaBrowser Client=" + quote(jellyfinClientName) +
+		", Device=" + quote(device) +
+		", DeviceId=" + quote(c.DeviceId) +
+		", Version=" + quote(Version)
+	if c.Token != "" {
+		h += ", Token=" + quote(c.Token)
+	}
+	return h
+}
+
+// do sends a request with a JSON body (if body is not nil) and decodes a
+// JSON reply into out (if out is not nil)
+func (c *jellyfinClient) do(method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.ServerURL, "/")+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.DeviceId != "" {
+		req.Header.Set("Authorization", c.authHeader())
+	} else if c.Token != "" {
+		req.Header.Set("X-Emby-Token", c.Token)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s: server returned %d: %s", method, path, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("%s %s: failed to parse response: %v", method, path, err)
+	}
+	return nil
+}
+
+// authenticateByName logs in with a user name and password and stores the
+// resulting access token and user ID in the client
+func (c *jellyfinClient) authenticateByName(username, password string) error {
+	var result struct {
+		AccessToken string `json:"AccessToken"`
+		User        struct {
+			Id string `json:"Id"`
+		} `json:"User"`
+	}
+	c.Token = ""
+	err := c.do("POST", "/Users/AuthenticateByName", map[string]string{
+		"Username": username,
+		"Pw":       password,
+	}, &result)
+	if err != nil {
+		return err
+	}
+	if result.AccessToken == "" {
+		return fmt.Errorf("server returned no access token")
+	}
+	c.Token = result.AccessToken
+	c.UserId = result.User.Id
+	return nil
+}
+
+// jellyfinItem is the subset of a Jellyfin item that we use
+type jellyfinItem struct {
+	Id           string             `json:"Id"`
+	Name         string             `json:"Name"`
+	Type         string             `json:"Type"`
+	Path         string             `json:"Path"`
+	SeriesId     string             `json:"SeriesId,omitempty"`
+	SeriesName   string             `json:"SeriesName,omitempty"`
+	RunTimeTicks int64              `json:"RunTimeTicks,omitempty"`
+	MediaSources []jellyfinSource   `json:"MediaSources,omitempty"`
+	Chapters     []jellyfinChapter  `json:"Chapters,omitempty"`
+	UserData     *jellyfinUserState `json:"UserData,omitempty"`
+	DisplayOrder string             `json:"DisplayOrder,omitempty"` // Of collections: "SortName" or "PremiereDate"
+
+	// Of libraries: "movies", "tvshows", ...
+	CollectionType string `json:"CollectionType,omitempty"`
+
+	// Episode numbering; season 0 holds the specials
+	ParentIndexNumber       *int `json:"ParentIndexNumber,omitempty"`
+	IndexNumber             *int `json:"IndexNumber,omitempty"`
+	AirsBeforeSeasonNumber  *int `json:"AirsBeforeSeasonNumber,omitempty"`
+	AirsAfterSeasonNumber   *int `json:"AirsAfterSeasonNumber,omitempty"`
+	AirsBeforeEpisodeNumber *int `json:"AirsBeforeEpisodeNumber,omitempty"`
+}
+
+// jellyfinSource is one version of an item
+type jellyfinSource struct {
+	Id       string `json:"Id"`
+	Name     string `json:"Name"`
+	Path     string `json:"Path"`
+	Protocol string `json:"Protocol"` // "File", "Http", ...
+}
+
+// jellyfinChapter is a chapter marker of an item
+type jellyfinChapter struct {
+	Name               string `json:"Name"`
+	StartPositionTicks int64  `json:"StartPositionTicks"`
+}
+
+// jellyfinUserState is the user's watch state of an item
+type jellyfinUserState struct {
+	PlaybackPositionTicks int64 `json:"PlaybackPositionTicks"`
+	Played                bool  `json:"Played"`
+}
+
+// Fields requested for items fetched in lists
+const itemListFields = "Path,MediaSources"
+
+// itemsPath returns the path of the user's item list with a query
+func (c *jellyfinClient) itemsPath(q url.Values) string {
+	return "/Users/" + url.PathEscape(c.UserId) + "/Items?" + q.Encode()
+}
+
+// getItem fetches a single item with all its fields
+func (c *jellyfinClient) getItem(id string) (jellyfinItem, error) {
+	var item jellyfinItem
+	err := c.do("GET", "/Users/"+url.PathEscape(c.UserId)+"/Items/"+url.PathEscape(id), nil, &item)
+	return item, err
+}
+
+// getItems fetches items by ID, in the order given
+func (c *jellyfinClient) getItems(ids []string) ([]jellyfinItem, error) {
+	q := url.Values{
+		"Ids":    {strings.Join(ids, ",")},
+		"Fields": {itemListFields},
+	}
+	var result struct {
+		Items []jellyfinItem `json:"Items"`
+	}
+	if err := c.do("GET", c.itemsPath(q), nil, &result); err != nil {
+		return nil, err
+	}
+
+	// The server sorts by its own order; restore the requested one
+	byId := make(map[string]jellyfinItem, len(result.Items))
+	for _, item := range result.Items {
+		byId[item.Id] = item
+	}
+	items := make([]jellyfinItem, 0, len(ids))
+	for _, id := range ids {
+		if item, ok := byId[id]; ok {
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+// getEpisodes returns the episodes of a series, or of one of its seasons
+// if seasonId is not empty, with the user's watch state
+func (c *jellyfinClient) getEpisodes(seriesId, seasonId string) ([]jellyfinItem, error) {
+	q := url.Values{"UserId": {c.UserId}, "Fields": {itemListFields}}
+	if seasonId != "" {
+		q.Set("SeasonId", seasonId)
+	}
+	var result struct {
+		Items []jellyfinItem `json:"Items"`
+	}
+	if err := c.do("GET", "/Shows/"+url.PathEscape(seriesId)+"/Episodes?"+q.Encode(), nil, &result); err != nil {
+		return nil, err
+	}
+	return result.Items, nil
+}
+
+// getNextUp returns the episode of a series the user would watch next: the
+// one in progress or the one after the last played. ok is false if there is
+// none.
+func (c *jellyfinClient) getNextUp(seriesId string) (item jellyfinItem, ok bool, err error) {
+	q := url.Values{
+		"UserId":   {c.UserId},
+		"SeriesId": {seriesId},
+		"Limit":    {"1"},
+	}
+	var result struct {
+		Items []jellyfinItem `json:"Items"`
+	}
+	if err := c.do("GET", "/Shows/NextUp?"+q.Encode(), nil, &result); err != nil {
+		return item, false, err
+	}
+	if len(result.Items) == 0 {
+		return item, false, nil
+	}
+	return result.Items[0], true, nil
+}
+
+// getChildren returns the videos inside a playlist or collection, in the
+// order Jellyfin shows them: playlists in their own order, collections by
+// name or release date as set on the collection
+func (c *jellyfinClient) getChildren(container jellyfinItem) ([]jellyfinItem, error) {
+	var result struct {
+		Items []jellyfinItem `json:"Items"`
+	}
+	var err error
+	if container.Type == "Playlist" {
+		q := url.Values{"UserId": {c.UserId}, "Fields": {itemListFields}}
+		err = c.do("GET", "/Playlists/"+url.PathEscape(container.Id)+"/Items?"+q.Encode(), nil, &result)
+	} else {
+		sortBy := "PremiereDate,ProductionYear,SortName"
+		if container.DisplayOrder == "SortName" {
+			sortBy = "SortName"
+		}
+		err = c.do("GET", c.itemsPath(url.Values{
+			"ParentId":         {container.Id},
+			"IncludeItemTypes": {strings.Join(videoItemTypes, ",")},
+			"Recursive":        {"true"},
+			"SortBy":           {sortBy},
+			"Fields":           {itemListFields},
+		}), nil, &result)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Playlists may hold audio and other items the player is not for
+	var items []jellyfinItem
+	for _, item := range result.Items {
+		if isVideoItemType(item.Type) {
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+// streamURL returns the URL that streams an item's original file
+func (c *jellyfinClient) streamURL(itemId, mediaSourceId string) string {
+	q := url.Values{"static": {"true"}, "api_key": {c.Token}}
+	if mediaSourceId != "" {
+		q.Set("MediaSourceId", mediaSourceId)
+	}
+	return fmt.Sprintf("%s/Videos/%s/stream?%s", strings.TrimSuffix(c.ServerURL, "/"), url.PathEscape(itemId), q.Encode())
+}
+
+// streamTokenHeader is the header players can send the access token in
+// instead of the api_key of stream URLs
+const streamTokenHeader = "X-Emby-Token"
+
+// withoutToken returns a URL on serverURL without its api_key, and whether
+// it had one. URLs of other hosts are returned unchanged.
+func withoutToken(rawURL, serverURL string) (string, bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil || !sameHost(u, serverURL) {
+		return rawURL, false
+	}
+	q := u.Query()
+	if q.Get("api_key") == "" {
+		return rawURL, false
+	}
+	q.Del("api_key")
+	u.RawQuery = q.Encode()
+	return u.String(), true
+}
+
+// isOtherHTTPHost reports whether path is an http(s) URL of a host other
+// than serverURL
+func isOtherHTTPHost(path, serverURL string) bool {
+	u, err := url.Parse(path)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+	return !sameHost(u, serverURL)
+}
+
+// sameHost reports whether u has the scheme and host of serverURL
+func sameHost(u *url.URL, serverURL string) bool {
+	s, err := url.Parse(serverURL)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Scheme, s.Scheme) && strings.EqualFold(u.Host, s.Host)
+}
+
+// getLibrary returns the library (collection folder) an item is in
+func (c *jellyfinClient) getLibrary(id string) (jellyfinItem, error) {
+	path := "/Items/" + url.PathEscape(id) + "/Ancestors"
+	if c.UserId != "" {
+		path += "?" + url.Values{"userId": {c.UserId}}.Encode()
+	}
+	var ancestors []jellyfinItem
+	if err := c.do("GET", path, nil, &ancestors); err != nil {
+		return jellyfinItem{}, err
+	}
+	for _, a := range ancestors {
+		if a.Type == "CollectionFolder" {
+			return a, nil
+		}
+	}
+	return jellyfinItem{}, fmt.Errorf("item %s is in no library", id)
+}
+
+// getLibraries returns the libraries the user can see
+func (c *jellyfinClient) getLibraries() ([]jellyfinItem, error) {
+	var result struct {
+		Items []jellyfinItem `json:"Items"`
+	}
+	if err := c.do("GET", "/Users/"+url.PathEscape(c.UserId)+"/Views", nil, &result); err != nil {
+		return nil, err
+	}
+	return result.Items, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// Most items whose library libraryCache remembers before starting over
+const libraryCacheSize = 2000
+
+// libraryCache remembers the library of items (or of series, for episodes),
+// so library-scoped path mappings cost one request per series or movie
+type libraryCache struct {
+	mu      sync.Mutex
+	entries map[string]string // Server URL + "|" + item ID -> library ID
+}
+
+var libraries = &libraryCache{entries: map[string]string{}}
+
+// libraryOf returns the ID of the library an item is in, or "" if it cannot
+// be looked up
+func (lc *libraryCache) libraryOf(c *jellyfinClient, item PlaylistItem) string {
+	id := item.ItemId
+	if item.seriesId != "" {
+		id = item.seriesId // All episodes of a series are in its library
+	}
+	if id == "" || c.Token == "" {
+		return ""
+	}
+	key := normalizeServerURL(c.ServerURL) + "|" + id
+
+	lc.mu.Lock()
+	library, ok := lc.entries[key]
+	lc.mu.Unlock()
+	if ok {
+		return library
+	}
+
+	folder, err := c.getLibrary(id)
+	if err != nil {
+		log.Printf("Failed to look up the library of item %s: %v", id, err)
+		return ""
+	}
+	debugLog("Item %s is in library %q (%s)", id, folder.Name, folder.Id)
+
+	lc.mu.Lock()
+	if len(lc.entries) >= libraryCacheSize {
+		lc.entries = map[string]string{}
+	}
+	lc.entries[key] = folder.Id
+	lc.mu.Unlock()
+	return folder.Id
+}
+
+// itemScope returns the mapping scope of an item of a server. Its library is
+// only looked up if a mapping of the server needs it.
+func itemScope(c *jellyfinClient, item *PlaylistItem) mappingScope {
+	if item.library == "" && mappingsNeedLibrary(c.ServerURL) {
+		item.library = libraries.libraryOf(c, *item)
+	}
+	return mappingScope{ServerURL: c.ServerURL, Library: item.library}
+}
+
+// librariesHandler lists the libraries of the stored servers, whose IDs
+// path mappings can be limited to (/api/libraries)
+func librariesHandler(w http.ResponseWriter, r *http.Request) {
+	list := []map[string]string{}
+	for _, cred := range credentials.list() {
+		folders, err := cred.client().getLibraries()
+		if err != nil {
+			log.Printf("Failed to list the libraries of %s: %v", cred.ServerURL, err)
+			continue
+		}
+		for _, f := range folders {
+			list = append(list, map[string]string{
+				"serverUrl":      cred.ServerURL,
+				"id":             f.Id,
+				"name":           f.Name,
+				"collectionType": f.CollectionType,
+			})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
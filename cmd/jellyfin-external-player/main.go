@@ -1,8 +1,6 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
 	"crypto/md5"
 	"encoding/json"
 	"flag"
@@ -26,31 +24,55 @@ import (
 // jellyfin-external-player.js is read from disk to allow editing without restart
 
 type PathMapping struct {
-	Type    string `json:"type"`    // "prefix", "wildcard", or "regex"
-	Match   string `json:"match"`   // pattern to match
-	Replace string `json:"replace"` // replacement string
+	Type    string `json:"type"`              // "prefix", "wildcard", or "regex"
+	Match   string `json:"match"`             // pattern to match
+	Replace string `json:"replace"`           // replacement string
+	Server  string `json:"server,omitempty"`  // Only for items of this server URL
+	Library string `json:"library,omitempty"` // Only for items of this library (collection folder ID)
+
+	re  *regexp.Regexp // Compiled wildcard or regex pattern
+	err error          // Why the mapping is invalid
 }
 
 type PlayerConfig struct {
-	Name string   `json:"name"`
-	Path string   `json:"path"`
+	Name         string   `json:"name"`
+	Type         string   `json:"type,omitempty"` // "mpv", "vlc" or "custom" (defaults to the player's key)
+	Path         string   `json:"path"`
+	Args         []string `json:"args"`                    // For "custom", a template with {path}, {start}, ... placeholders
+	PositionFile bool     `json:"position_file,omitempty"` // "custom" only: report the position the wrapper writes to {positionFile}
+}
+
+// Display is a display profile: player arguments that put the player on one
+// screen, such as mpv's --screen and --fs-screen
+type Display struct {
 	Args []string `json:"args"`
 }
 
 type Config struct {
-	Port          int                     `json:"port"`
-	Player        string                  `json:"player"` // "mpv"
-	Players       map[string]PlayerConfig `json:"players"`
-	PathMappings  []PathMapping           `json:"path_mappings"`
-	URLEncode     bool                    `json:"url_encode"`      // URL-encode path when passing to player
-	ServerURLs    []string                `json:"server_urls"`     // Emby/Jellyfin server URLs
-	ServerURLsSet bool                    `json:"server_urls_set"` // true if user has explicitly set URLs
-	Debug         bool                    `json:"debug"`           // Enable verbose logging
+	Port             int                     `json:"port"`
+	Player           string                  `json:"player"` // Key into Players, e.g. "mpv" or "vlc"
+	Players          map[string]PlayerConfig `json:"players"`
+	PathMappings     []PathMapping           `json:"path_mappings"`
+	URLEncode        bool                    `json:"url_encode"`        // URL-encode path when passing to player
+	CheckPaths       bool                    `json:"check_paths"`       // Check that mapped files can be read before playing them
+	ServerURLs       []string                `json:"server_urls"`       // Emby/Jellyfin server URLs
+	ServerURLsSet    bool                    `json:"server_urls_set"`   // true if user has explicitly set URLs
+	Debug            bool                    `json:"debug"`             // Enable verbose logging
+	ProgressInterval int                     `json:"progress_interval"` // Seconds between progress reports to the server
+	PlayedPercent    float64                 `json:"played_percent"`    // Mark played past this % of the duration (0 = default, >=100 = off)
+	PlayedSeconds    float64                 `json:"played_seconds"`    // Mark played within this many seconds of the end (0 = off)
+	SegmentActions   map[string]string       `json:"segment_actions"`   // Media segment type ("Intro", ...) -> "skip", "prompt" or "off"
+	SkipKey          string                  `json:"skip_key"`          // mpv key that skips a prompted segment
+	Client           ClientConfig            `json:"client"`            // Native client mode (remote control from Jellyfin apps)
+	SkipPlayed       bool                    `json:"skip_played"`       // Leave played episodes out of series playlists
+	Specials         string                  `json:"specials"`          // Specials in series playlists: "aired", "first", "last" or "skip"
+	InstancePolicy   string                  `json:"instance_policy"`   // Play requests while a player runs: "replace", "enqueue" or "reject"
+	Displays         map[string]Display      `json:"displays"`          // Display profiles by name, for one player per screen
 }
 
 // Version info - set by linker flags
 var (
-	Version   = "0.1.0"
+	Version    = "0.1.0"
 	CommitHash = "unknown"
 	BuildTime  = "unknown"
 )
@@ -63,28 +85,31 @@ var (
 
 // PlaylistItem represents one item in a playlist
 type PlaylistItem struct {
-	Path      string `json:"path"`
-	ItemId    string `json:"itemId"`
-	StreamUrl string `json:"streamUrl,omitempty"`
+	Path          string `json:"path"`
+	ItemId        string `json:"itemId"`
+	StreamUrl     string `json:"-"` // Built from the stored credentials
+	MediaSourceId string `json:"mediaSourceId,omitempty"`
+	Title         string `json:"title,omitempty"`
+
+	AudioStreamIndex    *int `json:"audioStreamIndex,omitempty"`    // Jellyfin stream index
+	SubtitleStreamIndex *int `json:"subtitleStreamIndex,omitempty"` // Jellyfin stream index, -1 = off
+
+	playMethod string // Set when the path is translated
+	route      string // How the media reaches the player, set with playMethod
+	seriesId   string // Of episodes, to look up the library once per series
+	library    string // Library the item is in, looked up for library-scoped mappings
+
+	// Tracks looked up after launch, nil if they were part of it
+	late *lateTracks
+	// Mapped file checked after launch, nil if it was checked before
+	unchecked *uncheckedPath
 }
 
-// Player state tracking
-var (
-	currentPlayer   *exec.Cmd
-	currentPlayerMu sync.Mutex
-	playerItemId    string
-	playerIPCPath   string  // IPC path (named pipe for mpv)
-	currentPlayerType string // "mpv"
-	lastPosition    float64 // Last known playback position in seconds
-	videoDuration   float64 // Total video duration in seconds
-	// Playlist tracking
-	playlist         []PlaylistItem
-	playlistPosition int // Current position in playlist (0-indexed)
-	// Emby API info for progress reporting
-	embyServerURL string
-	embyUserId    string
-	embyToken     string
-)
+// uncheckedPath is the mapped path a playlist entry was launched with
+// before its file was checked
+type uncheckedPath struct {
+	path string
+}
 
 // debugLog logs a message only if debug mode is enabled
 func debugLog(format string, v ...interface{}) {
@@ -97,297 +122,263 @@ func debugLog(format string, v ...interface{}) {
 }
 
 // connectMpvIPC is defined in ipc_windows.go or ipc_unix.go
+// Player backends are defined in player.go, player_mpv.go and player_vlc.go
 
-// Query mpv for a property via IPC
-func queryMpvProperty(pipePath, property string) (interface{}, error) {
-	conn, err := connectMpvIPC(pipePath)
-	if err != nil {
-		return nil, err
-	}
-	defer conn.Close()
-
-	// Set read/write deadline
-	conn.SetDeadline(time.Now().Add(500 * time.Millisecond))
-
-	// Send JSON-IPC command
-	cmd := map[string]interface{}{
-		"command": []interface{}{"get_property", property},
-	}
-	cmdBytes, _ := json.Marshal(cmd)
-	cmdBytes = append(cmdBytes, '\n')
-
-	_, err = conn.Write(cmdBytes)
-	if err != nil {
-		return nil, err
-	}
-
-	// Read response line by line (mpv sends newline-delimited JSON)
-	reader := bufio.NewReader(conn)
-	line, err := reader.ReadBytes('\n')
-	if err != nil {
-		return nil, err
-	}
-
-	var resp map[string]interface{}
-	if err := json.Unmarshal(line, &resp); err != nil {
-		return nil, err
-	}
-
-	if data, ok := resp["data"]; ok {
-		return data, nil
-	}
-	return nil, fmt.Errorf("no data in response")
-}
-
-// Send a command to mpv via IPC (e.g., "quit")
-func sendMpvCommand(pipePath, command string) error {
-	conn, err := connectMpvIPC(pipePath)
-	if err != nil {
-		return err
-	}
-	defer conn.Close()
-
-	conn.SetDeadline(time.Now().Add(500 * time.Millisecond))
-
-	cmd := map[string]interface{}{
-		"command": []interface{}{command},
-	}
-	cmdBytes, _ := json.Marshal(cmd)
-	cmdBytes = append(cmdBytes, '\n')
-
-	_, err = conn.Write(cmdBytes)
-	return err
+// itemUserData is the subset of an item's UserData that we use
+type itemUserData struct {
+	PlaybackPositionTicks float64 `json:"PlaybackPositionTicks"`
+	Played                bool    `json:"Played"`
+	LastPlayedDate        string  `json:"LastPlayedDate"`
 }
 
-// setMpvProperty sets a property on mpv via IPC
-func setMpvProperty(pipePath, property string, value interface{}) error {
-	conn, err := connectMpvIPC(pipePath)
-	if err != nil {
-		return err
-	}
-	defer conn.Close()
-
-	conn.SetDeadline(time.Now().Add(500 * time.Millisecond))
-
-	cmd := map[string]interface{}{
-		"command": []interface{}{"set_property", property, value},
-	}
-	cmdBytes, _ := json.Marshal(cmd)
-	cmdBytes = append(cmdBytes, '\n')
-
-	_, err = conn.Write(cmdBytes)
-	return err
-}
-
-// bringMpvToFront sets ontop property to bring mpv window to foreground and requests focus
-func bringMpvToFront(pipePath string, pid int) {
-	go func() {
-		// Wait for mpv to initialize and create its window
-		time.Sleep(800 * time.Millisecond)
-
-		// Set ontop to true to bring window to front
-		if err := setMpvProperty(pipePath, "ontop", true); err != nil {
-			log.Printf("Failed to set ontop: %v", err)
-			return
-		}
-		log.Printf("Set mpv ontop=true")
-
-		// Try multiple times to find and focus the window
-		for i := 0; i < 5; i++ {
-			time.Sleep(200 * time.Millisecond)
-			if focusProcessWindow(pid) {
-				break
-			}
-		}
-
-		// Brief delay then disable ontop so user can alt-tab away later
-		time.Sleep(300 * time.Millisecond)
-		if err := setMpvProperty(pipePath, "ontop", false); err != nil {
-			log.Printf("Failed to unset ontop: %v", err)
-		}
-		log.Printf("Set mpv ontop=false")
-	}()
-}
-
-// Query Emby for stored playback position
-func getStoredPosition(serverURL, userId, token, itemId string) float64 {
+// getUserData fetches the user's data for an item. The HTTP status is
+// returned with the error so callers can tell missing items from outages.
+func getUserData(serverURL, userId, token, itemId string) (itemUserData, int, error) {
 	apiURL := fmt.Sprintf("%s/Users/%s/Items/%s", serverURL, userId, itemId)
 
 	req, err := http.NewRequest("GET", apiURL, nil)
 	if err != nil {
-		log.Printf("getStoredPosition: failed to create request: %v", err)
-		return 0
+		return itemUserData{}, 0, fmt.Errorf("failed to create request: %v", err)
 	}
 	req.Header.Set("X-Emby-Token", token)
 
 	client := &http.Client{Timeout: 5 * time.Second}
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Printf("getStoredPosition: request failed: %v", err)
-		return 0
+		return itemUserData{}, 0, fmt.Errorf("request failed: %v", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		log.Printf("getStoredPosition: server returned %d", resp.StatusCode)
-		return 0
+		return itemUserData{}, resp.StatusCode, fmt.Errorf("server returned %d", resp.StatusCode)
 	}
 
 	var data struct {
-		UserData struct {
-			PlaybackPositionTicks float64 `json:"PlaybackPositionTicks"`
-		} `json:"UserData"`
+		UserData itemUserData `json:"UserData"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
-		log.Printf("getStoredPosition: failed to parse response: %v", err)
+		return itemUserData{}, resp.StatusCode, fmt.Errorf("failed to parse response: %v", err)
+	}
+	return data.UserData, resp.StatusCode, nil
+}
+
+// Query Emby for stored playback position
+func getStoredPosition(serverURL, userId, token, itemId string) float64 {
+	// Send any report still queued for this item first, so we resume from
+	// where it was last played rather than from a stale server position
+	reportQueue.flushItem(serverURL, itemId)
+
+	data, _, err := getUserData(serverURL, userId, token, itemId)
+	if err != nil {
+		log.Printf("getStoredPosition: %v", err)
 		return 0
 	}
 
-	positionSeconds := data.UserData.PlaybackPositionTicks / 10000000.0
+	positionSeconds := data.PlaybackPositionTicks / 10000000.0
 	log.Printf("getStoredPosition: item %s has %.0f ticks = %.1f seconds",
-		itemId, data.UserData.PlaybackPositionTicks, positionSeconds)
+		itemId, data.PlaybackPositionTicks, positionSeconds)
 	return positionSeconds
 }
 
 // Report playback start to Emby server (creates a session)
-func reportPlaybackStart() {
-	currentPlayerMu.Lock()
-	itemId := playerItemId
-	serverURL := embyServerURL
-	token := embyToken
-	currentPlayerMu.Unlock()
-
-	if itemId == "" || serverURL == "" || token == "" {
+func reportPlaybackStart(s *playerSession) {
+	sess := s.current()
+	serverURL := s.serverURL
+	token := s.token
+
+	if sess == nil || sess.ItemId == "" || serverURL == "" || token == "" {
 		log.Printf("Playback start: skipping (no credentials)")
 		return
 	}
 
-	apiURL := fmt.Sprintf("%s/Sessions/Playing", serverURL)
+	log.Printf("Playback start: item %s, session %s (%s)", sess.ItemId, sess.PlaySessionId, sess.PlayMethod)
 
-	body := map[string]interface{}{
-		"ItemId":      itemId,
-		"CanSeek":     true,
-		"PlayMethod":  "DirectPlay",
-		"PlaySessionId": fmt.Sprintf("jellyfin-external-player-%d", time.Now().Unix()),
-	}
-	bodyBytes, _ := json.Marshal(body)
-
-	log.Printf("Playback start: POST %s with %s", apiURL, string(bodyBytes))
-
-	req, err := http.NewRequest("POST", apiURL, bytes.NewReader(bodyBytes))
-	if err != nil {
-		log.Printf("Playback start: failed to create request: %v", err)
-		return
-	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("X-Emby-Token", token)
-
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
+	code, respBody, err := postEmbySession(serverURL, token, "/Sessions/Playing", sess.reportBody())
 	if err != nil {
 		log.Printf("Playback start: request failed: %v", err)
+		publishReportFailed(s, "/Sessions/Playing", sess.ItemId, 0, err)
 		return
 	}
-	defer resp.Body.Close()
-
-	bodyResp, _ := io.ReadAll(resp.Body)
-	log.Printf("Playback start: response %d: %s", resp.StatusCode, string(bodyResp))
+	log.Printf("Playback start: response %d: %s", code, string(respBody))
+	if code < 200 || code >= 300 {
+		publishReportFailed(s, "/Sessions/Playing", sess.ItemId, code, nil)
+	}
 }
 
 // Report playback stopped to Emby server
-func reportPlaybackStopped() {
-	currentPlayerMu.Lock()
-	itemId := playerItemId
-	position := lastPosition
-	serverURL := embyServerURL
-	token := embyToken
-	currentPlayerMu.Unlock()
-
-	if itemId == "" || serverURL == "" || token == "" {
+func reportPlaybackStopped(s *playerSession) {
+	s.mu.Lock()
+	sess := s.playback
+	position := s.lastPosition
+	duration := s.videoDuration
+	positionKnown := s.positionKnown
+	var serverPosition *float64
+	if sess != nil {
+		serverPosition = sess.serverPosition
+	}
+	s.mu.Unlock()
+	serverURL := s.serverURL
+	userId := s.userId
+	token := s.token
+
+	if sess == nil || sess.ItemId == "" || serverURL == "" || token == "" {
 		log.Printf("Playback stop: skipping (no credentials)")
 		return
 	}
+	// A report held from a failed progress report is sent if this one is
+	// neither delivered nor queued in its place
+	defer reportQueue.release(serverURL, sess.ItemId)
+
+	// Without a position from the player (no position file, or a control
+	// interface that never answered) the offset the item started at is
+	// reported, so the resume point is kept. Leaving PositionTicks out would
+	// make Jellyfin assume the item was played to completion.
+	if !positionKnown {
+		log.Printf("Playback stop: no position observed, reporting the start offset %.1f seconds", position)
+	}
+
+	// Past the completion threshold: clear the resume point and mark played
+	played := positionKnown && isPlayedToCompletion(position, duration)
+	if played {
+		log.Printf("Playback stop: %.1f of %.1f seconds is past the completion threshold", position, duration)
+		position = 0
+	}
 
 	// Convert seconds to ticks (1 tick = 100 nanoseconds)
 	positionTicks := int64(position * 10000000)
 
-	apiURL := fmt.Sprintf("%s/Sessions/Playing/Stopped", serverURL)
+	body := sess.reportBody()
+	body["PositionTicks"] = positionTicks
+
+	code, respBody, err := postEmbySession(serverURL, token, "/Sessions/Playing/Stopped", body)
+	if err != nil || isRetryableStatus(code) {
+		if err != nil {
+			log.Printf("Playback stop: request failed: %v", err)
+		} else {
+			log.Printf("Playback stop: server returned %d: %s", code, string(respBody))
+		}
+		publishReportFailed(s, "/Sessions/Playing/Stopped", sess.ItemId, code, err)
+		reportQueue.add(&queuedReport{
+			Endpoint:    "/Sessions/Playing/Stopped",
+			ServerURL:   serverURL,
+			UserId:      userId,
+			Token:       token,
+			ItemId:      sess.ItemId,
+			Position:    position,
+			ServerPos:   serverPosition,
+			MarkPlayed:  played,
+			Body:        body,
+			unreachable: err != nil,
+		})
+		return
+	}
+	if code >= 200 && code < 300 {
+		log.Printf("Playback stop: saved position %.1f seconds (%d ticks) for item %s, session %s. Response: %s",
+			position, positionTicks, sess.ItemId, sess.PlaySessionId, string(respBody))
+		reportQueue.supersede(serverURL, sess.ItemId)
+	} else {
+		log.Printf("Playback stop: server returned %d: %s", code, string(respBody))
+		publishReportFailed(s, "/Sessions/Playing/Stopped", sess.ItemId, code, nil)
+	}
+
+	if played {
+		markPlayed(serverURL, userId, token, sess.ItemId)
+	}
+}
+
+// Default percentage of the duration after which an item counts as played
+// (matches Jellyfin's default "maximum resume percentage")
+const defaultPlayedPercent = 90
+
+// isPlayedToCompletion reports whether position is past the configured
+// completion threshold, either a percentage or seconds before the end
+func isPlayedToCompletion(position, duration float64) bool {
+	if duration <= 0 || position <= 0 {
+		return false
+	}
+
+	configMu.RLock()
+	percent := config.PlayedPercent
+	seconds := config.PlayedSeconds
+	configMu.RUnlock()
+
+	if percent <= 0 {
+		percent = defaultPlayedPercent
+	}
+
+	if percent < 100 && position >= duration*percent/100 {
+		return true
+	}
+	if seconds > 0 && position >= duration-seconds {
+		return true
+	}
+	return false
+}
 
-	body := map[string]interface{}{
-		"ItemId":        itemId,
-		"PositionTicks": positionTicks,
-		"PlaySessionId": fmt.Sprintf("jellyfin-external-player-%d", time.Now().Unix()),
+// markPlayed marks an item as played for the user via the PlayedItems API
+func markPlayed(serverURL, userId, token, itemId string) {
+	if userId == "" {
+		log.Printf("markPlayed: skipping (no user ID)")
+		return
 	}
-	bodyBytes, _ := json.Marshal(body)
 
-	log.Printf("Playback stop: POST %s with %s", apiURL, string(bodyBytes))
+	apiURL := fmt.Sprintf("%s/Users/%s/PlayedItems/%s", serverURL, userId, itemId)
 
-	req, err := http.NewRequest("POST", apiURL, bytes.NewReader(bodyBytes))
+	req, err := http.NewRequest("POST", apiURL, nil)
 	if err != nil {
-		log.Printf("Playback stop: failed to create request: %v", err)
+		log.Printf("markPlayed: failed to create request: %v", err)
 		return
 	}
-	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("X-Emby-Token", token)
 
 	client := &http.Client{Timeout: 10 * time.Second}
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Printf("Playback stop: request failed: %v", err)
+		log.Printf("markPlayed: request failed: %v", err)
 		return
 	}
 	defer resp.Body.Close()
 
-	bodyResp, _ := io.ReadAll(resp.Body)
-	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-		log.Printf("Playback stop: saved position %.1f seconds (%d ticks) for item %s. Response: %s",
-			position, positionTicks, itemId, string(bodyResp))
-	} else {
-		log.Printf("Playback stop: server returned %d: %s", resp.StatusCode, string(bodyResp))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(resp.Body)
+		log.Printf("markPlayed: server returned %d: %s", resp.StatusCode, string(body))
+		return
 	}
+	log.Printf("markPlayed: item %s marked as played", itemId)
 }
 
 // Get current playback position from player
 type PlayerStatus struct {
-	Playing  bool
-	Paused   bool
-	Position float64
-	Duration float64
+	Playing     bool
+	Paused      bool
+	Position    float64
+	Duration    float64
+	Volume      float64
+	Muted       bool
+	PlaylistPos int
+	EOFReached  bool
 }
 
-func getMpvPlaybackInfo() (PlayerStatus, error) {
-	currentPlayerMu.Lock()
-	pipePath := playerIPCPath
-	currentPlayerMu.Unlock()
-
-	if pipePath == "" {
-		return PlayerStatus{}, fmt.Errorf("no IPC path")
+// getPlaybackInfo returns the status of a session's player
+func getPlaybackInfo(s *playerSession) (PlayerStatus, error) {
+	if s == nil || s.player == nil {
+		return PlayerStatus{}, fmt.Errorf("no player")
 	}
 
-	var status PlayerStatus
-
-	// If we can query mpv, it's running
-	pos, err := queryMpvProperty(pipePath, "time-pos")
+	status, err := s.player.Status()
 	if err != nil {
-		return PlayerStatus{}, err // Can't reach mpv
-	}
-	status.Playing = true
-
-	if p, ok := pos.(float64); ok {
-		status.Position = p
-		lastPosition = p
+		return PlayerStatus{}, err
 	}
 
-	dur, _ := queryMpvProperty(pipePath, "duration")
-	if d, ok := dur.(float64); ok {
-		status.Duration = d
-		videoDuration = d
+	s.mu.Lock()
+	if status.Position > 0 {
+		s.lastPosition = status.Position
+		s.positionKnown = true
 	}
-
-	paused, _ := queryMpvProperty(pipePath, "pause")
-	if p, ok := paused.(bool); ok {
-		status.Paused = p
+	if status.Duration > 0 {
+		s.videoDuration = status.Duration
 	}
+	s.mu.Unlock()
 
 	return status, nil
 }
@@ -397,11 +388,17 @@ func defaultConfig() Config {
 		Port:   9998,
 		Player: "mpv",
 		Players: map[string]PlayerConfig{
-			"mpv": {Name: "mpv", Path: defaultMpvPath, Args: []string{"--fs"}},
+			"mpv": {Name: "mpv", Type: playerTypeMpv, Path: defaultMpvPath, Args: []string{"--fs"}},
+			"vlc": {Name: "vlc", Type: playerTypeVlc, Path: defaultVlcPath, Args: []string{"--fullscreen"}},
 		},
-		PathMappings:  []PathMapping{}, // Empty by default - will use Jellyfin streaming
-		ServerURLs:    []string{},      // Will be populated by discovery
-		ServerURLsSet: false,
+		PathMappings:     []PathMapping{}, // Empty by default - will use Jellyfin streaming
+		ServerURLs:       []string{},      // Will be populated by discovery
+		ServerURLsSet:    false,
+		ProgressInterval: defaultProgressInterval,
+		PlayedPercent:    defaultPlayedPercent,
+		SkipKey:          defaultSkipKey,
+		Specials:         specialsAired,
+		InstancePolicy:   instancePolicyReplace,
 	}
 }
 
@@ -422,9 +419,20 @@ func loadConfig() error {
 		return err
 	}
 
-	// Ensure players map exists
+	// Ensure players map exists and contains the built-in players
 	if config.Players == nil {
-		config.Players = defaultConfig().Players
+		config.Players = map[string]PlayerConfig{}
+	}
+	for key, pc := range defaultConfig().Players {
+		if _, ok := config.Players[key]; !ok {
+			config.Players[key] = pc
+		}
+	}
+
+	// Invalid mappings stay in the config, so they can be fixed on the
+	// config page, but never match
+	for _, err := range compileMappings(config.PathMappings) {
+		log.Printf("Config: invalid path %v", err)
 	}
 
 	return nil
@@ -435,7 +443,11 @@ func saveConfigLocked() error {
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(configPath, data, 0644)
+	// Only readable by the user
+	if err := os.WriteFile(configPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Chmod(configPath, 0600)
 }
 
 func saveConfig() error {
@@ -444,203 +456,81 @@ func saveConfig() error {
 	return saveConfigLocked()
 }
 
-// wildcardToRegex converts a wildcard pattern to a regex for prefix-style matching
-// * matches anything except /
-// ** matches anything including /
-// The pattern matches the beginning of the path, and captures the remainder
-func wildcardToRegex(pattern string) (*regexp.Regexp, error) {
-	var result strings.Builder
-	result.WriteString("^")
-
-	i := 0
-	for i < len(pattern) {
-		if i+1 < len(pattern) && pattern[i] == '*' && pattern[i+1] == '*' {
-			result.WriteString("(.*?)")
-			i += 2
-		} else if pattern[i] == '*' {
-			result.WriteString("([^/]*)")
-			i++
-		} else if strings.ContainsRune("[](){}+?.\\^$|", rune(pattern[i])) {
-			result.WriteString("\\")
-			result.WriteByte(pattern[i])
-			i++
-		} else {
-			result.WriteByte(pattern[i])
-			i++
-		}
-	}
-
-	// Capture the remainder of the path
-	result.WriteString("(.*)")
-	result.WriteString("$")
-	return regexp.Compile(result.String())
-}
-
-// applyMapping applies a single mapping to a path
-// Returns the transformed path and true if matched, or original path and false if not
-func applyMapping(path string, mapping PathMapping) (string, bool) {
-	switch mapping.Type {
-	case "prefix":
-		if strings.HasPrefix(path, mapping.Match) {
-			return mapping.Replace + path[len(mapping.Match):], true
-		}
-		return path, false
-
-	case "wildcard":
-		re, err := wildcardToRegex(mapping.Match)
-		if err != nil {
-			log.Printf("Invalid wildcard pattern %q: %v", mapping.Match, err)
-			return path, false
-		}
-		matches := re.FindStringSubmatch(path)
-		if matches != nil {
-			// Last capture group is the remainder of the path
-			remainder := matches[len(matches)-1]
-			// Replace {1}, {2}, etc. with captured groups (excluding remainder)
-			result := mapping.Replace
-			for i := 1; i < len(matches)-1; i++ {
-				result = strings.ReplaceAll(result, fmt.Sprintf("{%d}", i), matches[i])
-			}
-			// Append the remainder with proper path separator
-			if len(remainder) > 0 && !strings.HasSuffix(result, "/") && !strings.HasSuffix(result, `\`) {
-				result += "/"
-			}
-			return result + remainder, true
-		}
-		return path, false
-
-	case "regex":
-		re, err := regexp.Compile(mapping.Match)
-		if err != nil {
-			log.Printf("Invalid regex pattern %q: %v", mapping.Match, err)
-			return path, false
-		}
-		if re.MatchString(path) {
-			return re.ReplaceAllString(path, mapping.Replace), true
-		}
-		return path, false
-
-	default:
-		// Treat unknown types as prefix for backwards compatibility
-		if strings.HasPrefix(path, mapping.Match) {
-			return mapping.Replace + path[len(mapping.Match):], true
-		}
-		return path, false
-	}
-}
-
-// translatePath applies path mappings and returns (result, matched)
-// If matched is true, a mapping was applied; if false, no mapping matched
-func translatePath(path string) (string, bool) {
+// encodeForPlayer URL-encodes a path if configured (helps with special
+// characters in paths)
+func encodeForPlayer(path string) string {
 	configMu.RLock()
-	defer configMu.RUnlock()
-
-	for _, mapping := range config.PathMappings {
-		if result, matched := applyMapping(path, mapping); matched {
-			// Only convert slashes for Windows UNC paths, not for URLs like smb://
-			if runtime.GOOS == "windows" && !strings.Contains(result, "://") {
-				return strings.ReplaceAll(result, "/", `\`), true
-			}
-			return result, true
-		}
-	}
+	urlEncode := config.URLEncode
+	configMu.RUnlock()
 
-	// No match - convert slashes only on Windows
-	if runtime.GOOS == "windows" {
-		return strings.ReplaceAll(path, "/", `\`), false
+	if urlEncode {
+		return url.PathEscape(path)
 	}
-	return path, false
+	return path
 }
 
-func playHandler(w http.ResponseWriter, r *http.Request) {
-	// Set CORS headers for browser requests
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-
-	if r.Method == "OPTIONS" {
-		w.WriteHeader(http.StatusOK)
-		return
-	}
-
-	path := r.URL.Query().Get("path")
-	if path == "" {
-		http.Error(w, "missing 'path' parameter", http.StatusBadRequest)
-		return
-	}
-
-	streamUrl := r.URL.Query().Get("streamUrl")
-	itemId := r.URL.Query().Get("itemId")
-	serverURL := r.URL.Query().Get("serverUrl")
-	userId := r.URL.Query().Get("userId")
-	token := r.URL.Query().Get("token")
-	resumeFlag := r.URL.Query().Get("resume")
-
-	// Only query for resume position if resume=1
-	var startSeconds float64
-	if resumeFlag == "1" && serverURL != "" && userId != "" && token != "" && itemId != "" {
-		if storedPosition := getStoredPosition(serverURL, userId, token, itemId); storedPosition > 0 {
-			startSeconds = storedPosition
-			log.Printf("Resume position from Emby: %.1f seconds", startSeconds)
-		}
-	}
-
-	// Try path mapping first; if no mapping matches, use stream URL
-	translatedPath, mappingMatched := translatePath(path)
-	if !mappingMatched && streamUrl != "" {
-		translatedPath = streamUrl
-		log.Printf("Playing (stream): %s", streamUrl)
-	} else {
-		log.Printf("Playing: %s -> %s", path, translatedPath)
-	}
-
-	// Check for colons in SMB paths (indicates a problem)
-	if strings.HasPrefix(translatedPath, `\\`) {
-		// Find position after the server and share parts
-		// \\server\share\rest\of\path
-		parts := strings.SplitN(translatedPath[2:], `\`, 3)
-		if len(parts) >= 3 && strings.Contains(parts[2], ":") {
-			log.Printf("Warning: Colon in SMB path may cause issues: %s", translatedPath)
-		}
-	}
-
+// launchPlayer starts the configured player on req.Paths (a playlist if
+// there are several) for a session and attaches to its control interface
+func launchPlayer(sessionID string, req launchRequest) (*exec.Cmd, Player, error) {
 	configMu.RLock()
 	playerKey := config.Player
 	playerConfig, ok := config.Players[playerKey]
+	display := config.Displays[req.Display]
 	configMu.RUnlock()
 
 	if !ok {
 		log.Printf("Unknown player %q, falling back to mpv", playerKey)
+		playerKey = playerTypeMpv
 		playerConfig = PlayerConfig{Path: "mpv", Args: []string{"--fs"}}
 	}
 
-	// URL-encode if configured (helps with special characters in paths)
-	configMu.RLock()
-	urlEncode := config.URLEncode
-	configMu.RUnlock()
+	player, err := newPlayer(playerKey, playerConfig, sessionID)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	pathForPlayer := translatedPath
-	if urlEncode {
-		pathForPlayer = url.PathEscape(translatedPath)
+	var pathsForPlayer []string
+	for _, path := range req.Paths {
+		pathsForPlayer = append(pathsForPlayer, encodeForPlayer(path))
+	}
+	req.Paths = pathsForPlayer
+
+	// Players that can send the token in a header get the stream URLs
+	// without it, unless the header would also go to other hosts
+	if setter, ok := player.(streamTokenSetter); ok && req.Token != "" && !hasOtherHTTPHost(req.Paths, req.ServerURL) {
+		stripped := make([]string, len(req.Paths))
+		hadToken := false
+		for i, path := range req.Paths {
+			var had bool
+			stripped[i], had = withoutToken(path, req.ServerURL)
+			hadToken = hadToken || had
+		}
+		if hadToken {
+			if err := setter.SetStreamToken(req.Token); err != nil {
+				log.Printf("Failed to pass the stream token in a header: %v", err)
+			} else {
+				req.Paths = stripped
+			}
+		}
 	}
 
 	args := append([]string{}, playerConfig.Args...)
+	if t, ok := player.(argTemplate); ok {
+		args = t.ExpandArgs(playerConfig.Args, req)
+	}
 
-	// Add IPC/RC interface args based on player type
-	var ipcPath string
-	if playerKey == "mpv" {
-		ipcPath = getMpvIPCPath()
-		args = append(args, "--input-ipc-server="+ipcPath)
+	// Put the player on the requested screen
+	args = append(args, display.Args...)
 
+	// Add control interface args for the player type
+	args = append(args, player.LaunchArgs()...)
 
-		// Add resume position if provided
-		if startSeconds > 0 {
-			args = append(args, fmt.Sprintf("--start=%.1f", startSeconds))
-			log.Printf("Starting playback at %.1f seconds", startSeconds)
-		}
+	// The resume position only applies to the first entry
+	if req.StartSeconds > 0 {
+		log.Printf("Starting playback at %.1f seconds", req.StartSeconds)
 	}
 
-	args = append(args, pathForPlayer)
+	args = append(args, player.PlaylistArgs(req)...)
 
 	playerPath := fixPlayerPath(playerConfig.Path)
 
@@ -653,94 +543,180 @@ func playHandler(w http.ResponseWriter, r *http.Request) {
 			cmdLine += " " + arg
 		}
 	}
-	log.Printf("Command: %s", cmdLine)
+	log.Printf("Command: %s", redact(cmdLine))
 
 	cmd := exec.Command(playerPath, args...)
 	noConsole(cmd) // Prevent console window flash on Windows
 	if err := cmd.Start(); err != nil {
-		log.Printf("Error starting player: %v", err)
-		http.Error(w, fmt.Sprintf("failed to start player: %v", err), http.StatusInternalServerError)
-		return
+		player.Close() // Removes the files the player was given
+		return nil, nil, err
 	}
 
-	// Track the current player process
-	currentPlayerMu.Lock()
-	currentPlayer = cmd
-	playerItemId = itemId
-	playerIPCPath = ipcPath
-	currentPlayerType = playerKey
-	lastPosition = 0
-	videoDuration = 0
-	embyServerURL = serverURL
-	embyUserId = userId
-	embyToken = token
-	currentPlayerMu.Unlock()
+	// Connect to the control interface in the background
+	player.Attach(cmd)
 
-	log.Printf("Stored Emby info: server=%s, userId=%s, hasToken=%v", serverURL, userId, token != "")
+	return cmd, player, nil
+}
 
-	// Bring mpv to front via IPC + Windows API
-	bringMpvToFront(ipcPath, cmd.Process.Pid)
+// hasOtherHTTPHost reports whether any of paths is an http(s) URL of a host
+// other than serverURL
+func hasOtherHTTPHost(paths []string, serverURL string) bool {
+	for _, path := range paths {
+		if isOtherHTTPHost(path, serverURL) {
+			return true
+		}
+	}
+	return false
+}
 
-	// Report playback started to Emby
-	go reportPlaybackStart()
+func playHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
 
-	// Wait for the player to finish in background
-	go func() {
-		cmd.Wait()
+	path := r.URL.Query().Get("path")
+	itemId := r.URL.Query().Get("itemId")
+	if path == "" && itemId == "" {
+		http.Error(w, "missing 'path' or 'itemId' parameter", http.StatusBadRequest)
+		return
+	}
 
-		// Get final position before clearing state
-		currentPlayerMu.Lock()
-		pType := currentPlayerType
-		ipc := playerIPCPath
-		currentPlayerMu.Unlock()
+	mediaSourceId := r.URL.Query().Get("mediaSourceId")
+	audioIndex := parseStreamIndex(r.URL.Query().Get("audioStreamIndex"))
+	subtitleIndex := parseStreamIndex(r.URL.Query().Get("subtitleStreamIndex"))
+	req := PlaylistRequest{
+		ServerURL:        r.URL.Query().Get("serverUrl"),
+		Display:          r.URL.Query().Get("display"),
+		Resume:           r.URL.Query().Get("resume") == "1",
+		AudioLanguage:    r.URL.Query().Get("audioLanguage"),
+		SubtitleLanguage: r.URL.Query().Get("subtitleLanguage"),
+	}
+
+	if !isDisplay(req.Display) {
+		http.Error(w, fmt.Sprintf("unknown display %q", req.Display), http.StatusBadRequest)
+		return
+	}
 
-		if ipc != "" && pType == "mpv" {
-			getMpvPlaybackInfo() // Updates lastPosition
+	// Jellyfin items are played with the stored credentials of their server;
+	// a bare path can be played without any
+	if req.ServerURL != "" || itemId != "" {
+		cred, ok := credentials.lookup(req.ServerURL)
+		if !ok {
+			http.Error(w, "no credentials stored for this server", http.StatusUnauthorized)
+			return
+		}
+		req.ServerURL, req.UserID, req.Token = cred.ServerURL, cred.UserId, cred.AccessToken
+	}
+
+	if path != "" {
+		req.Items = []PlaylistItem{{
+			Path:                path,
+			ItemId:              itemId,
+			MediaSourceId:       mediaSourceId,
+			Title:               r.URL.Query().Get("title"),
+			AudioStreamIndex:    audioIndex,
+			SubtitleStreamIndex: subtitleIndex,
+		}}
+	} else {
+		// Without a path the item is looked up on the server, which also
+		// expands seasons, series, playlists and collections
+		items, err := resolvePlaylistItems(&req, itemId, mediaSourceId)
+		if err != nil {
+			if unsupported, ok := err.(*unsupportedItemError); ok {
+				// Let the caller fall back to Jellyfin's own player
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				json.NewEncoder(w).Encode(map[string]string{
+					"status": "unsupported",
+					"type":   unsupported.Type,
+				})
+				return
+			}
+			log.Printf("Failed to resolve item %s: %v", itemId, err)
+			http.Error(w, fmt.Sprintf("failed to resolve item: %v", err), http.StatusBadGateway)
+			return
+		}
+		// The version and tracks picked apply to the item itself, not to
+		// the children of a container
+		if items[0].ItemId == itemId {
+			items[0].AudioStreamIndex = audioIndex
+			items[0].SubtitleStreamIndex = subtitleIndex
 		}
+		req.Items = items
+	}
 
-		// Report playback stopped to Emby
-		reportPlaybackStopped()
+	startPlayRequest(w, req)
+}
 
-		currentPlayerMu.Lock()
-		if currentPlayer == cmd {
-			currentPlayer = nil
-			playerItemId = ""
-			playerIPCPath = ""
-			currentPlayerType = ""
-			embyServerURL = ""
-			embyUserId = ""
-			embyToken = ""
-		}
-		currentPlayerMu.Unlock()
-		log.Printf("Player exited")
-	}()
+// startPlayRequest starts the player for a play or playlist request and
+// writes the response. While a player runs, the instance policy decides
+// whether the request replaces it, is added to its playlist or is refused.
+func startPlayRequest(w http.ResponseWriter, req PlaylistRequest) {
+	s, queued, err := startWithPolicy(req)
+	if err == errPlayerBusy {
+		log.Printf("Play request refused: %v", err)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Error starting player: %v", err)
+		http.Error(w, fmt.Sprintf("failed to start player: %v", err), http.StatusInternalServerError)
+		return
+	}
 
+	status := "playing"
+	if queued {
+		status = "queued"
+	}
+	routes := make([]string, len(req.Items))
+	for i, item := range req.Items {
+		routes[i] = item.route
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"status": "playing",
-		"path":   translatedPath,
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  status,
+		"items":   len(req.Items),
+		"session": s.ID,
+		"route":   routes[0],
+		"routes":  routes,
 	})
 }
 
+// resolvePlaylistItems looks up an item on the server of req and returns
+// the playlist entries for it. mediaSourceId selects the version of the
+// item itself.
+func resolvePlaylistItems(req *PlaylistRequest, itemId, mediaSourceId string) ([]PlaylistItem, error) {
+	_, videos, err := resolveItem(&jellyfinClient{ServerURL: req.ServerURL, UserId: req.UserID, Token: req.Token}, itemId)
+	if err != nil {
+		return nil, err
+	}
+	var items []PlaylistItem
+	for _, v := range videos {
+		if v.Id == itemId {
+			items = append(items, newPlaylistItem(v, mediaSourceId))
+		} else {
+			items = append(items, newPlaylistItem(v, ""))
+		}
+	}
+	return items, nil
+}
+
 // PlaylistRequest is the JSON body for /api/playlist
 type PlaylistRequest struct {
 	Items     []PlaylistItem `json:"items"`
 	ServerURL string         `json:"serverUrl"`
-	UserID    string         `json:"userId"`
-	Token     string         `json:"token"`
+	Display   string         `json:"display,omitempty"` // Display profile to play on
+	UserID    string         `json:"-"`                 // Filled in from the stored credentials
+	Token     string         `json:"-"`
 	Resume    bool           `json:"resume"`
+
+	StartPositionTicks int64  `json:"startPositionTicks,omitempty"` // Start of the first item, instead of its resume position
+	AudioLanguage      string `json:"audioLanguage,omitempty"`      // Preferred audio languages
+	SubtitleLanguage   string `json:"subtitleLanguage,omitempty"`   // Preferred subtitle languages
 }
 
 func playlistHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-
-	if r.Method == "OPTIONS" {
-		w.WriteHeader(http.StatusOK)
-		return
-	}
-
 	if r.Method != "POST" {
 		http.Error(w, "POST required", http.StatusMethodNotAllowed)
 		return
@@ -756,285 +732,392 @@ func playlistHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "empty playlist", http.StatusBadRequest)
 		return
 	}
+	if !isDisplay(req.Display) {
+		http.Error(w, fmt.Sprintf("unknown display %q", req.Display), http.StatusBadRequest)
+		return
+	}
 
-	log.Printf("Playing playlist of %d items", len(req.Items))
+	cred, ok := credentials.lookup(req.ServerURL)
+	if !ok {
+		http.Error(w, "no credentials stored for this server", http.StatusUnauthorized)
+		return
+	}
+	req.ServerURL, req.UserID, req.Token = cred.ServerURL, cred.UserId, cred.AccessToken
 
-	// Translate all paths (use stream URL if no mapping matches)
-	var translatedPaths []string
-	for i, item := range req.Items {
-		translated, mappingMatched := translatePath(item.Path)
-		if !mappingMatched && item.StreamUrl != "" {
-			translated = item.StreamUrl
-			log.Printf("  [%d] (stream) %s", i, item.StreamUrl)
-		} else {
-			log.Printf("  [%d] %s -> %s", i, item.Path, translated)
-		}
-		translatedPaths = append(translatedPaths, translated)
+	startPlayRequest(w, req)
+}
+
+// prepareItem returns what the player opens for an item: its translated
+// path, or its stream URL if no mapping matches. It sets the item's stream
+// URL and play method. If mapped files are checked and paths is nil, the
+// check is left for checkLatePath.
+func prepareItem(serverURL, token string, item *PlaylistItem, paths *pathChecker) string {
+	if item.StreamUrl == "" && item.ItemId != "" && token != "" {
+		c := &jellyfinClient{ServerURL: serverURL, Token: token}
+		item.StreamUrl = c.streamURL(item.ItemId, item.MediaSourceId)
 	}
 
-	// Get resume position for first item if requested
-	var startSeconds float64
-	if req.Resume && req.ServerURL != "" && req.UserID != "" && req.Token != "" && req.Items[0].ItemId != "" {
-		if storedPosition := getStoredPosition(req.ServerURL, req.UserID, req.Token, req.Items[0].ItemId); storedPosition > 0 {
-			startSeconds = storedPosition
-			log.Printf("Resume position for first item: %.1f seconds", startSeconds)
-		}
+	scope := itemScope(&jellyfinClient{ServerURL: serverURL, Token: token}, item)
+	recentPaths.add(item.Path, scope)
+	translated, mappingMatched := translatePath(item.Path, scope)
+	item.playMethod = playMethodDirectPlay
+	item.route = routeMapped
+	if !mappingMatched {
+		item.route = routeUnmapped
 	}
 
 	configMu.RLock()
-	playerKey := config.Player
-	playerConfig, ok := config.Players[playerKey]
-	urlEncode := config.URLEncode
+	checkPaths := config.CheckPaths
 	configMu.RUnlock()
+	if mappingMatched && checkPaths && paths == nil {
+		item.unchecked = &uncheckedPath{path: translated}
+	} else if mappingMatched && checkPaths {
+		if available, err := paths.availablePath(item.Path, scope); err == nil {
+			translated = available
+		} else if item.StreamUrl != "" {
+			log.Printf("Path check: %v, playing the stream", err)
+			item.route = routeStreamFallback
+			mappingMatched = false
+		} else {
+			log.Printf("Path check: %v, playing it anyway", err)
+		}
+	}
 
-	if !ok {
-		log.Printf("Unknown player %q, falling back to mpv", playerKey)
-		playerConfig = PlayerConfig{Path: "mpv", Args: []string{"--fs"}}
+	if !mappingMatched && item.StreamUrl != "" {
+		if item.route != routeStreamFallback {
+			log.Printf("No path mapping matches %s, playing the stream (test mappings on the config page)", item.Path)
+			item.route = routeStream
+		}
+		item.playMethod = playMethodDirectStream
+		return item.StreamUrl
+	}
+
+	// Check for colons in SMB paths (indicates a problem)
+	if strings.HasPrefix(translated, `\\`) {
+		// Find position after the server and share parts
+		// \\server\share\rest\of\path
+		parts := strings.SplitN(translated[2:], `\`, 3)
+		if len(parts) >= 3 && strings.Contains(parts[2], ":") {
+			log.Printf("Warning: Colon in SMB path may cause issues: %s", translated)
+		}
 	}
+	return translated
+}
 
-	args := append([]string{}, playerConfig.Args...)
-
-	// Add IPC/RC interface args based on player type
-	var ipcPath string
-	if playerKey == "mpv" {
-		ipcPath = getMpvIPCPath()
-		args = append(args, "--input-ipc-server="+ipcPath)
+// checkLatePath checks the mapped file of a playlist entry that was launched
+// without the check. If it cannot be read, the entry is replaced in the
+// player by the next mapping that can, or by the stream. It reports whether
+// the entry was replaced.
+func checkLatePath(s *playerSession, item PlaylistItem) bool {
+	checked := item
+	checked.unchecked = nil
+	checked.late = nil
+	translated := prepareItem(s.serverURL, s.token, &checked, s.paths)
+	if translated == item.unchecked.path {
+		return false
+	}
+	return queueReplace(s, item.unchecked, checked, translated)
+}
 
+// startPlaylist launches a player session on the items of req and tracks it
+// until it exits. Callers hold startMu.
+func startPlaylist(req PlaylistRequest) (*playerSession, error) {
+	log.Printf("Playing playlist of %d items", len(req.Items))
 
-		if startSeconds > 0 {
-			args = append(args, fmt.Sprintf("--start=%.1f", startSeconds))
-			log.Printf("Starting playback at %.1f seconds", startSeconds)
+	// Translate all paths (use stream URL if no mapping matches). Only the
+	// mapped file of the first item is checked now; those of later items
+	// are checked once the player runs.
+	paths := newPathChecker()
+	var translatedPaths []string
+	for i := range req.Items {
+		checker := paths
+		if i > 0 {
+			checker = nil
 		}
+		translated := prepareItem(req.ServerURL, req.Token, &req.Items[i], checker)
+		log.Printf("  [%d] %s", i, redact(translated))
+		translatedPaths = append(translatedPaths, translated)
 	}
 
-	// Add all paths to command line
-	for _, path := range translatedPaths {
-		pathForPlayer := path
-		if urlEncode {
-			pathForPlayer = url.PathEscape(path)
+	// Map the requested audio and subtitle streams of the first item. Those
+	// of later items that need the server are looked up once the player
+	// runs and handed to it when they start playing.
+	subs := &subtitleCache{}
+	tracks := []trackSelection{selectTracks(req.ServerURL, req.UserID, req.Token, req.Items[0], subs)}
+	for i := 1; i < len(req.Items); i++ {
+		if tracksNeedLookup(req.Items[i]) {
+			req.Items[i].late = &lateTracks{}
+			tracks = append(tracks, trackSelection{})
+			continue
 		}
-		args = append(args, pathForPlayer)
+		tracks = append(tracks, selectTracks(req.ServerURL, req.UserID, req.Token, req.Items[i], subs))
 	}
 
-	playerPath := fixPlayerPath(playerConfig.Path)
-	cmd := exec.Command(playerPath, args...)
-	noConsole(cmd) // Prevent console window flash on Windows
-	if err := cmd.Start(); err != nil {
-		log.Printf("Error starting player: %v", err)
-		http.Error(w, fmt.Sprintf("failed to start player: %v", err), http.StatusInternalServerError)
-		return
+	// Get resume position for first item if requested
+	startSeconds := float64(req.StartPositionTicks) / 10000000
+	if startSeconds == 0 && req.Resume && req.ServerURL != "" && req.UserID != "" && req.Token != "" && req.Items[0].ItemId != "" {
+		if storedPosition := getStoredPosition(req.ServerURL, req.UserID, req.Token, req.Items[0].ItemId); storedPosition > 0 {
+			startSeconds = storedPosition
+			log.Printf("Resume position for first item: %.1f seconds", startSeconds)
+		}
 	}
 
-	// Track state
-	currentPlayerMu.Lock()
-	currentPlayer = cmd
-	playlist = req.Items
-	playlistPosition = 0
-	playerItemId = req.Items[0].ItemId
-	playerIPCPath = ipcPath
-	currentPlayerType = playerKey
-	lastPosition = 0
-	videoDuration = 0
-	embyServerURL = req.ServerURL
-	embyUserId = req.UserID
-	embyToken = req.Token
-	currentPlayerMu.Unlock()
-
-	log.Printf("Stored Emby info: server=%s, userId=%s, hasToken=%v", req.ServerURL, req.UserID, req.Token != "")
-
-	// Bring mpv to front via IPC + Windows API
-	bringMpvToFront(ipcPath, cmd.Process.Pid)
+	id, seq := sessions.newID()
+	cmd, player, err := launchPlayer(id, launchRequest{
+		Display:          req.Display,
+		Paths:            translatedPaths,
+		Tracks:           tracks,
+		AudioLanguage:    req.AudioLanguage,
+		SubtitleLanguage: req.SubtitleLanguage,
+		StartSeconds:     startSeconds,
+		ItemId:           req.Items[0].ItemId,
+		Title:            req.Items[0].Title,
+		Subtitle:         tracks[0].selectedFile(),
+		AudioIndex:       req.Items[0].AudioStreamIndex,
+		ServerURL:        req.ServerURL,
+		Token:            req.Token,
+	})
+	if err != nil {
+		subs.cleanup()
+		return nil, err
+	}
 
-	// Report playback started
-	go reportPlaybackStart()
+	s := &playerSession{
+		ID:        id,
+		seq:       seq,
+		Display:   req.Display,
+		cmd:       cmd,
+		player:    player,
+		subs:      subs,
+		paths:     paths,
+		serverURL: req.ServerURL,
+		userId:    req.UserID,
+		token:     req.Token,
+		exited:    make(chan struct{}),
+		playlist:  req.Items,
+		// Reported at stop if the player never tells its position
+		lastPosition: startSeconds,
+		playback: newPlaybackSession(req.Items[0].ItemId, req.Items[0].MediaSourceId, req.Items[0].playMethod).
+			withStreams(req.Items[0].AudioStreamIndex, req.Items[0].SubtitleStreamIndex),
+	}
+	sessions.add(s)
+	publishEvent(s, stateEventLaunched, map[string]interface{}{
+		"display": s.Display,
+		"itemId":  req.Items[0].ItemId,
+		"title":   req.Items[0].Title,
+		"items":   len(req.Items),
+		"route":   req.Items[0].route,
+	})
 
-	// Monitor playlist position and wait for player to finish
-	go monitorPlaylist(cmd, ipcPath, playerKey)
+	log.Printf("Player session %s on display %q: server=%s, userId=%s, hasToken=%v", id, req.Display, req.ServerURL, req.UserID, req.Token != "")
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"status": "playing",
-		"items":  len(req.Items),
-	})
+	// Report playback started, monitor playlist position and wait for
+	// player to finish
+	go monitorPlaylist(s)
+	return s, nil
 }
 
-// monitorPlaylist tracks playlist position and reports progress for each item
-func monitorPlaylist(cmd *exec.Cmd, ipcPath string, playerType string) {
-	lastPos := 0
+// monitorPlaylist tracks playlist position and reports progress for each
+// item of a session. The session ends when the player exits.
+func monitorPlaylist(s *playerSession) {
+	var itemDuration float64
 
-	// Poll playlist position every second
-	ticker := time.NewTicker(time.Second)
-	defer ticker.Stop()
+	// Follow playlist position changes pushed by the player
+	events, unsubscribe := s.player.Subscribe()
+	defer unsubscribe()
+
+	// Reported here so the start always comes before the stop
+	reportPlaybackStart(s)
 
 	done := make(chan struct{})
 	go func() {
-		cmd.Wait()
+		s.cmd.Wait()
 		close(done)
 	}()
 
+	// Report progress periodically while the player runs
+	go runProgressReporter(s, done)
+	go runSegmentSkipper(s, done)
+	go runEventPublisher(s, done)
+	go resolveLateTracks(s, done)
+
 	for {
 		select {
 		case <-done:
 			// Player exited - report final item stopped
-			if ipcPath != "" && playerType == "mpv" {
-				getMpvPlaybackInfo()
-			}
-			reportPlaybackStopped()
-
-			currentPlayerMu.Lock()
-			if currentPlayer == cmd {
-				currentPlayer = nil
-				playerItemId = ""
-				playerIPCPath = ""
-				currentPlayerType = ""
-				playlist = nil
-				playlistPosition = 0
-				embyServerURL = ""
-				embyUserId = ""
-				embyToken = ""
-			}
-			currentPlayerMu.Unlock()
-			log.Printf("Player exited")
+			s.player.Close()
+			getPlaybackInfo(s)
+			reportPlaybackStopped(s)
+			s.subs.cleanup()
+
+			sessions.remove(s)
+			close(s.exited)
+			exitCode := s.cmd.ProcessState.ExitCode()
+			publishEvent(s, stateEventExited, map[string]interface{}{"exitCode": exitCode})
+			log.Printf("Player session %s exited (code %d)", s.ID, exitCode)
 			return
 
-		case <-ticker.C:
-			if ipcPath == "" {
+		case ev, ok := <-events:
+			if !ok {
+				events = nil // Control interface closed; wait for the process to exit
 				continue
 			}
-
-			// Query current playlist position based on player type
-			var newPos int
-			if playerType == "mpv" {
-				pos, err := queryMpvProperty(ipcPath, "playlist-pos")
-				if err != nil {
-					continue
+			if ev.Type == playerEventDuration {
+				itemDuration = ev.Value
+				continue
+			}
+			if ev.Type == playerEventFileLoaded {
+				index := int(ev.Value)
+				s.mu.Lock()
+				var item PlaylistItem
+				if index >= 0 && index < len(s.playlist) {
+					item = s.playlist[index]
 				}
-				posInt, ok := pos.(float64)
-				if !ok {
-					continue
+				s.mu.Unlock()
+				if item.late != nil {
+					go applyLateTracks(s, index, item)
 				}
-				newPos = int(posInt)
-			} else {
 				continue
 			}
-
-			if newPos != lastPos && newPos >= 0 {
-				currentPlayerMu.Lock()
-				plist := playlist
-				currentPlayerMu.Unlock()
-
-				if newPos < len(plist) {
-					// Position changed - report previous item complete
-					log.Printf("Playlist position changed: %d -> %d", lastPos, newPos)
-
-					// Mark previous item as complete
-					if lastPos >= 0 && lastPos < len(plist) {
-						currentPlayerMu.Lock()
-						playerItemId = plist[lastPos].ItemId
-						lastPosition = videoDuration // Set to end
-						currentPlayerMu.Unlock()
-						reportPlaybackStopped()
-					}
-
-					// Start tracking new item
-					currentPlayerMu.Lock()
-					playlistPosition = newPos
-					playerItemId = plist[newPos].ItemId
-					lastPosition = 0
-					videoDuration = 0
-					currentPlayerMu.Unlock()
-
-					reportPlaybackStart()
-					lastPos = newPos
-				}
+			if ev.Type != playerEventPlaylistPos {
+				continue
+			}
+			if playlistAdvanced(s, int(ev.Value), itemDuration) {
+				itemDuration = 0
 			}
 		}
 	}
 }
 
-func stopHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+// playlistAdvanced reports the entry the player left stopped and the one at
+// newPos started. An entry left by reaching its end counts as played to
+// itemDuration (its duration, if known); one left by a jump keeps the
+// position it was left at. It reports whether the playing entry changed.
+func playlistAdvanced(s *playerSession, newPos int, itemDuration float64) bool {
+	// The queue API keeps playlistPosition in step with entries
+	// added, removed or moved before the current one
+	s.mu.Lock()
+	lastPos := s.playlistPosition
+	plist := s.playlist
+	s.mu.Unlock()
+
+	if newPos == lastPos || newPos < 0 {
+		return false
+	}
+
+	s.mu.Lock()
+	jumped := s.playlistJumped
+	s.playlistJumped = false
+	s.mu.Unlock()
+	if newPos >= len(plist) {
+		return false
+	}
+
+	// Position changed - report previous item complete
+	log.Printf("Playlist position changed: %d -> %d", lastPos, newPos)
+
+	// Mark previous item as complete, unless it was left by
+	// jumping to another entry (the jump recorded its position)
+	if lastPos >= 0 && lastPos < len(plist) {
+		if !jumped {
+			s.mu.Lock()
+			if itemDuration > 0 {
+				s.videoDuration = itemDuration
+			}
+			s.lastPosition = s.videoDuration // Set to end
+			s.positionKnown = s.videoDuration > 0
+			s.mu.Unlock()
+		}
+		reportPlaybackStopped(s)
+	}
+
+	// Start tracking new item
+	s.mu.Lock()
+	s.playlistPosition = newPos
+	s.playback = newPlaybackSession(plist[newPos].ItemId, plist[newPos].MediaSourceId, plist[newPos].playMethod).
+		withStreams(plist[newPos].AudioStreamIndex, plist[newPos].SubtitleStreamIndex)
+	s.lastPosition = 0
+	s.positionKnown = false
+	s.videoDuration = 0
+	s.mu.Unlock()
+
+	publishEvent(s, stateEventPlaylistAdvanced, map[string]interface{}{
+		"from":   lastPos,
+		"to":     newPos,
+		"itemId": plist[newPos].ItemId,
+		"title":  plist[newPos].Title,
+	})
+	reportPlaybackStart(s)
+	return true
+}
 
-	if r.Method == "OPTIONS" {
-		w.WriteHeader(http.StatusOK)
+func stopHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
 		return
 	}
 
 	debugLog("Stop request received")
-
-	currentPlayerMu.Lock()
-	cmd := currentPlayer
-	currentPlayerMu.Unlock()
-
-	if cmd != nil && cmd.Process != nil {
-		log.Printf("Stopping player (pid %d)", cmd.Process.Pid)
-		// Try to quit gracefully via IPC first (handles launcher case)
-		currentPlayerMu.Lock()
-		ipcPath := playerIPCPath
-		pType := currentPlayerType
-		currentPlayerMu.Unlock()
-
-		if ipcPath != "" && pType == "mpv" {
-			if err := sendMpvCommand(ipcPath, "quit"); err != nil {
-				debugLog("IPC quit failed, falling back to kill: %v", err)
-				cmd.Process.Kill()
-			}
-		} else {
-			cmd.Process.Kill()
-		}
-	} else {
-		debugLog("Stop request: no player to stop (currentPlayer is nil)")
-	}
+	stopPlayer(sessions.get(r.URL.Query().Get("session")))
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"status": "stopped"})
 }
 
-func statusHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+// stopPlayer asks the player of a session to quit, killing it if that
+// fails. It returns false if there was no player to stop.
+func stopPlayer(s *playerSession) bool {
+	if s == nil || s.cmd.Process == nil {
+		debugLog("Stop request: no player to stop")
+		return false
+	}
 
-	if r.Method == "OPTIONS" {
-		w.WriteHeader(http.StatusOK)
-		return
+	log.Printf("Stopping player session %s (pid %d)", s.ID, s.cmd.Process.Pid)
+	// Try to quit gracefully via the control interface first (handles launcher case)
+	if err := s.player.Quit(); err != nil {
+		debugLog("IPC quit failed, falling back to kill: %v", err)
+		s.cmd.Process.Kill()
 	}
+	return true
+}
 
-	currentPlayerMu.Lock()
-	cmd := currentPlayer
-	itemId := playerItemId
-	pType := currentPlayerType
-	currentPlayerMu.Unlock()
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	s := sessions.get(r.URL.Query().Get("session"))
+	var itemId string
+	if s != nil {
+		if sess := s.current(); sess != nil {
+			itemId = sess.ItemId
+		}
+	}
 
 	// Process running is the source of truth for "playing"
-	playing := cmd != nil
+	playing := s != nil
 
 	w.Header().Set("Content-Type", "application/json")
 	if !playing {
 		json.NewEncoder(w).Encode(map[string]interface{}{
-			"playing":  false,
-			"paused":   false,
-			"itemId":   itemId,
-			"position": 0,
-			"duration": 0,
+			"playing":       false,
+			"paused":        false,
+			"itemId":        itemId,
+			"position":      0,
+			"duration":      0,
+			"queuedReports": len(reportQueue.snapshot()),
 		})
 		return
 	}
 
 	// Try to get detailed status from player IPC (may fail, that's ok)
-	var status PlayerStatus
-	if pType == "mpv" {
-		status, _ = getMpvPlaybackInfo()
-	}
+	status, _ := getPlaybackInfo(s)
 
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"playing":  true, // Process is running
-		"paused":   status.Paused,
-		"itemId":   itemId,
-		"position": status.Position,
-		"duration": status.Duration,
+		"playing":       true, // Process is running
+		"session":       s.ID,
+		"display":       s.Display,
+		"paused":        status.Paused,
+		"itemId":        itemId,
+		"position":      status.Position,
+		"duration":      status.Duration,
+		"queuedReports": len(reportQueue.snapshot()),
 	})
 }
 
@@ -1046,6 +1129,22 @@ func escapeHTML(s string) string {
 	return s
 }
 
+// mappingErrorStyle hides the error line of a valid mapping row
+func mappingErrorStyle(err error) string {
+	if err == nil {
+		return ` style="display: none;"`
+	}
+	return ""
+}
+
+// mappingErrorText is the escaped error of an invalid mapping row
+func mappingErrorText(err error) string {
+	if err == nil {
+		return ""
+	}
+	return escapeHTML(err.Error())
+}
+
 func selected(b bool) string {
 	if b {
 		return " selected"
@@ -1058,8 +1157,91 @@ func configPageHandler(w http.ResponseWriter, r *http.Request) {
 		configMu.RLock()
 		mappings := config.PathMappings
 		urlEncode := config.URLEncode
+		checkPaths := config.CheckPaths
 		debug := config.Debug
+		progressInterval := config.ProgressInterval
+		playedPercent := config.PlayedPercent
+		playedSeconds := config.PlayedSeconds
+		skipPlayedChecked := ""
+		if config.SkipPlayed {
+			skipPlayedChecked = " checked"
+		}
+		currentPlayerKey := config.Player
+		players := config.Players
 		configMu.RUnlock()
+		segmentActions, skipKey := getSegmentActions()
+		_, specials := getPlaylistOptions()
+		instancePolicy := getInstancePolicy()
+		configMu.RLock()
+		client := config.Client
+		configMu.RUnlock()
+
+		clientEnabledChecked := ""
+		if client.Enabled {
+			clientEnabledChecked = " checked"
+		}
+		clientStatus := "Not logged in"
+		if _, ok := clientCredential(client); ok {
+			clientStatus = "Logged in as " + escapeHTML(client.Username) + " on " + escapeHTML(client.ServerURL)
+		}
+
+		// Build stored server rows
+		var serverRows strings.Builder
+		for _, c := range credentials.list() {
+			serverRows.WriteString(fmt.Sprintf(`
+            <div class="mapping-row">
+                <span style="flex: 1;"><code>%s</code> as %s</span>
+                <button type="button" class="remove-btn" onclick="removeServer(this)" data-server="%s">&times;</button>
+            </div>`, escapeHTML(c.ServerURL), escapeHTML(c.UserName), escapeHTML(c.ServerURL)))
+		}
+		if serverRows.Len() == 0 {
+			serverRows.WriteString(`
+            <p class="help">No servers yet. They are added when you first play from a Jellyfin page, or log in below.</p>`)
+		}
+
+		// Build player options HTML
+		var playerOptions strings.Builder
+		for _, key := range playerKeys(players) {
+			playerOptions.WriteString(fmt.Sprintf(`<option value="%s"%s>%s</option>`,
+				escapeHTML(key), selected(key == currentPlayerKey), escapeHTML(key)))
+		}
+
+		// Build specials placement options
+		var specialsOptions strings.Builder
+		for _, p := range specialsPlacements {
+			specialsOptions.WriteString(fmt.Sprintf(`<option value="%s"%s>%s</option>`, p, selected(p == specials), p))
+		}
+
+		// Build instance policy options
+		var policyOptions strings.Builder
+		for _, p := range instancePolicies {
+			policyOptions.WriteString(fmt.Sprintf(`<option value="%s"%s>%s</option>`, p, selected(p == instancePolicy), p))
+		}
+
+		// Build media segment action rows
+		var segmentRows strings.Builder
+		for _, t := range segmentTypes {
+			a := segmentActions[t]
+			segmentRows.WriteString(fmt.Sprintf(`
+            <label style="display: flex; align-items: center; gap: 8px; font-weight: normal; margin-bottom: 6px;">
+                <span style="width: 100px;">%s</span>
+                <select name="segment_%s">
+                    <option value="off"%s>Play</option>
+                    <option value="prompt"%s>Prompt to skip</option>
+                    <option value="skip"%s>Skip automatically</option>
+                </select>
+            </label>`,
+				t, t,
+				selected(a != segmentActionPrompt && a != segmentActionSkip),
+				selected(a == segmentActionPrompt), selected(a == segmentActionSkip)))
+		}
+
+		if progressInterval <= 0 {
+			progressInterval = defaultProgressInterval
+		}
+		if playedPercent <= 0 {
+			playedPercent = defaultPlayedPercent
+		}
 
 		// Build mapping rows HTML
 		var mappingRows strings.Builder
@@ -1075,17 +1257,36 @@ func configPageHandler(w http.ResponseWriter, r *http.Request) {
                 <span class="arrow">&rarr;</span>
                 <input type="text" name="mapping_replace_%d" value="%s" placeholder="Replace with" class="mapping-replace">
                 <button type="button" class="remove-btn" onclick="removeMapping(this)">&times;</button>
+                <div class="mapping-scope">
+                    Only for
+                    <input type="text" name="mapping_server_%d" value="%s" placeholder="Any server" class="mapping-server" list="mappingServers">
+                    <input type="text" name="mapping_library_%d" value="%s" placeholder="Any library" class="mapping-library" list="mappingLibraries">
+                </div>
+                <div class="mapping-error"%s>%s</div>
             </div>`,
 				i, i,
 				selected(m.Type == "prefix"), selected(m.Type == "wildcard"), selected(m.Type == "regex"),
 				i, escapeHTML(m.Match),
-				i, escapeHTML(m.Replace)))
+				i, escapeHTML(m.Replace),
+				i, escapeHTML(m.Server),
+				i, escapeHTML(m.Library),
+				mappingErrorStyle(m.err), mappingErrorText(m.err)))
+		}
+
+		// Servers path mappings can be limited to
+		var serverOptions strings.Builder
+		for _, c := range credentials.list() {
+			serverOptions.WriteString(fmt.Sprintf(`<option value="%s">`, escapeHTML(c.ServerURL)))
 		}
 
 		urlEncodeChecked := ""
 		if urlEncode {
 			urlEncodeChecked = " checked"
 		}
+		checkPathsChecked := ""
+		if checkPaths {
+			checkPathsChecked = " checked"
+		}
 
 		debugChecked := ""
 		if debug {
@@ -1124,6 +1325,9 @@ func configPageHandler(w http.ResponseWriter, r *http.Request) {
             flex-wrap: wrap;
         }
         .mapping-type { width: 100px; flex-shrink: 0; }
+        .mapping-error { flex-basis: 100%; color: #b91c1c; font-size: 13px; }
+        .mapping-scope { flex-basis: 100%; display: flex; align-items: center; gap: 10px; color: #666; font-size: 13px; padding-left: 110px; }
+        .mapping-server, .mapping-library { flex: 1; min-width: 150px; }
         .mapping-match, .mapping-replace { flex: 1; min-width: 200px; }
         .arrow { color: #666; font-size: 18px; }
         .remove-btn {
@@ -1167,23 +1371,110 @@ func configPageHandler(w http.ResponseWriter, r *http.Request) {
         .tip { background: #f0fdf4; padding: 12px; border-radius: 4px; margin-top: 10px; font-size: 13px; color: #166534; }
         .warning { background: #fef3c7; border: 1px solid #f59e0b; color: #92400e; padding: 15px; border-radius: 8px; margin-top: 30px; }
         .warning a { color: #92400e; font-weight: 500; }
+        .trace { width: 100%; border-collapse: collapse; font-size: 13px; margin-top: 10px; }
+        .trace th, .trace td { text-align: left; padding: 6px; border-bottom: 1px solid #e5e7eb; vertical-align: top; word-break: break-all; }
+        .trace .applied { background: #ecfdf5; }
+        .trace .skipped { color: #9ca3af; }
+        .trace-ok { color: #166534; }
+        .trace-bad { color: #b91c1c; }
     </style>
 </head>
 <body>
     <h1>JF External Player Configuration</h1>
 
     <form method="POST" id="configForm">
-        <input type="hidden" name="player" value="mpv">
+        ` + csrfField() + `
         <div class="section">
             <h2>Options</h2>
+            <label style="display: flex; align-items: center; gap: 8px; font-weight: normal; margin-bottom: 10px;">
+                Player
+                <select name="player" id="playerSelect">` + playerOptions.String() + `</select>
+            </label>
             <label style="display: flex; align-items: center; gap: 8px; font-weight: normal;">
                 <input type="checkbox" name="url_encode" value="1"` + urlEncodeChecked + `>
                 URL-encode paths when passing to player (for paths with special characters)
             </label>
+            <label style="display: flex; align-items: center; gap: 8px; font-weight: normal; margin-top: 10px;">
+                <input type="checkbox" name="check_paths" value="1"` + checkPathsChecked + `>
+                Check that mapped files can be read before playing; if not, try the next matching mapping, then the Jellyfin stream
+            </label>
+            <label style="display: flex; align-items: center; gap: 8px; font-weight: normal; margin-top: 10px;">
+                While a player is running, play requests
+                <select name="instance_policy">` + policyOptions.String() + `</select>
+                <span class="help" style="margin: 0;">replace = quit it first, enqueue = add to its playlist, reject = answer 409</span>
+            </label>
             <label style="display: flex; align-items: center; gap: 8px; font-weight: normal; margin-top: 10px;">
                 <input type="checkbox" name="debug" value="1"` + debugChecked + `>
                 Enable debug logging (browser console and server log)
             </label>
+            <label style="display: flex; align-items: center; gap: 8px; font-weight: normal; margin-top: 10px;">
+                Report playback progress to Jellyfin every
+                <input type="number" name="progress_interval" min="1" value="` + fmt.Sprintf("%d", progressInterval) + `" style="width: 70px;">
+                seconds
+            </label>
+            <label style="display: flex; align-items: center; gap: 8px; font-weight: normal; margin-top: 10px;">
+                Mark as played when stopped after
+                <input type="number" name="played_percent" min="1" max="100" step="any" value="` + strconv.FormatFloat(playedPercent, 'f', -1, 64) + `" style="width: 70px;">
+                % or within
+                <input type="number" name="played_seconds" min="0" step="any" value="` + strconv.FormatFloat(playedSeconds, 'f', -1, 64) + `" style="width: 70px;">
+                seconds of the end (0 = off)
+            </label>
+        </div>
+
+        <div class="section">
+            <h2>Series Playlists</h2>
+            <p class="help" style="margin-top: 0;">
+                Playing a series or season starts at the next episode to watch and continues from there.
+            </p>
+            <label style="display: flex; align-items: center; gap: 8px; font-weight: normal; margin-bottom: 10px;">
+                <input type="checkbox" name="skip_played" value="1"` + skipPlayedChecked + `>
+                Leave out episodes already played
+            </label>
+            <label style="display: flex; align-items: center; gap: 8px; font-weight: normal;">
+                Specials
+                <select name="specials">` + specialsOptions.String() + `</select>
+                <span class="help" style="margin: 0;">aired = where they aired between episodes, if known</span>
+            </label>
+        </div>
+
+        <div class="section">
+            <h2>Media Segments</h2>
+            <p class="help" style="margin-top: 0;">
+                What to do when playback reaches a segment detected by Jellyfin (requires Jellyfin 10.10 and mpv).
+            </p>` + segmentRows.String() + `
+            <label style="display: flex; align-items: center; gap: 8px; font-weight: normal; margin-top: 10px;">
+                Skip key
+                <input type="text" name="skip_key" value="` + escapeHTML(skipKey) + `" style="width: 100px;">
+                <span class="help" style="margin: 0;">mpv key name, e.g. TAB, ENTER or s</span>
+            </label>
+        </div>
+
+        <div class="section">
+            <h2>Client Mode <span style="font-weight: normal; font-size: 14px; color: #666;">(Optional)</span></h2>
+            <p class="help" style="margin-top: 0;">
+                Log in to a Jellyfin server as a device, so any Jellyfin app (e.g. on a phone) can play to this computer.
+            </p>
+            <label style="display: flex; align-items: center; gap: 8px; font-weight: normal; margin-bottom: 10px;">
+                <input type="checkbox" name="client_enabled" value="1"` + clientEnabledChecked + `>
+                Enable client mode
+            </label>
+            <label style="display: flex; align-items: center; gap: 8px; font-weight: normal; margin-bottom: 6px;">
+                <span style="width: 100px;">Server URL</span>
+                <input type="text" name="client_server_url" value="` + escapeHTML(client.ServerURL) + `" placeholder="http://192.168.1.10:8096" style="flex: 1;">
+            </label>
+            <label style="display: flex; align-items: center; gap: 8px; font-weight: normal; margin-bottom: 6px;">
+                <span style="width: 100px;">Username</span>
+                <input type="text" name="client_username" value="` + escapeHTML(client.Username) + `" style="flex: 1;">
+            </label>
+            <label style="display: flex; align-items: center; gap: 8px; font-weight: normal; margin-bottom: 6px;">
+                <span style="width: 100px;">Password</span>
+                <input type="password" name="client_password" placeholder="Leave empty to keep the current login" style="flex: 1;" autocomplete="new-password">
+            </label>
+            <label style="display: flex; align-items: center; gap: 8px; font-weight: normal; margin-bottom: 6px;">
+                <span style="width: 100px;">Device name</span>
+                <input type="text" name="client_device_name" value="` + escapeHTML(client.DeviceName) + `" placeholder="Host name" style="flex: 1;">
+            </label>
+            <p class="help">` + clientStatus + `</p>
         </div>
 
         <div class="section">
@@ -1198,19 +1489,55 @@ func configPageHandler(w http.ResponseWriter, r *http.Request) {
 
             <div id="mappingsContainer">` + mappingRows.String() + `
             </div>
+            <datalist id="mappingServers">` + serverOptions.String() + `</datalist>
+            <datalist id="mappingLibraries"></datalist>
 
             <button type="button" class="add-btn" onclick="addMapping()">+ Add Mapping</button>
+            <button type="button" class="add-btn" onclick="suggestMappings()">Suggest from Mounts</button>
+            <div id="suggestions"></div>
 
             <div class="tip">
                 <strong>Tip:</strong> To find the path Jellyfin uses, go to any video, click the three dots menu, then "Edit metadata". The file path is shown there.
                 <a href="/help/mappings">See mapping examples &rarr;</a>
             </div>
+            <p class="help">
+                A mapping can be limited to the items of one server, one library, or both, for servers or libraries
+                whose paths look alike but are mounted differently here. Mappings apply in order, so put limited ones first.
+            </p>
+
+            <h2 style="margin-top: 20px;">Test Mappings</h2>
+            <div class="mapping-row">
+                <input type="text" id="testPath" placeholder="/media/movies/Film (2020)/Film.mkv" style="flex: 1;">
+                <button type="button" class="add-btn" style="margin-top: 0;" onclick="testMappings()">Test</button>
+            </div>
+            <div class="mapping-row">
+                <input type="text" id="testServer" placeholder="Server URL (optional)" list="mappingServers" style="flex: 1;">
+                <input type="text" id="testLibrary" placeholder="Library (optional)" list="mappingLibraries" style="flex: 1;">
+            </div>
+            <p class="help" style="margin-top: 0;">Runs a server path through the mappings above, saved or not, and checks the result on this machine.
+                Mappings limited to another server or library are skipped.</p>
+            <div id="testResult"></div>
         </div>
 
         <button type="submit" class="save-btn">Save Configuration</button>
         <span class="success" id="savedMsg" style="display: none;">Saved!</span>
     </form>
 
+    <div class="section" style="margin-top: 20px;">
+        <h2>Servers</h2>
+        <p class="help" style="margin-top: 0;">
+            Access tokens used to play items and report progress, one per server. They are kept in
+            <code>` + escapeHTML(filepath.Join(filepath.Dir(configPath), credentialsFile)) + `</code> and never sent back to the browser.
+        </p>` + serverRows.String() + `
+        <div class="mapping-row" style="margin-top: 15px;">
+            <input type="text" id="loginServer" placeholder="http://192.168.1.10:8096" style="flex: 1;">
+            <input type="text" id="loginUser" placeholder="Username" style="width: 140px;">
+            <input type="password" id="loginPassword" placeholder="Password" style="width: 140px;" autocomplete="new-password">
+            <button type="button" class="add-btn" style="margin-top: 0;" onclick="loginServer()">Log in</button>
+        </div>
+        <p class="help" id="loginStatus"></p>
+    </div>
+
     <div id="installWarning" class="warning" style="display: none;">
         <strong>Warning!</strong> No browser extension or userscript detected.
         <a href="/install">Please install.</a>
@@ -1218,10 +1545,11 @@ func configPageHandler(w http.ResponseWriter, r *http.Request) {
 
     <p style="margin-top: 30px; font-size: 12px; color: #666;">Config file: <code>` + escapeHTML(configPath) + `</code></p>
 
-    <script>
+    <script>` + apiFetchScript() + `
         let mappingIndex = ` + fmt.Sprintf("%d", len(mappings)) + `;
 
-        function addMapping() {
+        // Add a mapping row, filled in from mapping if given
+        function addMapping(mapping) {
             const container = document.getElementById('mappingsContainer');
             const row = document.createElement('div');
             row.className = 'mapping-row';
@@ -1236,15 +1564,192 @@ func configPageHandler(w http.ResponseWriter, r *http.Request) {
                 <span class="arrow">&rarr;</span>
                 <input type="text" name="mapping_replace_${mappingIndex}" placeholder="Replace with" class="mapping-replace">
                 <button type="button" class="remove-btn" onclick="removeMapping(this)">&times;</button>
+                <div class="mapping-scope">
+                    Only for
+                    <input type="text" name="mapping_server_${mappingIndex}" placeholder="Any server" class="mapping-server" list="mappingServers">
+                    <input type="text" name="mapping_library_${mappingIndex}" placeholder="Any library" class="mapping-library" list="mappingLibraries">
+                </div>
+                <div class="mapping-error" style="display: none;"></div>
             ` + "`" + `;
             container.appendChild(row);
             mappingIndex++;
+            if (mapping) {
+                row.querySelector('.mapping-type').value = mapping.type;
+                row.querySelector('.mapping-match').value = mapping.match;
+                row.querySelector('.mapping-replace').value = mapping.replace;
+                row.querySelector('.mapping-server').value = mapping.server || '';
+                row.querySelector('.mapping-library').value = mapping.library || '';
+            }
         }
 
         function removeMapping(btn) {
             btn.closest('.mapping-row').remove();
         }
 
+        // The mapping of a row as the API takes it
+        function readMapping(row) {
+            return {
+                type: row.querySelector('.mapping-type').value,
+                match: row.querySelector('.mapping-match').value,
+                replace: row.querySelector('.mapping-replace').value,
+                server: row.querySelector('.mapping-server').value.trim(),
+                library: row.querySelector('.mapping-library').value.trim()
+            };
+        }
+
+        // Offer the libraries of the stored servers in the library fields
+        (async function loadLibraries() {
+            try {
+                const resp = await apiFetch('/api/libraries');
+                const list = document.getElementById('mappingLibraries');
+                (await resp.json()).forEach(lib => {
+                    const option = document.createElement('option');
+                    option.value = lib.id;
+                    option.label = lib.name + ' (' + lib.serverUrl + ')';
+                    list.appendChild(option);
+                });
+            } catch (err) {
+                console.warn('Failed to list libraries:', err);
+            }
+        })();
+
+        function escapeText(s) {
+            const div = document.createElement('div');
+            div.textContent = s == null ? '' : String(s);
+            return div.innerHTML;
+        }
+
+        // Dry run the sample path through the mappings as they are in the form
+        async function testMappings() {
+            const result = document.getElementById('testResult');
+            const path = document.getElementById('testPath').value.trim();
+            if (!path) return;
+            const mappings = [];
+            document.querySelectorAll('#mappingsContainer .mapping-row').forEach(row => {
+                const mapping = readMapping(row);
+                if (mapping.match === '') return;
+                mappings.push(mapping);
+            });
+
+            const resp = await apiFetch('/api/mappings/test', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({
+                    path: path,
+                    serverUrl: document.getElementById('testServer').value.trim(),
+                    library: document.getElementById('testLibrary').value.trim(),
+                    mappings: mappings
+                })
+            });
+            if (!resp.ok) {
+                result.innerHTML = '<p class="trace-bad">' + escapeText(await resp.text()) + '</p>';
+                return;
+            }
+            const trace = await resp.json();
+
+            let html = '<table class="trace"><tr><th>#</th><th>Mapping</th><th>Matched</th><th>Groups</th><th>Output</th></tr>';
+            let applied = false;
+            trace.steps.forEach(step => {
+                const cls = step.applied ? 'applied' : (applied ? 'skipped' : '');
+                if (step.applied) applied = true;
+                let matched = step.error ? '<span class="trace-bad">' + escapeText(step.error) + '</span>'
+                    : (step.matched ? (step.applied ? 'yes, used' : 'yes, not used') : 'no');
+                if (!step.error && !step.inScope) matched += ' (other server or library)';
+                const scope = [step.server, step.library].filter(s => s).map(escapeText).join(', ');
+                html += '<tr class="' + cls + '"><td>' + (step.index + 1) + '</td>' +
+                    '<td>' + escapeText(step.type) + ': ' + escapeText(step.match) + ' &rarr; ' + escapeText(step.replace) +
+                    (scope ? '<br><small>only for ' + scope + '</small>' : '') + '</td>' +
+                    '<td>' + matched + '</td>' +
+                    '<td>' + (step.groups || []).map(g => '<code>' + escapeText(g) + '</code>').join(' ') + '</td>' +
+                    '<td>' + escapeText(step.output) + '</td></tr>';
+            });
+            html += '</table>';
+
+            if (!trace.mapped) {
+                html += '<p class="trace-bad">No mapping matches; the player gets the Jellyfin stream instead of the file.</p>';
+            } else {
+                html += '<p>Output: <code>' + escapeText(trace.output) + '</code><br>' +
+                    'On Windows: <code>' + escapeText(trace.windowsOutput) + '</code><br>' +
+                    'Player gets: <code>' + escapeText(trace.result) + '</code><br>';
+                if (!trace.checked) {
+                    html += 'Not checked: the player opens this URL itself.';
+                } else if (trace.readable) {
+                    html += '<span class="trace-ok">Exists and is readable on this machine.</span>';
+                } else {
+                    html += '<span class="trace-bad">' + (trace.exists ? 'Exists but is not readable' : 'Not found') +
+                        ' on this machine: ' + escapeText(trace.checkError) + '</span>';
+                }
+                html += '</p>';
+            }
+            result.innerHTML = html;
+        }
+
+        // Propose mappings from the network shares mounted here and the paths
+        // of recently played items, or the path under Test Mappings
+        async function suggestMappings() {
+            const box = document.getElementById('suggestions');
+            box.innerHTML = '<p class="help">Looking at the mounts...</p>';
+            const path = document.getElementById('testPath').value.trim();
+            const resp = await apiFetch('/api/mappings/suggest' + (path ? '?path=' + encodeURIComponent(path) : ''));
+            if (!resp.ok) {
+                box.innerHTML = '<p class="trace-bad">' + escapeText(await resp.text()) + '</p>';
+                return;
+            }
+            const data = await resp.json();
+            if (data.suggestions.length === 0) {
+                box.innerHTML = '<p class="help">No suggestions from ' + data.mounts.length + ' network mount(s) and ' +
+                    data.samples + ' sample path(s). Play something from Jellyfin, or enter a server path under Test Mappings, and try again.</p>';
+                return;
+            }
+            box.innerHTML = '<p class="help">Add the ones that look right, then save.</p>';
+            data.suggestions.forEach(s => {
+                const row = document.createElement('div');
+                row.className = 'mapping-row';
+                const checked = s.verified
+                    ? '<span class="trace-ok">found ' + escapeText(s.localSample) + '</span>'
+                    : '<span class="trace-bad">sample file not found</span>';
+                row.innerHTML = '<span style="flex: 1;"><code>' + escapeText(s.mapping.match) + '</code> &rarr; <code>' +
+                    escapeText(s.mapping.replace) + '</code>' +
+                    (s.mapping.server ? ' (only for ' + escapeText(s.mapping.server) + ')' : '') +
+                    '<br><small>' + escapeText(s.mount.source) + ' on ' + escapeText(s.mount.target) + ', ' +
+                    s.paths + ' path(s); ' + checked + '</small></span>' +
+                    '<button type="button" class="add-btn" style="margin-top: 0;">Add</button>';
+                row.querySelector('button').addEventListener('click', () => {
+                    addMapping(s.mapping);
+                    row.remove();
+                });
+                box.appendChild(row);
+            });
+        }
+
+        async function loginServer() {
+            const status = document.getElementById('loginStatus');
+            status.textContent = 'Logging in...';
+            const resp = await apiFetch('/api/credentials', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({
+                    serverUrl: document.getElementById('loginServer').value,
+                    username: document.getElementById('loginUser').value,
+                    password: document.getElementById('loginPassword').value
+                })
+            });
+            if (resp.ok) {
+                window.location.reload();
+            } else {
+                status.textContent = await resp.text();
+            }
+        }
+
+        async function removeServer(btn) {
+            const server = btn.dataset.server;
+            if (!confirm('Forget the access token for ' + server + '?')) {
+                return;
+            }
+            await apiFetch('/api/credentials?serverUrl=' + encodeURIComponent(server), { method: 'DELETE' });
+            window.location.reload();
+        }
+
         // Show saved message if redirected with ?saved=1
         if (window.location.search.includes('saved=1')) {
             document.getElementById('savedMsg').style.display = 'inline';
@@ -1266,14 +1771,55 @@ func configPageHandler(w http.ResponseWriter, r *http.Request) {
             }, 1000);
         })();
 
+        // Check the path mappings before saving; invalid ones are shown at
+        // their row and nothing is saved
+        async function validateMappings() {
+            const rows = [];
+            const mappings = [];
+            document.querySelectorAll('#mappingsContainer .mapping-row').forEach(row => {
+                const error = row.querySelector('.mapping-error');
+                error.style.display = 'none';
+                error.textContent = '';
+                const mapping = readMapping(row);
+                if (mapping.match === '') return;
+                rows.push(row);
+                mappings.push(mapping);
+            });
+            const resp = await apiFetch('/api/mappings/validate', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ mappings: mappings })
+            });
+            const data = await resp.json();
+            data.errors.forEach((msg, i) => {
+                if (!msg) return;
+                const error = rows[i].querySelector('.mapping-error');
+                error.textContent = msg;
+                error.style.display = '';
+            });
+            if (!data.valid) {
+                rows[data.errors.findIndex(msg => msg)].scrollIntoView({ block: 'center' });
+            }
+            return data.valid;
+        }
+
         // Check if player is found before saving
         document.getElementById('configForm').addEventListener('submit', async function(e) {
             e.preventDefault();
             try {
-                const resp = await fetch('/api/check-player');
+                if (!await validateMappings()) {
+                    return;
+                }
+            } catch (err) {
+                // The server checks them again
+                console.warn('Mapping check failed:', err);
+            }
+            try {
+                const player = document.getElementById('playerSelect').value;
+                const resp = await apiFetch('/api/check-player?player=' + encodeURIComponent(player));
                 const data = await resp.json();
                 if (!data.found) {
-                    if (!confirm('mpv was not found on this system. Save anyway?')) {
+                    if (!confirm(player + ' was not found on this system. Save anyway?')) {
                         return;
                     }
                 }
@@ -1286,6 +1832,8 @@ func configPageHandler(w http.ResponseWriter, r *http.Request) {
     </script>
 </body>
 </html>`
+		// The page embeds the API secret; keep other sites from framing it
+		w.Header().Set("X-Frame-Options", "DENY")
 		w.Header().Set("Content-Type", "text/html")
 		w.Write([]byte(html))
 		return
@@ -1293,10 +1841,17 @@ func configPageHandler(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method == "POST" {
 		r.ParseForm()
+		if !validCSRFToken(r) {
+			http.Error(w, "invalid or missing CSRF token; reload the page", http.StatusForbidden)
+			return
+		}
 
-		// Get player selection (only mpv is supported)
+		// Get player selection (must be one of the configured players)
 		player := r.FormValue("player")
-		if player != "mpv" {
+		configMu.RLock()
+		_, known := config.Players[player]
+		configMu.RUnlock()
+		if !known {
 			player = "mpv"
 		}
 
@@ -1310,6 +1865,8 @@ func configPageHandler(w http.ResponseWriter, r *http.Request) {
 			match := r.FormValue(matchKey)
 			replace := r.FormValue(replaceKey)
 			mappingType := r.FormValue(typeKey)
+			server := normalizeServerURL(r.FormValue(fmt.Sprintf("mapping_server_%d", i)))
+			library := strings.TrimSpace(r.FormValue(fmt.Sprintf("mapping_library_%d", i)))
 
 			// Check if this mapping exists (at least match or replace has a value)
 			if match == "" && replace == "" {
@@ -1328,20 +1885,111 @@ func configPageHandler(w http.ResponseWriter, r *http.Request) {
 					Type:    mappingType,
 					Match:   match,
 					Replace: replace,
+					Server:  server,
+					Library: library,
 				})
 			}
 		}
+		// The page checks the mappings before it posts them; this catches
+		// posts that skipped the check
+		if errs := compileMappings(mappings); len(errs) > 0 {
+			msg := "Configuration not saved, invalid path mappings:"
+			for _, err := range errs {
+				msg += "\n  " + err.Error()
+			}
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
 
 		// Get checkboxes
 		urlEncode := r.FormValue("url_encode") == "1"
+		checkPaths := r.FormValue("check_paths") == "1"
 		debug := r.FormValue("debug") == "1"
 
+		progressInterval, err := strconv.Atoi(r.FormValue("progress_interval"))
+		if err != nil || progressInterval <= 0 {
+			progressInterval = defaultProgressInterval
+		}
+
+		playedPercent, err := strconv.ParseFloat(r.FormValue("played_percent"), 64)
+		if err != nil || playedPercent <= 0 {
+			playedPercent = defaultPlayedPercent
+		}
+		playedSeconds, err := strconv.ParseFloat(r.FormValue("played_seconds"), 64)
+		if err != nil || playedSeconds < 0 {
+			playedSeconds = 0
+		}
+
+		segmentActions := map[string]string{}
+		for _, t := range segmentTypes {
+			switch a := r.FormValue("segment_" + t); a {
+			case segmentActionSkip, segmentActionPrompt:
+				segmentActions[t] = a
+			default:
+				segmentActions[t] = segmentActionOff
+			}
+		}
+		skipPlayed := r.FormValue("skip_played") == "1"
+		specials := r.FormValue("specials")
+		instancePolicy := r.FormValue("instance_policy")
+
+		skipKey := strings.TrimSpace(r.FormValue("skip_key"))
+		if skipKey == "" || strings.ContainsAny(skipKey, " \t\r\n") {
+			skipKey = defaultSkipKey
+		}
+
+		// Client mode: log in when a password is given. The password itself is
+		// never stored, only the access token.
+		configMu.RLock()
+		client := config.Client
+		configMu.RUnlock()
+		clientServerURL := strings.TrimSuffix(strings.TrimSpace(r.FormValue("client_server_url")), "/")
+		clientUsername := strings.TrimSpace(r.FormValue("client_username"))
+		client.Enabled = r.FormValue("client_enabled") == "1"
+		client.ServerURL = clientServerURL
+		client.Username = clientUsername
+		client.DeviceName = strings.TrimSpace(r.FormValue("client_device_name"))
+		if client.DeviceId == "" {
+			client.DeviceId = newDeviceId()
+		}
+		loggedIn := false
+		if password := r.FormValue("client_password"); password != "" {
+			c := &jellyfinClient{ServerURL: client.ServerURL, DeviceId: client.DeviceId, DeviceName: client.DeviceName}
+			if err := c.authenticateByName(client.Username, password); err != nil {
+				http.Error(w, fmt.Sprintf("Client mode login failed: %v", err), http.StatusBadRequest)
+				return
+			}
+			log.Printf("Client mode: logged in to %s as %s", client.ServerURL, client.Username)
+			err := credentials.put(serverCredential{
+				ServerURL:   client.ServerURL,
+				UserId:      c.UserId,
+				UserName:    client.Username,
+				AccessToken: c.Token,
+			})
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Failed to store the client mode login: %v", err), http.StatusInternalServerError)
+				return
+			}
+			loggedIn = true
+		}
+
 		configMu.Lock()
+		clientChanged := config.Client != client || loggedIn
 		config.Player = player
 		config.PathMappings = mappings
 		config.URLEncode = urlEncode
+		config.CheckPaths = checkPaths
 		config.Debug = debug
-		err := saveConfigLocked()
+		config.ProgressInterval = progressInterval
+		config.PlayedPercent = playedPercent
+		config.PlayedSeconds = playedSeconds
+		config.SegmentActions = segmentActions
+		config.SkipKey = skipKey
+		config.SkipPlayed = skipPlayed
+		config.Specials = specials
+		config.InstancePolicy = instancePolicy
+		config.Client = client
+		err = saveConfigLocked()
 		configMu.Unlock()
 
 		if err != nil {
@@ -1349,13 +1997,16 @@ func configPageHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		if clientChanged {
+			restartClientMode()
+		}
+
 		http.Redirect(w, r, "/config?saved=1", http.StatusSeeOther)
 		return
 	}
 }
 
 func configAPIHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Content-Type", "application/json")
 
 	configMu.RLock()
@@ -1365,27 +2016,50 @@ func configAPIHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func checkPlayerHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Content-Type", "application/json")
 
-	// Use findMpv which checks configured path, PATH, and common install locations
-	mpvPath := findMpv()
-	if mpvPath == "" {
-		json.NewEncoder(w).Encode(map[string]interface{}{"found": false, "error": "mpv not found"})
+	configMu.RLock()
+	playerKey := r.URL.Query().Get("player")
+	if playerKey == "" {
+		playerKey = config.Player
+	}
+	playerConfig, ok := config.Players[playerKey]
+	configMu.RUnlock()
+
+	if !ok {
+		json.NewEncoder(w).Encode(map[string]interface{}{"found": false, "error": "unknown player " + playerKey})
+		return
+	}
+
+	// Check the configured path, then PATH and common install locations
+	playerPath, err := exec.LookPath(fixPlayerPath(playerConfig.Path))
+	if err != nil {
+		switch playerType(playerKey, playerConfig) {
+		case playerTypeMpv:
+			playerPath = findMpv()
+		case playerTypeVlc:
+			playerPath = findVlc()
+		default:
+			playerPath = ""
+		}
+	}
+	if playerPath == "" {
+		json.NewEncoder(w).Encode(map[string]interface{}{"found": false, "error": playerKey + " not found"})
 		return
 	}
 
-	// Actually run mpv --version to verify it works
-	cmd := exec.Command(mpvPath, "--version")
+	// Actually run the player with --version to verify it works
+	cmd := exec.Command(playerPath, "--version")
+	noConsole(cmd)
 	output, err := cmd.Output()
 	if err != nil {
-		json.NewEncoder(w).Encode(map[string]interface{}{"found": false, "error": err.Error(), "path": mpvPath})
+		json.NewEncoder(w).Encode(map[string]interface{}{"found": false, "error": err.Error(), "path": playerPath})
 		return
 	}
 
 	// Extract first line of version output
 	version := strings.Split(string(output), "\n")[0]
-	json.NewEncoder(w).Encode(map[string]interface{}{"found": true, "path": mpvPath, "version": version})
+	json.NewEncoder(w).Encode(map[string]interface{}{"found": true, "path": playerPath, "version": version})
 }
 
 func helpMappingsHandler(w http.ResponseWriter, r *http.Request) {
@@ -1504,6 +2178,14 @@ func helpMappingsHandler(w http.ResponseWriter, r *http.Request) {
 
 // Serve userscript stub that loads main JS from server
 func userscriptHandler(w http.ResponseWriter, r *http.Request) {
+	// The stub carries the API secret, so other sites must not include it
+	// as a script, and it is only served on the loopback interface, also to
+	// clients that do not send Sec-Fetch-Site
+	if !isLocalHost(r.Host) || crossSiteRequest(r) {
+		http.Error(w, "the userscript is installed from the install page", http.StatusForbidden)
+		return
+	}
+
 	configMu.RLock()
 	serverURLs := config.ServerURLs
 	port := config.Port
@@ -1542,7 +2224,7 @@ func userscriptHandler(w http.ResponseWriter, r *http.Request) {
     // Load main script from server when head is available
     function loadScript() {
         const script = document.createElement('script');
-        script.src = '%s/jellyfin-external-player.js';
+        script.src = '%s/jellyfin-external-player.js?secret=%s';
         (document.head || document.documentElement).appendChild(script);
     }
 
@@ -1552,9 +2234,10 @@ func userscriptHandler(w http.ResponseWriter, r *http.Request) {
         document.addEventListener('DOMContentLoaded', loadScript);
     }
 })();
-`, includeLines.String(), kioskServerURL)
+`, includeLines.String(), kioskServerURL, apiSecret)
 
 	w.Header().Set("Content-Type", "application/javascript")
+	w.Header().Set("Cache-Control", "no-store")
 	w.Write([]byte(script))
 }
 
@@ -1564,10 +2247,10 @@ var currentScriptVersion string
 var scriptVersionMu sync.RWMutex
 
 func mainScriptHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Content-Type", "application/javascript")
-	// Cache for 5 minutes - shift-reload will bypass cache
-	w.Header().Set("Cache-Control", "public, max-age=300")
+	// Cache for 5 minutes - shift-reload will bypass cache. Private, as the
+	// script embeds the API secret.
+	w.Header().Set("Cache-Control", "private, max-age=300")
 
 	// Try to read from disk (allows editing without restart during development)
 	scriptBytes, err := os.ReadFile("jellyfin-external-player.js")
@@ -1607,12 +2290,21 @@ func mainScriptHandler(w http.ResponseWriter, r *http.Request) {
 	script := strings.Replace(string(scriptBytes), "{{KIOSK_SERVER}}", kioskServerURL, -1)
 	script = strings.Replace(script, "{{DEBUG}}", fmt.Sprintf("%t", debug), -1)
 	script = strings.Replace(script, "{{SCRIPT_VERSION}}", version, -1)
+	// Only the userscript stub knows the secret to load the script with;
+	// included from any other page, its API requests are refused
+	secret := ""
+	if validQuerySecret(r) {
+		secret = apiSecret
+	} else {
+		log.Printf("Main script loaded without the API secret; reinstall the userscript")
+	}
+	script = strings.Replace(script, "{{API_SECRET}}", secret, -1)
+	script = strings.Replace(script, "{{API_SECRET_HEADER}}", apiSecretHeader, -1)
 
 	w.Write([]byte(script))
 }
 
 func scriptVersionHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Cache-Control", "no-cache")
 
@@ -1627,6 +2319,10 @@ func installPageHandler(w http.ResponseWriter, r *http.Request) {
 	// Handle POST to save server URLs
 	if r.Method == "POST" {
 		r.ParseForm()
+		if !validCSRFToken(r) {
+			http.Error(w, "invalid or missing CSRF token; reload the page", http.StatusForbidden)
+			return
+		}
 		urls := r.Form["server_url"]
 		var filtered []string
 		for _, u := range urls {
@@ -1713,6 +2409,7 @@ func installPageHandler(w http.ResponseWriter, r *http.Request) {
         <button type="button" class="reset-btn" onclick="resetToDiscovery()">Reset to Auto-Discovery</button>
         <span id="discoverStatus"></span>
         <form method="POST" id="urlForm">
+            ` + csrfField() + `
             <div class="url-list" id="urlList">
                 ` + urlInputs.String() + `
             </div>
@@ -1738,7 +2435,7 @@ func installPageHandler(w http.ResponseWriter, r *http.Request) {
 
     <p style="margin-top: 40px;"><a href="/config">Configuration</a></p>
 
-    <script>
+    <script>` + apiFetchScript() + `
         function addUrlInput() {
             const input = document.createElement('input');
             input.type = 'text';
@@ -1757,7 +2454,7 @@ func installPageHandler(w http.ResponseWriter, r *http.Request) {
             status.style.color = '#666';
 
             try {
-                const response = await fetch('/api/discover');
+                const response = await apiFetch('/api/discover');
                 const data = await response.json();
                 const servers = data.servers || [];
 
@@ -1814,7 +2511,7 @@ func installPageHandler(w http.ResponseWriter, r *http.Request) {
             const urlList = document.getElementById('urlList');
             urlList.innerHTML = '<input type="text" name="server_url" placeholder="http://myserver:8096/*" class="url-input">';
 
-            await fetch('/api/discover/reset');
+            await apiFetch('/api/discover/reset', { method: 'POST' });
             discoverServers();
         }
 
@@ -1833,6 +2530,7 @@ func installPageHandler(w http.ResponseWriter, r *http.Request) {
     </script>
 </body>
 </html>`
+	w.Header().Set("X-Frame-Options", "DENY")
 	w.Header().Set("Content-Type", "text/html")
 	w.Write([]byte(html))
 }
@@ -2118,7 +2816,10 @@ func discoverHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func restartHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 
 	log.Printf("Restart requested, exiting with code 0...")
@@ -2134,7 +2835,10 @@ func restartHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func shutdownHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 
 	log.Printf("Shutdown requested, exiting with code 1...")
@@ -2148,6 +2852,10 @@ func shutdownHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func resetDiscoveryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 
 	// Clear user-set flag and URLs, then start discovery
@@ -2204,7 +2912,6 @@ func getConfigDir() string {
 	return filepath.Join(home, ".config", "jellyfin-external-player")
 }
 
-
 // syncWriter wraps a file and syncs after each write for immediate log visibility
 type syncWriter struct {
 	f *os.File
@@ -2294,7 +3001,17 @@ func main() {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
-	// Port priority: CLI flag > env var > config file > default (9998)
+	credentials.load(configDir)
+	migrateClientToken()
+	// Resend reports that could not be delivered during the last run
+	reportQueue.start(configDir)
+	if err := loadAPISecret(configDir); err != nil {
+		log.Fatalf("Failed to load the API secret: %v", err)
+	}
+
+	// Port priority: CLI flag > env var > config file > default (9998).
+	// Set before client mode starts, since it reads the port.
+	configMu.Lock()
 	if portFlag > 0 {
 		config.Port = portFlag
 	} else if envPort := os.Getenv("JELLYFIN_EXTERNAL_PORT"); envPort != "" {
@@ -2302,6 +3019,10 @@ func main() {
 			config.Port = p
 		}
 	}
+	configMu.Unlock()
+
+	// Connect to Jellyfin as a client device if configured
+	restartClientMode()
 
 	// Auto-discover servers on startup if not configured by user
 	if !config.ServerURLsSet {
@@ -2310,29 +3031,41 @@ func main() {
 	}
 
 	http.HandleFunc("/", rootHandler)
-	http.HandleFunc("/api/play", playHandler)
-	http.HandleFunc("/api/playlist", playlistHandler)
-	http.HandleFunc("/api/stop", stopHandler)
-	http.HandleFunc("/api/status", statusHandler)
-	http.HandleFunc("/api/config", configAPIHandler)
-	http.HandleFunc("/api/check-player", checkPlayerHandler)
-	http.HandleFunc("/api/script-version", scriptVersionHandler)
-	http.HandleFunc("/api/discover", discoverHandler)
-	http.HandleFunc("/api/discover/reset", resetDiscoveryHandler)
+	http.HandleFunc("/api/play", requireSecret(playHandler))
+	http.HandleFunc("/api/playlist", requireSecret(playlistHandler))
+	http.HandleFunc("/api/stop", requireSecret(stopHandler))
+	http.HandleFunc("/api/status", requireSecret(statusHandler))
+	http.HandleFunc("/api/control", requireSecret(controlHandler))
+	http.HandleFunc("/api/sessions", requireSecret(sessionsHandler))
+	http.HandleFunc("/api/events", requireSecret(eventsHandler))
+	http.HandleFunc("/api/report-queue", requireSecret(reportQueueHandler))
+	http.HandleFunc("/api/credentials", requireSecret(credentialsHandler))
+	http.HandleFunc("/api/item", requireSecret(itemHandler))
+	http.HandleFunc("/api/queue", requireSecret(queueHandler))
+	http.HandleFunc("/api/queue/", requireSecret(queueHandler))
+	http.HandleFunc("/api/config", requireSecret(configAPIHandler))
+	http.HandleFunc("/api/check-player", requireSecret(checkPlayerHandler))
+	http.HandleFunc("/api/mappings/test", requireSecret(mappingsTestHandler))
+	http.HandleFunc("/api/mappings/validate", requireSecret(mappingsValidateHandler))
+	http.HandleFunc("/api/mappings/suggest", requireSecret(mappingsSuggestHandler))
+	http.HandleFunc("/api/libraries", requireSecret(librariesHandler))
+	http.HandleFunc("/api/script-version", requireSecret(scriptVersionHandler))
+	http.HandleFunc("/api/discover", requireSecret(discoverHandler))
+	http.HandleFunc("/api/discover/reset", requireSecret(resetDiscoveryHandler))
 	http.HandleFunc("/config", configPageHandler)
 	http.HandleFunc("/help/mappings", helpMappingsHandler)
 	http.HandleFunc("/install", installPageHandler)
-	http.HandleFunc("/jellyfin-external-player.user.js", userscriptHandler)
+	http.Handle("/jellyfin-external-player.user.js", localOnly(http.HandlerFunc(userscriptHandler)))
 	http.HandleFunc("/jellyfin-external-player.js", mainScriptHandler)
-	http.HandleFunc("/api/restart", restartHandler)
-	http.HandleFunc("/api/shutdown", shutdownHandler)
+	http.HandleFunc("/api/restart", requireSecret(restartHandler))
+	http.HandleFunc("/api/shutdown", requireSecret(shutdownHandler))
 
 	addr := fmt.Sprintf("127.0.0.1:%d", config.Port)
 	log.Printf("Starting server on %s", addr)
 	log.Printf("Config page: http://%s/config", addr)
-	log.Printf("Play endpoint: http://%s/api/play?path=...", addr)
+	log.Printf("Play endpoint: POST http://%s/api/play?path=... with the %s header from %s", addr, apiSecretHeader, filepath.Join(configDir, apiSecretFile))
 
-	if err := http.ListenAndServe(addr, nil); err != nil {
+	if err := http.ListenAndServe(addr, localOnly(http.DefaultServeMux)); err != nil {
 		errMsg := fmt.Sprintf("Failed to start server on %s:\n\n%v\n\nAnother instance may already be running.", addr, err)
 		log.Print(errMsg)
 		showFatalError(errMsg)
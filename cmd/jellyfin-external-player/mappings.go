@@ -0,0 +1,540 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// wildcardToRegex converts a wildcard pattern to a regex for prefix-style matching
+// * matches anything except /
+// ** matches anything including /
+// The pattern matches the beginning of the path, and captures the remainder
+func wildcardToRegex(pattern string) (*regexp.Regexp, error) {
+	var result strings.Builder
+	result.WriteString("^")
+
+	i := 0
+	for i < len(pattern) {
+		if i+1 < len(pattern) && pattern[i] == '*' && pattern[i+1] == '*' {
+			result.WriteString("(.*?)")
+			i += 2
+		} else if pattern[i] == '*' {
+			result.WriteString("([^/]*)")
+			i++
+		} else if strings.ContainsRune("[](){}+?.\\^$|", rune(pattern[i])) {
+			result.WriteString("\\")
+			result.WriteByte(pattern[i])
+			i++
+		} else {
+			result.WriteByte(pattern[i])
+			i++
+		}
+	}
+
+	// Capture the remainder of the path
+	result.WriteString("(.*)")
+	result.WriteString("$")
+	return regexp.Compile(result.String())
+}
+
+// compile validates a mapping and caches its compiled pattern. An invalid
+// mapping keeps its error and never matches.
+func (m *PathMapping) compile() error {
+	m.re, m.err = nil, nil
+	switch m.Type {
+	case "wildcard":
+		re, err := wildcardToRegex(m.Match)
+		if err != nil {
+			m.err = fmt.Errorf("invalid wildcard pattern: %v", err)
+			break
+		}
+		m.re = re
+		// The last group of the regex is the remainder of the path
+		m.err = checkPlaceholders(m.Replace, re.NumSubexp()-1)
+	case "regex":
+		re, err := regexp.Compile(m.Match)
+		if err != nil {
+			m.err = fmt.Errorf("invalid regex: %v", err)
+			break
+		}
+		m.re = re
+		m.err = checkGroupReferences(m.Replace, re)
+	}
+	return m.err
+}
+
+// {N} placeholders of wildcard replacements
+var placeholderPattern = regexp.MustCompile(`\{(\d+)\}`)
+
+// Group references of regex replacements: $name or ${name}
+var groupReferencePattern = regexp.MustCompile(`\$(?:\{([^}]*)\}|([a-zA-Z0-9_]+))`)
+
+// checkPlaceholders checks that the {N} placeholders of a wildcard
+// replacement refer to one of the pattern's groups
+func checkPlaceholders(replace string, groups int) error {
+	for _, m := range placeholderPattern.FindAllStringSubmatch(replace, -1) {
+		n, _ := strconv.Atoi(m[1])
+		if n >= 1 && n <= groups {
+			continue
+		}
+		if groups == 0 {
+			return fmt.Errorf("%s refers to a group, but the pattern has no * or **", m[0])
+		}
+		return fmt.Errorf("%s refers to a group that does not exist; the pattern has %d (* or **)", m[0], groups)
+	}
+	return nil
+}
+
+// checkGroupReferences checks that the $1, ${1} and ${name} references of a
+// regex replacement name groups of re
+func checkGroupReferences(replace string, re *regexp.Regexp) error {
+	if m := placeholderPattern.FindString(groupReferencePattern.ReplaceAllString(replace, "")); m != "" {
+		return fmt.Errorf("regex replacements refer to groups as $%s or ${%s}, not %s", m[1:len(m)-1], m[1:len(m)-1], m)
+	}
+	// "$$" is a literal dollar sign
+	for _, m := range groupReferencePattern.FindAllStringSubmatch(strings.ReplaceAll(replace, "$$", ""), -1) {
+		name := m[1] + m[2]
+		if n, err := strconv.Atoi(name); err == nil {
+			if n <= re.NumSubexp() {
+				continue
+			}
+			return fmt.Errorf("%s refers to group %d, but the regex has %d", m[0], n, re.NumSubexp())
+		}
+		if re.SubexpIndex(name) >= 0 {
+			continue
+		}
+		if m[2] != "" && name[0] >= '0' && name[0] <= '9' {
+			// $1x is the group named "1x", not group 1 followed by x
+			return fmt.Errorf("%s refers to a group named %q; write ${%s} to follow a group number with text", m[0], name, leadingDigits(name))
+		}
+		return fmt.Errorf("%s refers to a group named %q, which the regex does not have", m[0], name)
+	}
+	return nil
+}
+
+// leadingDigits returns the digits s starts with
+func leadingDigits(s string) string {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	return s[:i]
+}
+
+// compileMappings compiles mappings in place and returns the errors of the
+// invalid ones, numbered from 1 as on the config page
+func compileMappings(mappings []PathMapping) []error {
+	var errs []error
+	for i := range mappings {
+		if err := mappings[i].compile(); err != nil {
+			errs = append(errs, fmt.Errorf("mapping %d (%s %q): %v", i+1, mappings[i].Type, mappings[i].Match, err))
+		}
+	}
+	return errs
+}
+
+// matchMapping applies a single mapping to a path. It returns the
+// transformed path, the groups its pattern captured and whether it matched;
+// the error is set if the mapping is invalid.
+func matchMapping(path string, mapping PathMapping) (string, []string, bool, error) {
+	if mapping.re == nil && mapping.err == nil {
+		mapping.compile() // Mappings that did not come from the config
+	}
+	if mapping.err != nil {
+		return path, nil, false, mapping.err
+	}
+
+	switch mapping.Type {
+	case "wildcard":
+		matches := mapping.re.FindStringSubmatch(path)
+		if matches == nil {
+			return path, nil, false, nil
+		}
+		// Last capture group is the remainder of the path
+		remainder := matches[len(matches)-1]
+		// Replace {1}, {2}, etc. with captured groups (excluding remainder)
+		result := mapping.Replace
+		for i := 1; i < len(matches)-1; i++ {
+			result = strings.ReplaceAll(result, fmt.Sprintf("{%d}", i), matches[i])
+		}
+		// Append the remainder with proper path separator
+		if len(remainder) > 0 && !strings.HasSuffix(result, "/") && !strings.HasSuffix(result, `\`) {
+			result += "/"
+		}
+		return result + remainder, matches[1:], true, nil
+
+	case "regex":
+		matches := mapping.re.FindStringSubmatch(path)
+		if matches == nil {
+			return path, nil, false, nil
+		}
+		return mapping.re.ReplaceAllString(path, mapping.Replace), matches[1:], true, nil
+
+	default:
+		// "prefix"; unknown types are treated as prefix for backwards compatibility
+		if strings.HasPrefix(path, mapping.Match) {
+			return mapping.Replace + path[len(mapping.Match):], nil, true, nil
+		}
+		return path, nil, false, nil
+	}
+}
+
+// applyMapping applies a single mapping to a path
+// Returns the transformed path and true if matched, or original path and false if not.
+// Invalid mappings never match; their errors are logged when the config is loaded.
+func applyMapping(path string, mapping PathMapping) (string, bool) {
+	result, _, matched, _ := matchMapping(path, mapping)
+	return result, matched
+}
+
+// mappingScope is the server and library of the item a path belongs to.
+// Mappings limited to a server or library only apply to paths of their
+// scope; paths without an item (e.g. of a play request by path) only get the
+// unscoped mappings.
+type mappingScope struct {
+	ServerURL string
+	Library   string // Collection folder ID, empty if unknown
+}
+
+// inScope reports whether a mapping applies to paths of scope
+func (m PathMapping) inScope(scope mappingScope) bool {
+	if m.Server != "" && normalizeServerURL(m.Server) != normalizeServerURL(scope.ServerURL) {
+		return false
+	}
+	if m.Library != "" && !sameItemId(m.Library, scope.Library) {
+		return false
+	}
+	return true
+}
+
+// sameItemId compares Jellyfin IDs, which the server writes with or
+// without dashes
+func sameItemId(a, b string) bool {
+	return a != "" && strings.EqualFold(strings.ReplaceAll(a, "-", ""), strings.ReplaceAll(b, "-", ""))
+}
+
+// mappingsNeedLibrary reports whether a mapping of serverURL is limited to a
+// library, so the library of its items has to be looked up
+func mappingsNeedLibrary(serverURL string) bool {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	for _, m := range config.PathMappings {
+		if m.Library != "" && m.inScope(mappingScope{ServerURL: serverURL, Library: m.Library}) {
+			return true
+		}
+	}
+	return false
+}
+
+// translatePath applies the path mappings of scope and returns (result, matched)
+// If matched is true, a mapping was applied; if false, no mapping matched
+func translatePath(path string, scope mappingScope) (string, bool) {
+	configMu.RLock()
+	defer configMu.RUnlock()
+
+	for _, mapping := range config.PathMappings {
+		if !mapping.inScope(scope) {
+			continue
+		}
+		if result, matched := applyMapping(path, mapping); matched {
+			if runtime.GOOS == "windows" {
+				return windowsSlashes(result), true
+			}
+			return result, true
+		}
+	}
+
+	// No match - convert slashes only on Windows
+	if runtime.GOOS == "windows" {
+		return strings.ReplaceAll(path, "/", `\`), false
+	}
+	return path, false
+}
+
+// windowsSlashes converts a mapped path to backslashes for Windows UNC
+// paths. URLs like smb:// keep their slashes.
+func windowsSlashes(path string) string {
+	if strings.Contains(path, "://") {
+		return path
+	}
+	return strings.ReplaceAll(path, "/", `\`)
+}
+
+// Routes by which a playlist item reaches the player
+const (
+	routeMapped         = "mapped"          // A path mapping gave a local path or URL
+	routeUnmapped       = "unmapped"        // No mapping matched; the path is played as it is
+	routeStream         = "stream"          // No mapping matched; the server streams the item
+	routeStreamFallback = "stream-fallback" // Mapped files could not be read; the server streams the item
+)
+
+// How long checking a mapped file may take, so a hung network mount cannot
+// hold up a play request
+const pathCheckTimeout = 2 * time.Second
+
+// errNoAnswer is returned by checkLocalPath when the check timed out
+var errNoAnswer = errors.New("no answer")
+
+// checkLocalPath checks that a local file exists and can be opened. It
+// reports whether the file exists and the error if it cannot be read. After
+// pathCheckTimeout it gives up; the check itself may go on in the background.
+func checkLocalPath(path string) (bool, error) {
+	type result struct {
+		exists bool
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		if _, err := os.Stat(path); err != nil {
+			done <- result{false, err}
+			return
+		}
+		f, err := os.Open(path)
+		if err == nil {
+			f.Close()
+		}
+		done <- result{true, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.exists, r.err
+	case <-time.After(pathCheckTimeout):
+		return false, fmt.Errorf("%s: %w within %v", path, errNoAnswer, pathCheckTimeout)
+	}
+}
+
+// pathChecker checks the mapped files of one play request. A mapping whose
+// share did not answer is not tried again, so a hung mount costs one timeout
+// rather than one per playlist entry.
+type pathChecker struct {
+	mu   sync.Mutex
+	dead map[int]error // Mappings that timed out, by index
+}
+
+func newPathChecker() *pathChecker {
+	return &pathChecker{dead: map[int]error{}}
+}
+
+// availablePath returns the output of the first mapping of path that can be
+// read on this machine, trying the matching mappings of scope in order. URLs
+// are taken as they are.
+func (c *pathChecker) availablePath(path string, scope mappingScope) (string, error) {
+	configMu.RLock()
+	mappings := config.PathMappings
+	configMu.RUnlock()
+
+	var lastErr error
+	for i, mapping := range mappings {
+		if !mapping.inScope(scope) {
+			continue
+		}
+		result, matched := applyMapping(path, mapping)
+		if !matched {
+			continue
+		}
+		if runtime.GOOS == "windows" {
+			result = windowsSlashes(result)
+		}
+		if strings.Contains(result, "://") {
+			return result, nil
+		}
+
+		c.mu.Lock()
+		err, dead := c.dead[i]
+		c.mu.Unlock()
+		if dead {
+			debugLog("Path check: mapping %d did not answer before, skipping it", i+1)
+			lastErr = err
+			continue
+		}
+		if _, err := checkLocalPath(result); err != nil {
+			log.Printf("Path check: mapping %d: %v", i+1, err)
+			if errors.Is(err, errNoAnswer) {
+				c.mu.Lock()
+				c.dead[i] = err
+				c.mu.Unlock()
+			}
+			lastErr = err
+			continue
+		}
+		return result, nil
+	}
+	if lastErr == nil {
+		return "", fmt.Errorf("no path mapping matches %s", path)
+	}
+	return "", fmt.Errorf("no mapped file of %s can be read", path)
+}
+
+// mappingTraceStep is how one path mapping handled the sample path
+type mappingTraceStep struct {
+	Index   int      `json:"index"`
+	Type    string   `json:"type"`
+	Match   string   `json:"match"`
+	Replace string   `json:"replace"`
+	Server  string   `json:"server,omitempty"`
+	Library string   `json:"library,omitempty"`
+	InScope bool     `json:"inScope"` // Applies to the server and library of the test
+	Matched bool     `json:"matched"`
+	Applied bool     `json:"applied"` // The first match in scope, which translatePath uses
+	Groups  []string `json:"groups,omitempty"`
+	Output  string   `json:"output,omitempty"`
+	Error   string   `json:"error,omitempty"` // Invalid pattern
+}
+
+// mappingTrace is the dry run of a sample path through the path mappings
+type mappingTrace struct {
+	Path          string             `json:"path"`
+	ServerURL     string             `json:"serverUrl,omitempty"`
+	Library       string             `json:"library,omitempty"`
+	Steps         []mappingTraceStep `json:"steps"`
+	Mapped        bool               `json:"mapped"`        // A mapping matched; otherwise the stream is played
+	Output        string             `json:"output"`        // Output of the applied mapping
+	WindowsOutput string             `json:"windowsOutput"` // The output after the Windows slash conversion
+	Result        string             `json:"result"`        // What the player gets on this machine
+	Checked       bool               `json:"checked"`       // Result is a local path and was looked up
+	Exists        bool               `json:"exists"`
+	Readable      bool               `json:"readable"`
+	CheckError    string             `json:"checkError,omitempty"`
+}
+
+// traceMappings runs a server path of scope through mappings the way
+// translatePath does, recording every mapping in order, and checks the result
+// on this machine. Mappings out of scope are matched but never applied.
+func traceMappings(path string, scope mappingScope, mappings []PathMapping) mappingTrace {
+	trace := mappingTrace{Path: path, ServerURL: scope.ServerURL, Library: scope.Library, Steps: []mappingTraceStep{}}
+	for i, m := range mappings {
+		step := mappingTraceStep{
+			Index:   i,
+			Type:    m.Type,
+			Match:   m.Match,
+			Replace: m.Replace,
+			Server:  m.Server,
+			Library: m.Library,
+			InScope: m.inScope(scope),
+		}
+		output, groups, matched, err := matchMapping(path, m)
+		if err != nil {
+			step.Error = err.Error()
+		}
+		if matched {
+			step.Matched = true
+			step.Groups = groups
+			step.Output = output
+			if step.InScope && !trace.Mapped {
+				step.Applied = true
+				trace.Mapped = true
+				trace.Output = output
+			}
+		}
+		trace.Steps = append(trace.Steps, step)
+	}
+
+	if !trace.Mapped {
+		return trace
+	}
+	trace.WindowsOutput = windowsSlashes(trace.Output)
+	trace.Result = trace.Output
+	if runtime.GOOS == "windows" {
+		trace.Result = trace.WindowsOutput
+	}
+
+	if strings.Contains(trace.Result, "://") {
+		return trace // A URL the player opens itself
+	}
+	trace.Checked = true
+	exists, err := checkLocalPath(trace.Result)
+	trace.Exists = exists
+	if err != nil {
+		trace.CheckError = err.Error()
+		return trace
+	}
+	trace.Readable = true
+	return trace
+}
+
+// mappingsTestHandler shows how a server path would be translated
+// (/api/mappings/test?path=...). The optional serverUrl and library
+// parameters give the scope of the path. A POST may carry the mappings to
+// try instead of the saved ones, so the config page can test unsaved
+// changes.
+func mappingsTestHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Path      string         `json:"path"`
+		ServerURL string         `json:"serverUrl"`
+		Library   string         `json:"library"`
+		Mappings  *[]PathMapping `json:"mappings"`
+	}
+	switch r.Method {
+	case "GET":
+		req.Path = r.URL.Query().Get("path")
+		req.ServerURL = r.URL.Query().Get("serverUrl")
+		req.Library = r.URL.Query().Get("library")
+	case "POST":
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "GET or POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	if req.Path == "" {
+		http.Error(w, "missing 'path'", http.StatusBadRequest)
+		return
+	}
+
+	var mappings []PathMapping
+	if req.Mappings != nil {
+		mappings = *req.Mappings
+	} else {
+		configMu.RLock()
+		mappings = append(mappings, config.PathMappings...)
+		configMu.RUnlock()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(traceMappings(req.Path, mappingScope{ServerURL: req.ServerURL, Library: req.Library}, mappings))
+}
+
+// mappingsValidateHandler checks mappings before the config page saves them
+// (POST /api/mappings/validate). The errors are in the order of the
+// mappings, empty for valid ones.
+func mappingsValidateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Mappings []PathMapping `json:"mappings"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	errs := make([]string, len(req.Mappings))
+	valid := true
+	for i := range req.Mappings {
+		if err := req.Mappings[i].compile(); err != nil {
+			errs[i] = err.Error()
+			valid = false
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"valid":  valid,
+		"errors": errs,
+	})
+}
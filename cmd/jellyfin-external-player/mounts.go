@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// mountEntry is a file system mounted on this machine
+type mountEntry struct {
+	Source string `json:"source"` // "nas:/export", "//nas/share", `\\nas\share`
+	Target string `json:"target"` // Where it is mounted
+	Type   string `json:"type"`
+}
+
+// File system types of network shares, which server paths may map to
+var networkFSTypes = map[string]bool{
+	"nfs":           true,
+	"nfs4":          true,
+	"cifs":          true,
+	"smb":           true,
+	"smb3":          true,
+	"smbfs":         true,
+	"afpfs":         true,
+	"9p":            true,
+	"davfs":         true,
+	"webdav":        true,
+	"fuse.sshfs":    true,
+	"fuse.rclone":   true,
+	"fuse.smbnetfs": true,
+}
+
+// Most server folders recentPaths keeps
+const recentPathsSize = 20
+
+// recentPath is a server path of a played item, with the scope its mappings
+// were picked in
+type recentPath struct {
+	Path  string
+	Scope mappingScope
+}
+
+// recentPathList keeps the paths of recently played items, one per server
+// folder, as samples for mapping suggestions
+type recentPathList struct {
+	mu      sync.Mutex
+	entries []recentPath // Most recent first
+}
+
+var recentPaths = &recentPathList{}
+
+// serverDir returns the folder of a server path, which may use / or \
+func serverDir(path string) string {
+	return path[:strings.LastIndexAny(path, `/\`)+1]
+}
+
+// add records the path of a played item, replacing an older one of the
+// same folder
+func (l *recentPathList) add(path string, scope mappingScope) {
+	if path == "" || strings.Contains(path, "://") {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries := []recentPath{{Path: path, Scope: scope}}
+	for _, e := range l.entries {
+		if serverDir(e.Path) != serverDir(path) && len(entries) < recentPathsSize {
+			entries = append(entries, e)
+		}
+	}
+	l.entries = entries
+}
+
+// list returns the recorded paths, most recent first
+func (l *recentPathList) list() []recentPath {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]recentPath(nil), l.entries...)
+}
+
+// mappingSuggestion is a prefix mapping proposed from a mount
+type mappingSuggestion struct {
+	Mapping     PathMapping `json:"mapping"`
+	Mount       mountEntry  `json:"mount"`
+	Verified    bool        `json:"verified"`              // The sample file was found through the mapping
+	Sample      string      `json:"sample"`                // Server path the mapping was found for
+	LocalSample string      `json:"localSample,omitempty"` // Where the mapping puts the sample
+	Paths       int         `json:"paths"`                 // Recent paths the mapping covers
+}
+
+// pathComponents splits a server path at / and \ and returns its components
+// and the index in path where each one starts
+func pathComponents(path string) ([]string, []int) {
+	var comps []string
+	var starts []int
+	start := -1
+	for i := 0; i <= len(path); i++ {
+		if i == len(path) || path[i] == '/' || path[i] == '\\' {
+			if start >= 0 {
+				comps = append(comps, path[start:i])
+				starts = append(starts, start)
+				start = -1
+			}
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+	}
+	return comps, starts
+}
+
+// mountTarget returns the replacement that puts paths under a mount point
+func mountTarget(m mountEntry) string {
+	target := strings.TrimRight(m.Target, `/\`)
+	if target == "" {
+		return "/"
+	}
+	return target
+}
+
+// sourceHint returns how many leading components of a server path the
+// source of a mount stands for: an NFS export that is a prefix of the path,
+// or an SMB share named like one of its folders. It returns 0 if the source
+// gives no hint.
+func sourceHint(m mountEntry, comps []string) int {
+	source := strings.ReplaceAll(m.Source, `\`, "/")
+	if strings.HasPrefix(source, "//") {
+		share := source[strings.LastIndex(strings.TrimRight(source, "/"), "/")+1:]
+		share = strings.TrimRight(share, "/")
+		for i := 0; i < len(comps)-1; i++ {
+			if strings.EqualFold(comps[i], share) {
+				return i + 1
+			}
+		}
+		return 0
+	}
+	if i := strings.Index(source, ":/"); i >= 0 {
+		export, _ := pathComponents(source[i+1:])
+		if len(export) == 0 || len(export) >= len(comps) {
+			return 0
+		}
+		for j, c := range export {
+			if comps[j] != c {
+				return 0
+			}
+		}
+		return len(export)
+	}
+	return 0
+}
+
+// suggestForPath looks for the mapping of a server path into a mount: the
+// shortest server prefix whose remainder exists under the mount point,
+// trying the prefix the mount source hints at first. Without a sample file
+// the hint is still suggested, unverified.
+func suggestForPath(path string, m mountEntry) (mappingSuggestion, bool) {
+	comps, starts := pathComponents(path)
+	if len(comps) < 2 {
+		return mappingSuggestion{}, false
+	}
+	hint := sourceHint(m, comps)
+	suggestion := func(k int) mappingSuggestion {
+		return mappingSuggestion{
+			Mapping: PathMapping{
+				Type:    "prefix",
+				Match:   strings.TrimRight(path[:starts[k]], `/\`),
+				Replace: mountTarget(m),
+			},
+			Mount:  m,
+			Sample: path,
+		}
+	}
+
+	order := []int{}
+	if hint > 0 {
+		order = append(order, hint)
+	}
+	for k := 1; k < len(comps); k++ {
+		if k != hint {
+			order = append(order, k)
+		}
+	}
+	for _, k := range order {
+		local := filepath.Join(append([]string{m.Target}, comps[k:]...)...)
+		if _, err := checkLocalPath(local); err != nil {
+			continue
+		}
+		s := suggestion(k)
+		s.Verified = true
+		s.LocalSample = local
+		return s, true
+	}
+	if hint > 0 {
+		return suggestion(hint), true
+	}
+	return mappingSuggestion{}, false
+}
+
+// suggestMappings proposes prefix mappings from the network mounts for the
+// sample paths that no mapping turns into a readable file
+func suggestMappings(mounts []mountEntry, samples []recentPath) []mappingSuggestion {
+	configMu.RLock()
+	existing := append([]PathMapping(nil), config.PathMappings...)
+	configMu.RUnlock()
+	servers := len(credentials.list())
+
+	// Mount points that do not answer are left out, so a hung share costs
+	// one check instead of one per candidate
+	var usable []mountEntry
+	for _, m := range mounts {
+		if _, err := checkLocalPath(m.Target); err != nil {
+			log.Printf("Mapping suggestions: skipping mount %s: %v", m.Target, err)
+			continue
+		}
+		usable = append(usable, m)
+	}
+
+	suggestions := []mappingSuggestion{}
+	for _, sample := range samples {
+		if translated, matched := translatePath(sample.Path, sample.Scope); matched && !strings.Contains(translated, "://") {
+			if _, err := checkLocalPath(translated); err == nil {
+				continue // Already mapped to a readable file
+			}
+		}
+
+	mounts:
+		for _, m := range usable {
+			s, ok := suggestForPath(sample.Path, m)
+			if !ok {
+				continue
+			}
+			if servers > 1 {
+				s.Mapping.Server = sample.Scope.ServerURL
+			}
+			for _, e := range existing {
+				if e.Type == "prefix" && e.Match == s.Mapping.Match && e.Replace == s.Mapping.Replace &&
+					normalizeServerURL(e.Server) == s.Mapping.Server {
+					continue mounts
+				}
+			}
+			for i := range suggestions {
+				if suggestions[i].Mapping == s.Mapping {
+					suggestions[i].Paths++
+					suggestions[i].Verified = suggestions[i].Verified || s.Verified
+					continue mounts
+				}
+			}
+			s.Paths = 1
+			suggestions = append(suggestions, s)
+		}
+	}
+	return suggestions
+}
+
+// mappingsSuggestHandler proposes path mappings from the network shares
+// mounted here and the paths of recently played items
+// (/api/mappings/suggest). The optional "path" parameter adds a sample
+// server path.
+func mappingsSuggestHandler(w http.ResponseWriter, r *http.Request) {
+	all, err := listMounts()
+	if err != nil {
+		http.Error(w, "failed to list mounts: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	mounts := []mountEntry{}
+	for _, m := range all {
+		if networkFSTypes[m.Type] {
+			mounts = append(mounts, m)
+		}
+	}
+
+	samples := recentPaths.list()
+	if path := r.URL.Query().Get("path"); path != "" {
+		samples = append([]recentPath{{Path: path, Scope: mappingScope{ServerURL: r.URL.Query().Get("serverUrl")}}}, samples...)
+	}
+	suggestions := suggestMappings(mounts, samples)
+	debugLog("Mapping suggestions: %d from %d mount(s) and %d sample path(s)", len(suggestions), len(mounts), len(samples))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"mounts":      mounts,
+		"samples":     len(samples),
+		"suggestions": suggestions,
+	})
+}
@@ -0,0 +1,86 @@
+//go:build !windows
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// listMounts returns the mounted file systems: /proc/mounts on Linux, the
+// output of mount(8) on macOS and the BSDs
+func listMounts() ([]mountEntry, error) {
+	if runtime.GOOS == "linux" {
+		data, err := os.ReadFile("/proc/mounts")
+		if err != nil {
+			return nil, err
+		}
+		return parseProcMounts(data), nil
+	}
+	out, err := exec.Command("mount").Output()
+	if err != nil {
+		return nil, err
+	}
+	return parseMountOutput(out), nil
+}
+
+// parseProcMounts parses /proc/mounts: "source target type options 0 0",
+// with spaces and other special characters escaped as \040
+func parseProcMounts(data []byte) []mountEntry {
+	var mounts []mountEntry
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		mounts = append(mounts, mountEntry{
+			Source: unescapeMountField(fields[0]),
+			Target: unescapeMountField(fields[1]),
+			Type:   fields[2],
+		})
+	}
+	return mounts
+}
+
+// unescapeMountField decodes the octal escapes of a /proc/mounts field
+func unescapeMountField(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// Lines of mount(8) on macOS and the BSDs: "source on target (type, options)"
+var mountLinePattern = regexp.MustCompile(`^(.+) on (.+) \(([^,)]+)`)
+
+// parseMountOutput parses the output of mount(8)
+func parseMountOutput(out []byte) []mountEntry {
+	var mounts []mountEntry
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		m := mountLinePattern.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+		mounts = append(mounts, mountEntry{Source: m[1], Target: m[2], Type: strings.TrimSpace(m[3])})
+	}
+	return mounts
+}
@@ -0,0 +1,52 @@
+//go:build windows
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os/exec"
+	"strings"
+)
+
+// listMounts returns the network shares Windows is connected to, from
+// "net use". Shares mapped to a drive letter are mounted at the drive;
+// others are reached by their UNC path.
+func listMounts() ([]mountEntry, error) {
+	cmd := exec.Command("net", "use")
+	hideWindow(cmd)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	return parseNetUse(out), nil
+}
+
+// parseNetUse parses the table of "net use":
+//
+//	Status       Local     Remote                    Network
+//	OK           Z:        \\nas\media               Microsoft Windows Network
+func parseNetUse(out []byte) []mountEntry {
+	var mounts []mountEntry
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		var local, remote string
+		for _, f := range strings.Fields(scanner.Text()) {
+			switch {
+			case strings.HasPrefix(f, `\\`) && remote == "":
+				remote = f
+			case len(f) == 2 && f[1] == ':' && remote == "":
+				local = f + `\`
+			}
+		}
+		if remote == "" {
+			continue
+		}
+		target := local
+		if target == "" {
+			target = remote
+		}
+		mounts = append(mounts, mountEntry{Source: remote, Target: target, Type: "smb"})
+	}
+	return mounts
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// How long to keep retrying the IPC connection while mpv starts up
+	mpvConnectTimeout = 10 * time.Second
+	// How long to wait for mpv to answer a single command
+	mpvCommandTimeout = 2 * time.Second
+)
+
+// Properties the client observes to keep its PlayerStatus up to date and to
+// report changes
+var mpvObservedProperties = []string{
+	"time-pos",
+	"pause",
+	"playlist-pos",
+	"duration",
+	"eof-reached",
+	"volume",
+	"mute",
+	"sid",
+}
+
+var errMpvClosed = errors.New("mpv IPC connection closed")
+
+// mpvEvent is an asynchronous message from mpv, e.g. a property change
+type mpvEvent struct {
+	Event string      // mpv event name ("property-change", "seek", "end-file", ...)
+	Name  string      // Property name for "property-change" events
+	Data  interface{} // Property value for "property-change" events (nil if unavailable)
+	Args  []string    // Arguments of "client-message" events (script-message)
+}
+
+type mpvResponse struct {
+	Error string
+	Data  interface{}
+}
+
+// mpvClient is a long-lived connection to mpv's JSON IPC server. Replies are
+// matched to commands by request_id, and observed properties are kept in an
+// in-memory PlayerStatus so callers never have to touch the socket to poll.
+type mpvClient struct {
+	pipePath string
+
+	ready     chan struct{} // closed once connected
+	closed    chan struct{} // closed when the connection ends
+	closeOnce sync.Once
+
+	writeMu sync.Mutex
+
+	mu          sync.Mutex
+	conn        net.Conn
+	nextID      int
+	pending     map[int]chan mpvResponse
+	status      PlayerStatus
+	subscribers map[chan mpvEvent]struct{}
+}
+
+// newMpvClient returns a client for the IPC server at pipePath and starts
+// connecting in the background. mpv creates the socket shortly after launch,
+// so the connection is retried for up to mpvConnectTimeout.
+func newMpvClient(pipePath string) *mpvClient {
+	c := &mpvClient{
+		pipePath:    pipePath,
+		ready:       make(chan struct{}),
+		closed:      make(chan struct{}),
+		pending:     make(map[int]chan mpvResponse),
+		subscribers: make(map[chan mpvEvent]struct{}),
+	}
+	go c.run()
+	return c
+}
+
+func (c *mpvClient) run() {
+	deadline := time.Now().Add(mpvConnectTimeout)
+	var conn net.Conn
+	for {
+		var err error
+		conn, err = connectMpvIPC(c.pipePath)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			log.Printf("mpv IPC: could not connect to %s: %v", c.pipePath, err)
+			c.Close()
+			return
+		}
+		select {
+		case <-c.closed:
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	c.mu.Lock()
+	select {
+	case <-c.closed:
+		// Closed while connecting
+		c.mu.Unlock()
+		conn.Close()
+		return
+	default:
+	}
+	c.conn = conn
+	c.status.Playing = true
+	c.mu.Unlock()
+	close(c.ready)
+	debugLog("mpv IPC: connected to %s", c.pipePath)
+
+	go c.readLoop(conn)
+
+	for i, property := range mpvObservedProperties {
+		if _, err := c.command("observe_property", i+1, property); err != nil {
+			log.Printf("mpv IPC: failed to observe %s: %v", property, err)
+		}
+	}
+}
+
+// readLoop dispatches replies and events until the connection closes
+func (c *mpvClient) readLoop(conn net.Conn) {
+	defer c.Close()
+
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			debugLog("mpv IPC: connection closed: %v", err)
+			return
+		}
+
+		var msg struct {
+			RequestID *int        `json:"request_id"`
+			Error     string      `json:"error"`
+			Data      interface{} `json:"data"`
+			Event     string      `json:"event"`
+			Name      string      `json:"name"`
+			Args      []string    `json:"args"`
+		}
+		if err := json.Unmarshal(line, &msg); err != nil {
+			debugLog("mpv IPC: ignoring malformed message %q: %v", string(line), err)
+			continue
+		}
+
+		if msg.Event != "" {
+			c.handleEvent(mpvEvent{Event: msg.Event, Name: msg.Name, Data: msg.Data, Args: msg.Args})
+			continue
+		}
+
+		if msg.RequestID != nil {
+			c.mu.Lock()
+			ch, ok := c.pending[*msg.RequestID]
+			delete(c.pending, *msg.RequestID)
+			c.mu.Unlock()
+			if ok {
+				ch <- mpvResponse{Error: msg.Error, Data: msg.Data}
+			}
+		}
+	}
+}
+
+// handleEvent updates the cached status and forwards the event to subscribers
+func (c *mpvClient) handleEvent(ev mpvEvent) {
+	c.mu.Lock()
+	if ev.Event == "property-change" {
+		switch ev.Name {
+		case "time-pos":
+			// Unavailable (nil) between files and at shutdown; keep the last value
+			if v, ok := ev.Data.(float64); ok {
+				c.status.Position = v
+			}
+		case "duration":
+			if v, ok := ev.Data.(float64); ok {
+				c.status.Duration = v
+			}
+		case "pause":
+			if v, ok := ev.Data.(bool); ok {
+				c.status.Paused = v
+			}
+		case "playlist-pos":
+			if v, ok := ev.Data.(float64); ok {
+				c.status.PlaylistPos = int(v)
+			}
+		case "eof-reached":
+			v, _ := ev.Data.(bool)
+			c.status.EOFReached = v
+		case "volume":
+			if v, ok := ev.Data.(float64); ok {
+				c.status.Volume = v
+			}
+		case "mute":
+			if v, ok := ev.Data.(bool); ok {
+				c.status.Muted = v
+			}
+		}
+	}
+	for ch := range c.subscribers {
+		select {
+		case ch <- ev:
+		default:
+			debugLog("mpv IPC: subscriber full, dropping %s event", ev.Event)
+		}
+	}
+	c.mu.Unlock()
+}
+
+// subscribe returns a channel receiving every mpv event, and a function to
+// stop receiving them. The channel is closed when the connection ends.
+func (c *mpvClient) subscribe() (<-chan mpvEvent, func()) {
+	ch := make(chan mpvEvent, 32)
+
+	c.mu.Lock()
+	select {
+	case <-c.closed:
+		close(ch)
+	default:
+		c.subscribers[ch] = struct{}{}
+	}
+	c.mu.Unlock()
+
+	return ch, func() {
+		c.mu.Lock()
+		if _, ok := c.subscribers[ch]; ok {
+			delete(c.subscribers, ch)
+			close(ch)
+		}
+		c.mu.Unlock()
+	}
+}
+
+// Status returns the last known player state. Playing is false once the
+// connection has closed, but the final position and duration are kept.
+func (c *mpvClient) Status() PlayerStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.status
+}
+
+// Connected reports whether the client has ever connected to mpv
+func (c *mpvClient) Connected() bool {
+	select {
+	case <-c.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// waitReady blocks until the client is connected
+func (c *mpvClient) waitReady() error {
+	select {
+	case <-c.closed:
+		return errMpvClosed
+	default:
+	}
+
+	select {
+	case <-c.ready:
+		return nil
+	case <-c.closed:
+		return errMpvClosed
+	case <-time.After(mpvConnectTimeout):
+		return fmt.Errorf("mpv IPC: not connected to %s", c.pipePath)
+	}
+}
+
+// write sends one JSON message to mpv
+func (c *mpvClient) write(msg map[string]interface{}) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(mpvCommandTimeout))
+	_, err = conn.Write(data)
+	return err
+}
+
+// command sends a command to mpv and waits for its reply
+func (c *mpvClient) command(args ...interface{}) (interface{}, error) {
+	return c.request(args, args[0])
+}
+
+// commandNamed sends a command with named arguments, for commands whose
+// positional arguments changed between mpv versions
+func (c *mpvClient) commandNamed(name string, args map[string]interface{}) (interface{}, error) {
+	cmd := map[string]interface{}{"name": name}
+	for k, v := range args {
+		cmd[k] = v
+	}
+	return c.request(cmd, name)
+}
+
+// request sends a command (an argument list or a named-argument map) and
+// waits for its reply
+func (c *mpvClient) request(cmd interface{}, name interface{}) (interface{}, error) {
+	if err := c.waitReady(); err != nil {
+		return nil, err
+	}
+
+	ch := make(chan mpvResponse, 1)
+	c.mu.Lock()
+	c.nextID++
+	id := c.nextID
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	cleanup := func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}
+
+	if err := c.write(map[string]interface{}{"command": cmd, "request_id": id}); err != nil {
+		cleanup()
+		return nil, err
+	}
+
+	select {
+	case resp := <-ch:
+		if resp.Error != "" && resp.Error != "success" {
+			return nil, fmt.Errorf("mpv: %s", resp.Error)
+		}
+		return resp.Data, nil
+	case <-c.closed:
+		cleanup()
+		return nil, errMpvClosed
+	case <-time.After(mpvCommandTimeout):
+		cleanup()
+		return nil, fmt.Errorf("mpv IPC: timed out waiting for reply to %v", name)
+	}
+}
+
+// send sends a command without waiting for a reply (for commands like
+// "quit" where mpv may close the connection before answering)
+func (c *mpvClient) send(args ...interface{}) error {
+	if err := c.waitReady(); err != nil {
+		return err
+	}
+	return c.write(map[string]interface{}{"command": args})
+}
+
+// GetProperty queries a property from mpv
+func (c *mpvClient) GetProperty(property string) (interface{}, error) {
+	return c.command("get_property", property)
+}
+
+// SetProperty sets a property on mpv
+func (c *mpvClient) SetProperty(property string, value interface{}) error {
+	_, err := c.command("set_property", property, value)
+	return err
+}
+
+// Close shuts the connection down and fails any outstanding commands
+func (c *mpvClient) Close() {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		close(c.closed)
+		c.status.Playing = false
+		if c.conn != nil {
+			c.conn.Close()
+		}
+		for id := range c.pending {
+			delete(c.pending, id)
+		}
+		for ch := range c.subscribers {
+			delete(c.subscribers, ch)
+			close(ch)
+		}
+		c.mu.Unlock()
+	})
+}
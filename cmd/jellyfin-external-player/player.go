@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Player is a playback backend. It builds the command line for its
+// executable and controls and observes the process once it is running.
+type Player interface {
+	// LaunchArgs returns the arguments that enable the control interface
+	LaunchArgs() []string
+	// PlaylistArgs returns the arguments that play req.Paths in order with
+	// their track selection and the preferred languages, the first one
+	// starting at req.StartSeconds
+	PlaylistArgs(req launchRequest) []string
+
+	// Attach connects to the control interface of the launched process
+	Attach(cmd *exec.Cmd)
+	// Status returns the last known playback state
+	Status() (PlayerStatus, error)
+	// SetPause pauses or resumes playback
+	SetPause(paused bool) error
+	// Quit asks the player to exit
+	Quit() error
+	// PlaylistIndex returns the 0-based index of the current playlist entry
+	PlaylistIndex() (int, error)
+	// Subscribe returns a channel of player events and a function to stop
+	// receiving them. The channel is closed when the player is closed.
+	Subscribe() (<-chan playerEvent, func())
+	// Close releases the control interface after the process has exited
+	Close()
+}
+
+// transportController is implemented by players that can be remote
+// controlled beyond pausing and quitting
+type transportController interface {
+	// Seek jumps to position seconds
+	Seek(position float64) error
+	// PlaylistNext and PlaylistPrev move to the next or previous entry
+	PlaylistNext() error
+	PlaylistPrev() error
+	// SetVolume sets the volume in percent
+	SetVolume(percent float64) error
+	SetMute(muted bool) error
+	// ShowMessage shows text on screen for d
+	ShowMessage(text string, d time.Duration) error
+}
+
+// mediaController is implemented by players that can step through chapters,
+// switch tracks, toggle fullscreen and take screenshots. Tracks are numbered
+// from 1 among the tracks of their kind; 0 turns the kind off.
+type mediaController interface {
+	// ChapterStep moves step chapters forward, or back if step is negative
+	ChapterStep(step int) error
+	SetAudioTrack(track int) error
+	SetSubtitleTrack(track int) error
+	ToggleFullscreen() error
+	// Screenshot saves a screenshot where the player's settings put them
+	Screenshot() error
+}
+
+// queueController is implemented by players whose playlist can be changed
+// while they play. Indexes are 0-based.
+type queueController interface {
+	// QueueAdd adds path with its track selection at index, or at the end
+	// if index is negative
+	QueueAdd(path string, tracks trackSelection, index int) error
+	QueueRemove(index int) error
+	// QueueMove moves the entry at from so it ends up at index to
+	QueueMove(from, to int) error
+	// QueueJump starts playing the entry at index
+	QueueJump(index int) error
+}
+
+// trackApplier is implemented by players that can be given the track
+// selection of a playlist entry after its file has loaded, for entries whose
+// tracks were looked up after launch
+type trackApplier interface {
+	ApplyTracks(tracks trackSelection) error
+}
+
+// streamTokenSetter is implemented by players that can send the Jellyfin
+// access token in a request header, so stream URLs on their command line
+// need not carry it
+type streamTokenSetter interface {
+	SetStreamToken(token string) error
+}
+
+// argTemplate is implemented by players whose configured args are a
+// template with per-launch placeholders
+type argTemplate interface {
+	ExpandArgs(args []string, req launchRequest) []string
+}
+
+// launchRequest describes one player launch
+type launchRequest struct {
+	Paths            []string         // Translated paths or stream URLs, in playlist order
+	Tracks           []trackSelection // Track selection per path (may be shorter than Paths)
+	AudioLanguage    string           // Preferred audio languages (e.g. "eng,ger") when no track is selected
+	SubtitleLanguage string           // Preferred subtitle languages when no track is selected
+	StartSeconds     float64          // Resume offset for the first item
+	ItemId           string           // Jellyfin item ID of the first item
+	Title            string           // Title of the first item
+	Subtitle         string           // External subtitle path or URL of the first item
+	AudioIndex       *int             // Jellyfin audio stream index of the first item
+	Display          string           // Display profile whose args are added
+	ServerURL        string           // Jellyfin server the stream URLs are on
+	Token            string           // Access token the stream URLs carry
+}
+
+// trackSelection is the audio and subtitle choice for one file, numbered
+// the way players number tracks rather than by Jellyfin stream index
+type trackSelection struct {
+	Audio             int      // 1-based among the file's audio tracks, 0 = player default
+	Subtitle          int      // 1-based among the file's subtitles, 0 = player default, -1 = off
+	SubtitleFiles     []string // External subtitle files to load, numbered after the embedded ones
+	EmbeddedSubtitles int      // Number of subtitles inside the media file
+}
+
+// selectedFile returns the external subtitle file that Subtitle refers to,
+// or "" if an embedded subtitle (or none) is selected
+func (t trackSelection) selectedFile() string {
+	i := t.Subtitle - t.EmbeddedSubtitles - 1
+	if t.Subtitle <= 0 || i < 0 || i >= len(t.SubtitleFiles) {
+		return ""
+	}
+	return t.SubtitleFiles[i]
+}
+
+// tracksFor returns the track selection of path i
+func (req launchRequest) tracksFor(i int) trackSelection {
+	if i < len(req.Tracks) {
+		return req.Tracks[i]
+	}
+	return trackSelection{}
+}
+
+// Player event types
+const (
+	playerEventPause       = "pause"
+	playerEventUnpause     = "unpause"
+	playerEventSeek        = "seek"         // A seek has completed
+	playerEventPlaylistPos = "playlist-pos" // Value is the new playlist index
+	playerEventDuration    = "duration"     // Value is the new duration in seconds
+	playerEventSkip        = "skip"         // The skip key of an on-screen prompt was pressed
+	playerEventSubtitle    = "subtitle"     // Value is the new subtitle track (0 = off)
+	playerEventFileLoaded  = "file-loaded"  // Value is the playlist index of the file whose tracks are known
+)
+
+// playerEvent is a state change reported by a Player
+type playerEvent struct {
+	Type  string
+	Value float64
+}
+
+// playerEventHub fans player events out to subscribers
+type playerEventHub struct {
+	mu     sync.Mutex
+	subs   map[chan playerEvent]struct{}
+	closed bool
+}
+
+func (h *playerEventHub) subscribe() (<-chan playerEvent, func()) {
+	ch := make(chan playerEvent, 32)
+
+	h.mu.Lock()
+	if h.closed {
+		close(ch)
+	} else {
+		if h.subs == nil {
+			h.subs = make(map[chan playerEvent]struct{})
+		}
+		h.subs[ch] = struct{}{}
+	}
+	h.mu.Unlock()
+
+	return ch, func() {
+		h.mu.Lock()
+		if _, ok := h.subs[ch]; ok {
+			delete(h.subs, ch)
+			close(ch)
+		}
+		h.mu.Unlock()
+	}
+}
+
+func (h *playerEventHub) publish(ev playerEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- ev:
+		default:
+			debugLog("Player events: subscriber full, dropping %s event", ev.Type)
+		}
+	}
+}
+
+func (h *playerEventHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+	h.closed = true
+	for ch := range h.subs {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// Supported player types
+const (
+	playerTypeMpv    = "mpv"
+	playerTypeVlc    = "vlc"
+	playerTypeCustom = "custom"
+)
+
+// playerType returns the backend type of a configured player. Older configs
+// have no type and are keyed by the player name.
+func playerType(key string, pc PlayerConfig) string {
+	if pc.Type != "" {
+		return pc.Type
+	}
+	return key
+}
+
+// newPlayer creates the backend for a configured player of a session
+func newPlayer(key string, pc PlayerConfig, sessionID string) (Player, error) {
+	switch t := playerType(key, pc); t {
+	case playerTypeMpv:
+		return newMpvPlayer(getMpvIPCPath(sessionID)), nil
+	case playerTypeVlc:
+		return newVlcPlayer()
+	case playerTypeCustom:
+		return newCustomPlayer(pc)
+	default:
+		return nil, fmt.Errorf("unsupported player type %q", t)
+	}
+}
+
+// playerKeys returns the configured player names in sorted order
+func playerKeys(players map[string]PlayerConfig) []string {
+	keys := make([]string, 0, len(players))
+	for k := range players {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// customPlayer runs an arbitrary executable (a wrapper script, a player
+// without IPC, ...) whose Args are a template. Placeholders are filled in per
+// launch:
+//
+//	{path}         media path; an argument that is exactly {path} expands to
+//	               one argument per playlist entry
+//	{start}        start offset in seconds
+//	{title}        item title
+//	{itemId}       Jellyfin item ID
+//	{subtitle}     external subtitle path or URL
+//	{audioIndex}   Jellyfin audio stream index
+//	{positionFile} file the wrapper may write the final position to (seconds),
+//	               optionally followed by the duration on the next line
+//
+// There is no control interface, so the player can only be stopped by killing
+// it. If PositionFile is set, the position written to {positionFile} at exit
+// is reported to Jellyfin; without a duration the item is never marked
+// played.
+type customPlayer struct {
+	template     []string
+	positionFile string
+	events       playerEventHub
+
+	mu     sync.Mutex
+	exited bool
+	final  PlayerStatus
+}
+
+func newCustomPlayer(pc PlayerConfig) (*customPlayer, error) {
+	p := &customPlayer{template: pc.Args}
+	if pc.PositionFile {
+		f, err := os.CreateTemp("", "jellyfin-external-player-position-*.txt")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create position file: %v", err)
+		}
+		f.Close()
+		p.positionFile = f.Name()
+	}
+	return p, nil
+}
+
+// ExpandArgs fills the placeholders of the configured args template
+func (p *customPlayer) ExpandArgs(args []string, req launchRequest) []string {
+	first := ""
+	if len(req.Paths) > 0 {
+		first = req.Paths[0]
+	}
+	audioIndex := ""
+	if req.AudioIndex != nil {
+		audioIndex = strconv.Itoa(*req.AudioIndex)
+	}
+
+	replacer := strings.NewReplacer(
+		"{path}", first,
+		"{start}", strconv.FormatFloat(req.StartSeconds, 'f', 1, 64),
+		"{title}", req.Title,
+		"{itemId}", req.ItemId,
+		"{subtitle}", req.Subtitle,
+		"{audioIndex}", audioIndex,
+		"{positionFile}", p.positionFile,
+	)
+
+	var expanded []string
+	for _, arg := range args {
+		if arg == "{path}" {
+			expanded = append(expanded, req.Paths...)
+			continue
+		}
+		expanded = append(expanded, replacer.Replace(arg))
+	}
+	return expanded
+}
+
+// hasPlaceholder reports whether the args template uses a placeholder
+func (p *customPlayer) hasPlaceholder(name string) bool {
+	for _, arg := range p.template {
+		if strings.Contains(arg, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *customPlayer) LaunchArgs() []string {
+	return nil
+}
+
+// PlaylistArgs appends the paths only if the template has no {path}. The
+// start offset is passed through {start}.
+func (p *customPlayer) PlaylistArgs(req launchRequest) []string {
+	if p.hasPlaceholder("{path}") {
+		return nil
+	}
+	return req.Paths
+}
+
+func (p *customPlayer) Attach(cmd *exec.Cmd) {
+	go func() {
+		for i := 0; i < 5; i++ {
+			time.Sleep(400 * time.Millisecond)
+			if focusProcessWindow(cmd.Process.Pid) {
+				return
+			}
+		}
+	}()
+}
+
+// Status returns the position read from the position file once the player
+// has exited; while it runs there is nothing to query
+func (p *customPlayer) Status() (PlayerStatus, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.exited || p.final.Position == 0 {
+		return PlayerStatus{}, fmt.Errorf("custom player has no control interface")
+	}
+	return p.final, nil
+}
+
+func (p *customPlayer) SetPause(paused bool) error {
+	return fmt.Errorf("custom player has no control interface")
+}
+
+// Quit returns an error so the caller falls back to killing the process
+func (p *customPlayer) Quit() error {
+	return fmt.Errorf("custom player has no control interface")
+}
+
+func (p *customPlayer) PlaylistIndex() (int, error) {
+	return 0, fmt.Errorf("custom player has no control interface")
+}
+
+func (p *customPlayer) Subscribe() (<-chan playerEvent, func()) {
+	return p.events.subscribe()
+}
+
+// Close reads and removes the position file. It is also called when the
+// player failed to start, so the file does not outlive the launch.
+func (p *customPlayer) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.exited {
+		return
+	}
+	p.exited = true
+	p.events.close()
+
+	if p.positionFile == "" {
+		return
+	}
+	defer os.Remove(p.positionFile)
+
+	data, err := os.ReadFile(p.positionFile)
+	if err != nil {
+		log.Printf("Custom player: could not read position file: %v", err)
+		return
+	}
+	// "position" or "position\nduration", in seconds
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		debugLog("Custom player: position file is empty")
+		return
+	}
+	position, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		log.Printf("Custom player: invalid position %q in position file", fields[0])
+		return
+	}
+	p.final = PlayerStatus{Position: position}
+	if len(fields) > 1 {
+		duration, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil || duration <= 0 {
+			log.Printf("Custom player: invalid duration %q in position file", fields[1])
+		} else {
+			p.final.Duration = duration
+		}
+	}
+	log.Printf("Custom player: exit position %.1f of %.1f seconds", position, p.final.Duration)
+}
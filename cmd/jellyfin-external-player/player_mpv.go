@@ -0,0 +1,460 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Input section and script message used for the segment skip key binding
+const (
+	mpvSkipSection = "jellyfin-external-player-skip"
+	mpvSkipMessage = "jellyfin-external-player-skip"
+)
+
+// mpvPlayer controls mpv through its JSON IPC server
+type mpvPlayer struct {
+	ipcPath string
+	ipc     *mpvClient
+	events  playerEventHub
+	// Config file with the stream token header, removed on Close
+	tokenFile string
+}
+
+func newMpvPlayer(ipcPath string) *mpvPlayer {
+	return &mpvPlayer{ipcPath: ipcPath}
+}
+
+func (p *mpvPlayer) LaunchArgs() []string {
+	args := []string{"--input-ipc-server=" + p.ipcPath}
+	if p.tokenFile != "" {
+		args = append(args, "--include="+p.tokenFile)
+	}
+	return args
+}
+
+// SetStreamToken writes the header that carries the token to a config file
+// readable only by the user, which mpv is pointed at with --include, so the
+// token is not on the command line where other users see it. mpv sends the
+// header with every HTTP request.
+func (p *mpvPlayer) SetStreamToken(token string) error {
+	f, err := os.CreateTemp("", "jellyfin-external-player-mpv-*.conf")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintf(f, "http-header-fields=\"%s: %s\"\n", streamTokenHeader, token); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	p.tokenFile = f.Name()
+	return nil
+}
+
+// PlaylistArgs puts each file's track options, and the start offset of the
+// first file, in a per-file group (--{ ... --}) so they don't carry over to
+// the next playlist entry
+func (p *mpvPlayer) PlaylistArgs(req launchRequest) []string {
+	var args []string
+	if req.AudioLanguage != "" {
+		args = append(args, "--alang="+req.AudioLanguage)
+	}
+	if req.SubtitleLanguage != "" {
+		args = append(args, "--slang="+req.SubtitleLanguage)
+	}
+
+	for i, path := range req.Paths {
+		opts := mpvFileOptions(req.tracksFor(i))
+		if i == 0 && req.StartSeconds > 0 {
+			opts = append([][2]string{{"start", fmt.Sprintf("%.1f", req.StartSeconds)}}, opts...)
+		}
+		if len(opts) == 0 {
+			args = append(args, path)
+			continue
+		}
+		args = append(args, "--{")
+		for _, o := range opts {
+			args = append(args, "--"+o[0]+"="+o[1])
+		}
+		args = append(args, path, "--}")
+	}
+	return args
+}
+
+// mpvFileOptions returns the per-file options (name, value) that apply a
+// track selection
+func mpvFileOptions(t trackSelection) [][2]string {
+	var opts [][2]string
+	if t.Audio > 0 {
+		opts = append(opts, [2]string{"aid", fmt.Sprint(t.Audio)})
+	}
+	for _, f := range t.SubtitleFiles {
+		opts = append(opts, [2]string{"sub-file", f})
+	}
+	switch {
+	case t.Subtitle < 0:
+		opts = append(opts, [2]string{"sid", "no"})
+	case t.Subtitle > 0:
+		opts = append(opts, [2]string{"sid", fmt.Sprint(t.Subtitle)})
+	}
+	return opts
+}
+
+func (p *mpvPlayer) Attach(cmd *exec.Cmd) {
+	p.ipc = newMpvClient(p.ipcPath)
+	go p.forwardEvents()
+
+	// Bring mpv to front via IPC + Windows API
+	bringMpvToFront(p.ipc, cmd.Process.Pid)
+}
+
+// forwardEvents translates mpv IPC events into player events
+func (p *mpvPlayer) forwardEvents() {
+	events, unsubscribe := p.ipc.subscribe()
+	defer unsubscribe()
+	defer p.events.close()
+
+	var (
+		paused     bool
+		havePaused bool
+		sid        float64
+		haveSid    bool
+		pos        float64
+	)
+
+	for ev := range events {
+		switch {
+		case ev.Event == "property-change" && ev.Name == "pause":
+			v, ok := ev.Data.(bool)
+			if !ok {
+				continue
+			}
+			// The first value is the initial state, not a change
+			if havePaused && v != paused {
+				if v {
+					p.events.publish(playerEvent{Type: playerEventPause})
+				} else {
+					p.events.publish(playerEvent{Type: playerEventUnpause})
+				}
+			}
+			paused, havePaused = v, true
+
+		case ev.Event == "property-change" && ev.Name == "playlist-pos":
+			if v, ok := ev.Data.(float64); ok {
+				pos = v
+				p.events.publish(playerEvent{Type: playerEventPlaylistPos, Value: v})
+			}
+
+		case ev.Event == "property-change" && ev.Name == "sid":
+			// A track number, or false when subtitles are off
+			v, _ := ev.Data.(float64)
+			if haveSid && v != sid {
+				p.events.publish(playerEvent{Type: playerEventSubtitle, Value: v})
+			}
+			sid, haveSid = v, true
+
+		case ev.Event == "property-change" && ev.Name == "duration":
+			if v, ok := ev.Data.(float64); ok {
+				p.events.publish(playerEvent{Type: playerEventDuration, Value: v})
+			}
+
+		case ev.Event == "client-message" && len(ev.Args) > 0 && ev.Args[0] == mpvSkipMessage:
+			p.events.publish(playerEvent{Type: playerEventSkip})
+
+		case ev.Event == "file-loaded":
+			p.events.publish(playerEvent{Type: playerEventFileLoaded, Value: pos})
+
+		case ev.Event == "playback-restart":
+			// Sent when a seek completes (and when a file starts)
+			p.events.publish(playerEvent{Type: playerEventSeek})
+		}
+	}
+}
+
+func (p *mpvPlayer) Status() (PlayerStatus, error) {
+	if p.ipc == nil || !p.ipc.Connected() {
+		return PlayerStatus{}, fmt.Errorf("mpv IPC not connected")
+	}
+	return p.ipc.Status(), nil
+}
+
+func (p *mpvPlayer) SetPause(paused bool) error {
+	if p.ipc == nil {
+		return fmt.Errorf("mpv IPC not connected")
+	}
+	return p.ipc.SetProperty("pause", paused)
+}
+
+func (p *mpvPlayer) Quit() error {
+	if p.ipc == nil || !p.ipc.Connected() {
+		return fmt.Errorf("mpv IPC not connected")
+	}
+	return p.ipc.send("quit")
+}
+
+func (p *mpvPlayer) Seek(position float64) error {
+	if p.ipc == nil {
+		return fmt.Errorf("mpv IPC not connected")
+	}
+	_, err := p.ipc.command("seek", position, "absolute")
+	return err
+}
+
+func (p *mpvPlayer) PlaylistNext() error {
+	if p.ipc == nil {
+		return fmt.Errorf("mpv IPC not connected")
+	}
+	_, err := p.ipc.command("playlist-next")
+	return err
+}
+
+func (p *mpvPlayer) PlaylistPrev() error {
+	if p.ipc == nil {
+		return fmt.Errorf("mpv IPC not connected")
+	}
+	_, err := p.ipc.command("playlist-prev")
+	return err
+}
+
+func (p *mpvPlayer) SetVolume(percent float64) error {
+	if p.ipc == nil {
+		return fmt.Errorf("mpv IPC not connected")
+	}
+	return p.ipc.SetProperty("volume", percent)
+}
+
+func (p *mpvPlayer) SetMute(muted bool) error {
+	if p.ipc == nil {
+		return fmt.Errorf("mpv IPC not connected")
+	}
+	return p.ipc.SetProperty("mute", muted)
+}
+
+func (p *mpvPlayer) ShowMessage(text string, d time.Duration) error {
+	if p.ipc == nil {
+		return fmt.Errorf("mpv IPC not connected")
+	}
+	_, err := p.ipc.command("show-text", text, int(d/time.Millisecond))
+	return err
+}
+
+func (p *mpvPlayer) ChapterStep(step int) error {
+	if p.ipc == nil {
+		return fmt.Errorf("mpv IPC not connected")
+	}
+	_, err := p.ipc.command("add", "chapter", step)
+	return err
+}
+
+func (p *mpvPlayer) SetAudioTrack(track int) error {
+	if p.ipc == nil {
+		return fmt.Errorf("mpv IPC not connected")
+	}
+	return p.ipc.SetProperty("aid", mpvTrack(track))
+}
+
+func (p *mpvPlayer) SetSubtitleTrack(track int) error {
+	if p.ipc == nil {
+		return fmt.Errorf("mpv IPC not connected")
+	}
+	return p.ipc.SetProperty("sid", mpvTrack(track))
+}
+
+// ApplyTracks adds the external subtitles of the current file and selects
+// its tracks. The subtitles are numbered after the embedded ones, as with
+// --sub-file.
+func (p *mpvPlayer) ApplyTracks(t trackSelection) error {
+	if p.ipc == nil {
+		return fmt.Errorf("mpv IPC not connected")
+	}
+	for _, f := range t.SubtitleFiles {
+		if _, err := p.ipc.command("sub-add", f, "auto"); err != nil {
+			return err
+		}
+	}
+	if t.Audio > 0 {
+		if err := p.ipc.SetProperty("aid", t.Audio); err != nil {
+			return err
+		}
+	}
+	if t.Subtitle != 0 {
+		return p.ipc.SetProperty("sid", mpvTrack(t.Subtitle))
+	}
+	return nil
+}
+
+// mpvTrack returns the aid/sid value for a track number
+func mpvTrack(track int) interface{} {
+	if track <= 0 {
+		return "no"
+	}
+	return track
+}
+
+func (p *mpvPlayer) ToggleFullscreen() error {
+	if p.ipc == nil {
+		return fmt.Errorf("mpv IPC not connected")
+	}
+	_, err := p.ipc.command("cycle", "fullscreen")
+	return err
+}
+
+func (p *mpvPlayer) Screenshot() error {
+	if p.ipc == nil {
+		return fmt.Errorf("mpv IPC not connected")
+	}
+	_, err := p.ipc.command("screenshot")
+	return err
+}
+
+// ShowSkipPrompt shows text on the OSD and binds key to a script message,
+// which mpv sends to every IPC client. The binding is in its own input
+// section so it can be removed again without touching the user's bindings.
+func (p *mpvPlayer) ShowSkipPrompt(text, key string, d time.Duration) error {
+	if p.ipc == nil {
+		return fmt.Errorf("mpv IPC not connected")
+	}
+	binding := key + " script-message " + mpvSkipMessage + "\n"
+	if _, err := p.ipc.command("define-section", mpvSkipSection, binding, "force"); err != nil {
+		return err
+	}
+	if _, err := p.ipc.command("enable-section", mpvSkipSection); err != nil {
+		return err
+	}
+	_, err := p.ipc.command("show-text", text, int(d/time.Millisecond))
+	return err
+}
+
+func (p *mpvPlayer) HideSkipPrompt() error {
+	if p.ipc == nil {
+		return fmt.Errorf("mpv IPC not connected")
+	}
+	if _, err := p.ipc.command("disable-section", mpvSkipSection); err != nil {
+		return err
+	}
+	_, err := p.ipc.command("show-text", "", 1)
+	return err
+}
+
+// QueueAdd appends path with its track options (quoted with mpv's %len%
+// syntax, since paths may contain commas) and moves it into place
+func (p *mpvPlayer) QueueAdd(path string, tracks trackSelection, index int) error {
+	if p.ipc == nil {
+		return fmt.Errorf("mpv IPC not connected")
+	}
+	var options []string
+	for _, o := range mpvFileOptions(tracks) {
+		options = append(options, fmt.Sprintf("%s=%%%d%%%s", o[0], len(o[1]), o[1]))
+	}
+	args := map[string]interface{}{"url": path, "flags": "append"}
+	if len(options) > 0 {
+		args["options"] = strings.Join(options, ",")
+	}
+	if _, err := p.ipc.commandNamed("loadfile", args); err != nil {
+		return err
+	}
+	if index < 0 {
+		return nil
+	}
+
+	count, err := p.ipc.GetProperty("playlist-count")
+	if err != nil {
+		return err
+	}
+	n, ok := count.(float64)
+	if !ok {
+		return fmt.Errorf("mpv: unexpected playlist-count %v", count)
+	}
+	if index >= int(n)-1 {
+		return nil
+	}
+	_, err = p.ipc.command("playlist-move", int(n)-1, index)
+	return err
+}
+
+func (p *mpvPlayer) QueueRemove(index int) error {
+	if p.ipc == nil {
+		return fmt.Errorf("mpv IPC not connected")
+	}
+	_, err := p.ipc.command("playlist-remove", index)
+	return err
+}
+
+// QueueMove moves an entry so it ends up at index to. mpv's playlist-move
+// puts it before the entry at its second argument.
+func (p *mpvPlayer) QueueMove(from, to int) error {
+	if p.ipc == nil {
+		return fmt.Errorf("mpv IPC not connected")
+	}
+	if from < to {
+		to++
+	}
+	_, err := p.ipc.command("playlist-move", from, to)
+	return err
+}
+
+func (p *mpvPlayer) QueueJump(index int) error {
+	if p.ipc == nil {
+		return fmt.Errorf("mpv IPC not connected")
+	}
+	_, err := p.ipc.command("playlist-play-index", index)
+	return err
+}
+
+func (p *mpvPlayer) PlaylistIndex() (int, error) {
+	status, err := p.Status()
+	if err != nil {
+		return 0, err
+	}
+	return status.PlaylistPos, nil
+}
+
+func (p *mpvPlayer) Subscribe() (<-chan playerEvent, func()) {
+	return p.events.subscribe()
+}
+
+func (p *mpvPlayer) Close() {
+	if p.ipc != nil {
+		p.ipc.Close()
+	}
+	p.events.close()
+	if p.tokenFile != "" {
+		os.Remove(p.tokenFile)
+	}
+}
+
+// bringMpvToFront sets ontop property to bring mpv window to foreground and requests focus
+func bringMpvToFront(ipc *mpvClient, pid int) {
+	if ipc == nil {
+		return
+	}
+	go func() {
+		// Wait for mpv to initialize and create its window
+		time.Sleep(800 * time.Millisecond)
+
+		// Set ontop to true to bring window to front
+		if err := ipc.SetProperty("ontop", true); err != nil {
+			log.Printf("Failed to set ontop: %v", err)
+			return
+		}
+		log.Printf("Set mpv ontop=true")
+
+		// Try multiple times to find and focus the window
+		for i := 0; i < 5; i++ {
+			time.Sleep(200 * time.Millisecond)
+			if focusProcessWindow(pid) {
+				break
+			}
+		}
+
+		// Brief delay then disable ontop so user can alt-tab away later
+		time.Sleep(300 * time.Millisecond)
+		if err := ipc.SetProperty("ontop", false); err != nil {
+			log.Printf("Failed to unset ontop: %v", err)
+		}
+		log.Printf("Set mpv ontop=false")
+	}()
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// How often the VLC HTTP interface is polled for status
+	vlcPollInterval = 500 * time.Millisecond
+	// A position jump larger than this (in seconds) between polls is treated as a seek
+	vlcSeekThreshold = 3.0
+	// VLC's volume scale: 256 is 100%
+	vlcVolumeScale = 256.0
+)
+
+// vlcPlayer controls VLC through its HTTP (lua) interface. VLC has no push
+// notifications, so the status is polled and changes are turned into events.
+type vlcPlayer struct {
+	port       int
+	password   string
+	configFile string // vlcrc that carries the password, removed on Close
+	client     *http.Client
+	events     playerEventHub
+
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mu          sync.Mutex
+	cmd         *exec.Cmd
+	connected   bool
+	status      PlayerStatus
+	currentID   int     // VLC playlist ID of the current entry
+	mutedVolume float64 // Volume (VLC scale) to restore when unmuting
+}
+
+// vlcStatus is the subset of /requests/status.json that we use
+type vlcStatus struct {
+	State       string  `json:"state"` // "playing", "paused" or "stopped"
+	Time        float64 `json:"time"`
+	Length      float64 `json:"length"`
+	Position    float64 `json:"position"` // Fraction of length
+	Volume      float64 `json:"volume"`
+	CurrentPlID int     `json:"currentplid"`
+}
+
+// vlcPlaylistNode is a node of /requests/playlist.json
+type vlcPlaylistNode struct {
+	ID       string            `json:"id"`
+	Type     string            `json:"type"` // "node" or "leaf"
+	Children []vlcPlaylistNode `json:"children"`
+}
+
+func newVlcPlayer() (*vlcPlayer, error) {
+	port, err := freeLocalPort()
+	if err != nil {
+		return nil, fmt.Errorf("no free port for VLC HTTP interface: %v", err)
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	password := hex.EncodeToString(b)
+	configFile, err := writeVlcConfig(password)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write VLC config: %v", err)
+	}
+
+	return &vlcPlayer{
+		port:       port,
+		password:   password,
+		configFile: configFile,
+		client:     &http.Client{Timeout: 2 * time.Second},
+		closed:     make(chan struct{}),
+	}, nil
+}
+
+// userVlcConfigPath returns where VLC keeps the user's vlcrc
+func userVlcConfigPath() string {
+	switch runtime.GOOS {
+	case "windows":
+		return filepath.Join(os.Getenv("APPDATA"), "vlc", "vlcrc")
+	case "darwin":
+		home, _ := os.UserHomeDir()
+		return filepath.Join(home, "Library", "Preferences", "org.videolan.vlc", "vlcrc")
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "vlc", "vlcrc")
+}
+
+// writeVlcConfig writes a copy of the user's vlcrc with the HTTP password
+// added, readable only by the user. VLC is pointed at it with --config, so
+// the password is neither on the command line, where other users see it,
+// nor in the log.
+func writeVlcConfig(password string) (string, error) {
+	f, err := os.CreateTemp("", "jellyfin-external-player-vlcrc-*")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// VLC ignores the [section] lines and the last value of an option wins
+	if path := userVlcConfigPath(); path != "" {
+		if data, err := os.ReadFile(path); err == nil {
+			f.Write(data)
+			f.WriteString("\n")
+		}
+	}
+	if _, err := f.WriteString("http-password=" + password + "\n"); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// freeLocalPort asks the OS for an unused TCP port on localhost
+func freeLocalPort() (int, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port, nil
+}
+
+func (p *vlcPlayer) LaunchArgs() []string {
+	return []string{
+		"--extraintf", "http",
+		"--http-host", "127.0.0.1",
+		"--http-port", strconv.Itoa(p.port),
+		"--config=" + p.configFile,
+		"--play-and-exit",
+	}
+}
+
+// PlaylistArgs follows each path with its track options, and the first
+// path with its start offset, as input options (":option"), which only
+// apply to that playlist entry
+func (p *vlcPlayer) PlaylistArgs(req launchRequest) []string {
+	var args []string
+	if req.AudioLanguage != "" {
+		args = append(args, "--audio-language="+req.AudioLanguage)
+	}
+	if req.SubtitleLanguage != "" {
+		args = append(args, "--sub-language="+req.SubtitleLanguage)
+	}
+
+	for i, path := range req.Paths {
+		args = append(args, path)
+		if i == 0 && req.StartSeconds > 0 {
+			args = append(args, fmt.Sprintf(":start-time=%.1f", req.StartSeconds))
+		}
+
+		// VLC numbers tracks from 0
+		t := req.tracksFor(i)
+		if t.Audio > 0 {
+			args = append(args, fmt.Sprintf(":audio-track=%d", t.Audio-1))
+		}
+		switch {
+		case t.Subtitle < 0:
+			args = append(args, ":no-spu")
+		case t.selectedFile() != "":
+			// VLC takes a single subtitle file and selects it
+			args = append(args, ":sub-file="+t.selectedFile())
+		case t.Subtitle > 0:
+			args = append(args, fmt.Sprintf(":sub-track=%d", t.Subtitle-1))
+		}
+	}
+	return args
+}
+
+func (p *vlcPlayer) Attach(cmd *exec.Cmd) {
+	p.mu.Lock()
+	p.cmd = cmd
+	p.mu.Unlock()
+
+	go p.poll()
+
+	// Bring the VLC window to front (no-op outside Windows)
+	go func() {
+		for i := 0; i < 5; i++ {
+			time.Sleep(400 * time.Millisecond)
+			if focusProcessWindow(cmd.Process.Pid) {
+				return
+			}
+		}
+	}()
+}
+
+// request sends a request to the HTTP interface and decodes the JSON reply
+func (p *vlcPlayer) request(path string, query url.Values, out interface{}) error {
+	u := fmt.Sprintf("http://127.0.0.1:%d%s", p.port, path)
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	// VLC uses HTTP basic auth with an empty user name
+	req.SetBasicAuth("", p.password)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("VLC returned %d", resp.StatusCode)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// command sends a status.json command (e.g. "pl_pause") with optional value
+func (p *vlcPlayer) command(command string, val string) error {
+	q := url.Values{"command": {command}}
+	if val != "" {
+		q.Set("val", val)
+	}
+	return p.request("/requests/status.json", q, nil)
+}
+
+// poll reads VLC's status until the player is closed, publishing events on change
+func (p *vlcPlayer) poll() {
+	ticker := time.NewTicker(vlcPollInterval)
+	defer ticker.Stop()
+
+	var lastPoll time.Time
+
+	for {
+		select {
+		case <-p.closed:
+			return
+		case now := <-ticker.C:
+			var s vlcStatus
+			if err := p.request("/requests/status.json", nil, &s); err != nil {
+				// Still starting up, or already exiting
+				continue
+			}
+
+			position := s.Time
+			if s.Length > 0 && s.Position > 0 {
+				position = s.Position * s.Length
+			}
+
+			p.mu.Lock()
+			prev := p.status
+			wasConnected := p.connected
+			prevID := p.currentID
+
+			p.connected = true
+			p.currentID = s.CurrentPlID
+			p.status.Playing = s.State != "stopped"
+			p.status.Paused = s.State == "paused"
+			p.status.Position = position
+			p.status.Duration = s.Length
+			p.status.Volume = s.Volume * 100 / vlcVolumeScale
+			p.status.Muted = s.Volume == 0
+			p.mu.Unlock()
+
+			if !wasConnected {
+				debugLog("VLC: connected to HTTP interface on port %d", p.port)
+				if s.Length > 0 {
+					p.events.publish(playerEvent{Type: playerEventDuration, Value: s.Length})
+				}
+				lastPoll = now
+				continue
+			}
+
+			if s.CurrentPlID != prevID && s.CurrentPlID >= 0 {
+				if index, err := p.playlistIndex(s.CurrentPlID); err == nil {
+					p.mu.Lock()
+					p.status.PlaylistPos = index
+					p.mu.Unlock()
+					p.events.publish(playerEvent{Type: playerEventPlaylistPos, Value: float64(index)})
+					p.events.publish(playerEvent{Type: playerEventFileLoaded, Value: float64(index)})
+				}
+			}
+			if s.Length != prev.Duration && s.Length > 0 {
+				p.events.publish(playerEvent{Type: playerEventDuration, Value: s.Length})
+			}
+
+			switch {
+			case s.State == "paused" && !prev.Paused:
+				p.events.publish(playerEvent{Type: playerEventPause})
+			case s.State == "playing" && prev.Paused:
+				p.events.publish(playerEvent{Type: playerEventUnpause})
+			case s.State == "playing" && s.CurrentPlID == prevID:
+				expected := prev.Position + now.Sub(lastPoll).Seconds()
+				if math.Abs(position-expected) > vlcSeekThreshold {
+					p.events.publish(playerEvent{Type: playerEventSeek})
+				}
+			}
+			lastPoll = now
+		}
+	}
+}
+
+// playlistIndex returns the position of the entry with VLC playlist ID id
+func (p *vlcPlayer) playlistIndex(id int) (int, error) {
+	var root vlcPlaylistNode
+	if err := p.request("/requests/playlist.json", nil, &root); err != nil {
+		return 0, err
+	}
+
+	// Leaves of the first node ("Playlist") are the entries we queued
+	var leaves []string
+	var walk func(n vlcPlaylistNode)
+	walk = func(n vlcPlaylistNode) {
+		if n.Type == "leaf" {
+			leaves = append(leaves, n.ID)
+			return
+		}
+		for _, c := range n.Children {
+			walk(c)
+		}
+	}
+	if len(root.Children) > 0 {
+		walk(root.Children[0])
+	}
+
+	want := strconv.Itoa(id)
+	for i, leaf := range leaves {
+		if leaf == want {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("VLC playlist entry %d not found", id)
+}
+
+func (p *vlcPlayer) Status() (PlayerStatus, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.connected {
+		return PlayerStatus{}, fmt.Errorf("VLC HTTP interface not connected")
+	}
+	return p.status, nil
+}
+
+func (p *vlcPlayer) SetPause(paused bool) error {
+	if paused {
+		return p.command("pl_forcepause", "")
+	}
+	return p.command("pl_forceresume", "")
+}
+
+// Quit stops playback, which makes VLC exit because it was started with
+// --play-and-exit. VLC is killed if it is still running shortly after.
+func (p *vlcPlayer) Quit() error {
+	if err := p.command("pl_stop", ""); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	cmd := p.cmd
+	p.mu.Unlock()
+
+	go func() {
+		select {
+		case <-p.closed:
+		case <-time.After(3 * time.Second):
+			if cmd != nil && cmd.Process != nil {
+				log.Printf("VLC did not exit after stop, killing (pid %d)", cmd.Process.Pid)
+				cmd.Process.Kill()
+			}
+		}
+	}()
+	return nil
+}
+
+func (p *vlcPlayer) Seek(position float64) error {
+	return p.command("seek", strconv.Itoa(int(position)))
+}
+
+func (p *vlcPlayer) PlaylistNext() error {
+	return p.command("pl_next", "")
+}
+
+func (p *vlcPlayer) PlaylistPrev() error {
+	return p.command("pl_previous", "")
+}
+
+func (p *vlcPlayer) SetVolume(percent float64) error {
+	return p.command("volume", strconv.Itoa(int(math.Round(percent*vlcVolumeScale/100))))
+}
+
+// SetMute sets the volume to 0, as the HTTP interface has no mute command.
+// Unmuting restores the volume from before.
+func (p *vlcPlayer) SetMute(muted bool) error {
+	p.mu.Lock()
+	current := p.status.Volume * vlcVolumeScale / 100
+	if muted && current > 0 {
+		p.mutedVolume = current
+	}
+	restore := p.mutedVolume
+	p.mu.Unlock()
+
+	if muted {
+		return p.command("volume", "0")
+	}
+	if restore <= 0 {
+		restore = vlcVolumeScale
+	}
+	return p.command("volume", strconv.Itoa(int(math.Round(restore))))
+}
+
+func (p *vlcPlayer) ShowMessage(text string, d time.Duration) error {
+	return fmt.Errorf("VLC HTTP interface cannot show messages")
+}
+
+// ChapterStep presses VLC's chapter hotkey step times
+func (p *vlcPlayer) ChapterStep(step int) error {
+	key := "chapter-next"
+	if step < 0 {
+		key, step = "chapter-prev", -step
+	}
+	for i := 0; i < step; i++ {
+		if err := p.command("key", key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetAudioTrack is not supported: the HTTP interface selects tracks by
+// VLC's stream IDs, which do not follow the track order
+func (p *vlcPlayer) SetAudioTrack(track int) error {
+	return fmt.Errorf("VLC HTTP interface cannot select tracks by number")
+}
+
+func (p *vlcPlayer) SetSubtitleTrack(track int) error {
+	return fmt.Errorf("VLC HTTP interface cannot select tracks by number")
+}
+
+// ApplyTracks loads the selected external subtitle, which VLC then shows.
+// Tracks inside the file cannot be selected over HTTP.
+func (p *vlcPlayer) ApplyTracks(t trackSelection) error {
+	if f := t.selectedFile(); f != "" {
+		return p.command("addsubtitle", f)
+	}
+	if t.Audio > 0 || t.Subtitle != 0 {
+		return fmt.Errorf("VLC HTTP interface cannot select tracks by number")
+	}
+	return nil
+}
+
+func (p *vlcPlayer) ToggleFullscreen() error {
+	return p.command("fullscreen", "")
+}
+
+func (p *vlcPlayer) Screenshot() error {
+	return p.command("key", "snapshot")
+}
+
+func (p *vlcPlayer) PlaylistIndex() (int, error) {
+	status, err := p.Status()
+	if err != nil {
+		return 0, err
+	}
+	return status.PlaylistPos, nil
+}
+
+func (p *vlcPlayer) Subscribe() (<-chan playerEvent, func()) {
+	return p.events.subscribe()
+}
+
+func (p *vlcPlayer) Close() {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+		p.mu.Lock()
+		p.status.Playing = false
+		p.mu.Unlock()
+		p.events.close()
+		os.Remove(p.configFile)
+	})
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"time"
+)
+
+// Default number of seconds between periodic progress reports
+const defaultProgressInterval = 10
+
+// getProgressInterval returns the configured progress reporting interval
+func getProgressInterval() time.Duration {
+	configMu.RLock()
+	interval := config.ProgressInterval
+	configMu.RUnlock()
+
+	if interval <= 0 {
+		interval = defaultProgressInterval
+	}
+	return time.Duration(interval) * time.Second
+}
+
+// postEmbySession POSTs a JSON body to one of the /Sessions/Playing endpoints
+// and returns the HTTP status code and response body
+func postEmbySession(serverURL, token, endpoint string, body interface{}) (int, []byte, error) {
+	bodyBytes, err := json.Marshal(body)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	apiURL := serverURL + endpoint
+	debugLog("POST %s with %s", apiURL, string(bodyBytes))
+
+	req, err := http.NewRequest("POST", apiURL, bytes.NewReader(bodyBytes))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Emby-Token", token)
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, respBody, nil
+}
+
+// Report playback progress to Emby server. eventName is one of Jellyfin's
+// progress events ("TimeUpdate", "Pause", "Unpause", ...)
+func reportPlaybackProgress(s *playerSession, status PlayerStatus, eventName string) {
+	sess := s.current()
+	serverURL := s.serverURL
+	userId := s.userId
+	token := s.token
+
+	if sess == nil || sess.ItemId == "" || serverURL == "" || token == "" {
+		return
+	}
+
+	body := sess.reportBody()
+	body["PositionTicks"] = int64(status.Position * 10000000)
+	body["IsPaused"] = status.Paused
+	body["IsMuted"] = status.Muted
+	body["VolumeLevel"] = int(math.Round(status.Volume))
+	body["EventName"] = eventName
+
+	code, respBody, err := postEmbySession(serverURL, token, "/Sessions/Playing/Progress", body)
+	if err != nil || isRetryableStatus(code) {
+		if err != nil {
+			log.Printf("Playback progress: request failed: %v", err)
+		} else {
+			log.Printf("Playback progress: server returned %d: %s", code, string(respBody))
+		}
+		publishReportFailed(s, "/Sessions/Playing/Progress", sess.ItemId, code, err)
+		// Keep the position in case the server is still down when playback
+		// stops, or this program does not get to report the stop. It is
+		// queued as a stop report, held until the item stops playing.
+		s.mu.Lock()
+		serverPosition := sess.serverPosition
+		s.mu.Unlock()
+		reportQueue.add(&queuedReport{
+			Endpoint:    "/Sessions/Playing/Progress",
+			ServerURL:   serverURL,
+			UserId:      userId,
+			Token:       token,
+			ItemId:      sess.ItemId,
+			Position:    status.Position,
+			ServerPos:   serverPosition,
+			Body:        body,
+			held:        true,
+			unreachable: err != nil,
+		})
+		return
+	}
+	if code < 200 || code >= 300 {
+		log.Printf("Playback progress: server returned %d: %s", code, string(respBody))
+		publishReportFailed(s, "/Sessions/Playing/Progress", sess.ItemId, code, nil)
+		return
+	}
+	position := status.Position
+	s.mu.Lock()
+	sess.serverPosition = &position
+	s.mu.Unlock()
+	reportQueue.supersede(serverURL, sess.ItemId)
+	debugLog("Playback progress: %s at %.1f seconds for item %s", eventName, status.Position, sess.ItemId)
+}
+
+// runProgressReporter reports progress to Emby every progress interval while
+// the player of a session runs, and immediately when the player reports a
+// pause, unpause or completed seek. It returns when done is closed.
+func runProgressReporter(s *playerSession, done <-chan struct{}) {
+	events, unsubscribe := s.player.Subscribe()
+	defer unsubscribe()
+
+	ticker := time.NewTicker(getProgressInterval())
+	defer ticker.Stop()
+
+	for {
+		eventName := ""
+
+		select {
+		case <-done:
+			return
+
+		case <-ticker.C:
+			eventName = "TimeUpdate"
+
+		case ev, ok := <-events:
+			if !ok {
+				events = nil // Control interface closed; wait for the process to exit
+				continue
+			}
+			switch ev.Type {
+			case playerEventPause:
+				eventName = "Pause"
+			case playerEventUnpause:
+				eventName = "Unpause"
+			case playerEventSeek:
+				debugLog("Playback progress: seek completed")
+				eventName = "TimeUpdate"
+			}
+		}
+
+		if eventName == "" {
+			continue
+		}
+
+		status, err := getPlaybackInfo(s)
+		if err != nil {
+			continue
+		}
+		reportPlaybackProgress(s, status, eventName)
+	}
+}
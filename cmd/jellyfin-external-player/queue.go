@@ -0,0 +1,410 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var (
+	errNothingPlaying   = errors.New("nothing is playing")
+	errQueueUnsupported = errors.New("the player does not support changing its playlist")
+)
+
+// queueMu serializes changes to running playlists, so each one updates the
+// session's playlist and position and then the player before the next starts
+var queueMu sync.Mutex
+
+// queueRequest is the JSON body of the /api/queue/ actions
+type queueRequest struct {
+	ItemId              string `json:"itemId"`
+	ServerURL           string `json:"serverUrl"`
+	Path                string `json:"path"`
+	MediaSourceId       string `json:"mediaSourceId"`
+	Display             string `json:"display"` // Display to start on if nothing plays there
+	AudioStreamIndex    *int   `json:"audioStreamIndex"`
+	SubtitleStreamIndex *int   `json:"subtitleStreamIndex"`
+
+	Index *int `json:"index"` // Entry to remove, move or jump to
+	To    *int `json:"to"`    // Where to move it
+}
+
+// queueState returns the playlist controls of a session's player and a copy
+// of its playlist state
+func queueState(s *playerSession) (queueController, []PlaylistItem, int, error) {
+	if s == nil {
+		return nil, nil, 0, errNothingPlaying
+	}
+	q, ok := s.player.(queueController)
+	if !ok {
+		return nil, nil, 0, errQueueUnsupported
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return q, append([]PlaylistItem(nil), s.playlist...), s.playlistPosition, nil
+}
+
+// setQueueState replaces the playlist state of a session
+func setQueueState(s *playerSession, items []PlaylistItem, pos int) {
+	s.mu.Lock()
+	s.playlist = items
+	s.playlistPosition = pos
+	s.mu.Unlock()
+}
+
+// queueAdd adds items to the playlist of a session: after the current entry
+// if next is set, otherwise at the end
+func queueAdd(s *playerSession, items []PlaylistItem, next bool) error {
+	queueMu.Lock()
+	defer queueMu.Unlock()
+
+	q, plist, pos, err := queueState(s)
+	if err != nil {
+		return err
+	}
+
+	for i, item := range items {
+		translated := prepareItem(s.serverURL, s.token, &item, s.paths)
+		items[i] = item // Keeps the route for the response
+		tracks := selectTracks(s.serverURL, s.userId, s.token, item, s.subs)
+
+		index := len(plist)
+		if next {
+			index = pos + 1 + i
+		}
+		updated := make([]PlaylistItem, 0, len(plist)+1)
+		updated = append(updated, plist[:index]...)
+		updated = append(updated, item)
+		updated = append(updated, plist[index:]...)
+
+		// Update our state first, so the position change the player
+		// reports for an insert is not taken for a new item playing
+		setQueueState(s, updated, pos)
+		target := index
+		if !next {
+			target = -1
+		}
+		if err := q.QueueAdd(encodeForPlayer(translated), tracks, target); err != nil {
+			setQueueState(s, plist, pos)
+			return err
+		}
+		log.Printf("Queue: added [%d] %s", index, redact(translated))
+		plist = updated
+	}
+	return nil
+}
+
+// queueRemove removes an entry other than the one playing
+func queueRemove(s *playerSession, index int) error {
+	queueMu.Lock()
+	defer queueMu.Unlock()
+
+	q, plist, pos, err := queueState(s)
+	if err != nil {
+		return err
+	}
+	if index < 0 || index >= len(plist) {
+		return fmt.Errorf("index %d out of range", index)
+	}
+	if index == pos {
+		return fmt.Errorf("entry %d is playing; jump to another entry first", index)
+	}
+
+	updated := append(append([]PlaylistItem(nil), plist[:index]...), plist[index+1:]...)
+	newPos := pos
+	if index < pos {
+		newPos--
+	}
+	setQueueState(s, updated, newPos)
+	if err := q.QueueRemove(index); err != nil {
+		setQueueState(s, plist, pos)
+		return err
+	}
+	log.Printf("Queue: removed [%d] %s", index, plist[index].ItemId)
+	return nil
+}
+
+// queueMove moves an entry so it ends up at index to
+func queueMove(s *playerSession, from, to int) error {
+	queueMu.Lock()
+	defer queueMu.Unlock()
+
+	q, plist, pos, err := queueState(s)
+	if err != nil {
+		return err
+	}
+	if from < 0 || from >= len(plist) || to < 0 || to >= len(plist) {
+		return fmt.Errorf("index out of range")
+	}
+	if from == to {
+		return nil
+	}
+
+	item := plist[from]
+	updated := append(append([]PlaylistItem(nil), plist[:from]...), plist[from+1:]...)
+	updated = append(updated[:to], append([]PlaylistItem{item}, updated[to:]...)...)
+
+	// Follow the playing entry to its new index
+	newPos := pos
+	switch {
+	case pos == from:
+		newPos = to
+	case from < pos && to >= pos:
+		newPos--
+	case from > pos && to <= pos:
+		newPos++
+	}
+
+	setQueueState(s, updated, newPos)
+	if err := q.QueueMove(from, to); err != nil {
+		setQueueState(s, plist, pos)
+		return err
+	}
+	log.Printf("Queue: moved [%d] to [%d]", from, to)
+	return nil
+}
+
+// queueReplace replaces the entry launched with the unchecked path u by
+// item, played from path, unless the entry was removed or has started
+// playing. It reports whether the entry was replaced.
+func queueReplace(s *playerSession, u *uncheckedPath, item PlaylistItem, path string) bool {
+	queueMu.Lock()
+	defer queueMu.Unlock()
+
+	q, plist, pos, err := queueState(s)
+	if err != nil {
+		log.Printf("Path check: cannot replace %s: %v", redact(u.path), err)
+		return false
+	}
+	index := -1
+	for i := range plist {
+		if plist[i].unchecked == u {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return false
+	}
+	if index <= pos {
+		log.Printf("Path check: entry %d has already started, not replacing it", index)
+		return false
+	}
+
+	tracks := selectTracks(s.serverURL, s.userId, s.token, item, s.subs)
+	updated := append([]PlaylistItem(nil), plist...)
+	updated[index] = item
+	setQueueState(s, updated, pos)
+	if err := q.QueueRemove(index); err != nil {
+		setQueueState(s, plist, pos)
+		log.Printf("Path check: cannot replace entry %d: %v", index, err)
+		return false
+	}
+	if err := q.QueueAdd(encodeForPlayer(path), tracks, index); err != nil {
+		setQueueState(s, append(updated[:index:index], updated[index+1:]...), pos)
+		log.Printf("Path check: removed entry %d but could not add its replacement: %v", index, err)
+		return true
+	}
+	log.Printf("Queue: replaced [%d] with %s", index, redact(path))
+	return true
+}
+
+// queueJump starts playing another entry. The position reached in the
+// current one is reported instead of marking it finished.
+func queueJump(s *playerSession, index int) error {
+	queueMu.Lock()
+	defer queueMu.Unlock()
+
+	q, plist, pos, err := queueState(s)
+	if err != nil {
+		return err
+	}
+	if index < 0 || index >= len(plist) {
+		return fmt.Errorf("index %d out of range", index)
+	}
+	if index == pos {
+		return nil
+	}
+
+	getPlaybackInfo(s) // Updates lastPosition
+	s.mu.Lock()
+	s.playlistJumped = true
+	s.mu.Unlock()
+
+	if err := q.QueueJump(index); err != nil {
+		s.mu.Lock()
+		s.playlistJumped = false
+		s.mu.Unlock()
+		return err
+	}
+	log.Printf("Queue: jumped from [%d] to [%d]", pos, index)
+	return nil
+}
+
+// queueHandler lists the running playlist (GET /api/queue) and changes it
+// through POST /api/queue/append, /next, /remove, /move and /jump. The
+// "session" parameter picks the player session; without it the most
+// recently started one is used.
+func queueHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := r.URL.Query().Get("session")
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/queue"), "/")
+	if action == "" {
+		if r.Method != "GET" {
+			http.Error(w, "GET required", http.StatusMethodNotAllowed)
+			return
+		}
+		writeQueue(w, sessions.get(sessionID))
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req queueRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s := sessions.get(sessionID)
+	var err error
+	switch action {
+	case "append", "next":
+		if !isDisplay(req.Display) {
+			http.Error(w, fmt.Sprintf("unknown display %q", req.Display), http.StatusBadRequest)
+			return
+		}
+		if sessionID == "" && req.Display != "" {
+			s = sessions.onDisplay(req.Display)
+		}
+		if s == nil && sessionID != "" {
+			err = errNothingPlaying
+			break
+		}
+		s, err = queueAddRequest(s, req, action == "next")
+	case "remove", "jump":
+		if req.Index == nil {
+			http.Error(w, "missing index", http.StatusBadRequest)
+			return
+		}
+		if action == "remove" {
+			err = queueRemove(s, *req.Index)
+		} else {
+			err = queueJump(s, *req.Index)
+		}
+	case "move":
+		if req.Index == nil || req.To == nil {
+			http.Error(w, "missing index or to", http.StatusBadRequest)
+			return
+		}
+		err = queueMove(s, *req.Index, *req.To)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if err != nil {
+		status := http.StatusBadRequest
+		switch {
+		case err == errNothingPlaying, err == errPlayerBusy:
+			status = http.StatusConflict
+		case err == errQueueUnsupported:
+			status = http.StatusNotImplemented
+		}
+		if _, ok := err.(*unsupportedItemError); ok {
+			status = http.StatusUnprocessableEntity
+		}
+		log.Printf("Queue: %s failed: %v", action, err)
+		http.Error(w, err.Error(), status)
+		return
+	}
+	writeQueue(w, s)
+}
+
+// queueAddRequest resolves the item of an append or next request and adds
+// it to the playlist of session s, starting a session on the requested
+// display if s is nil. It returns the session the item went to.
+func queueAddRequest(s *playerSession, req queueRequest, next bool) (*playerSession, error) {
+	if req.ItemId == "" && req.Path == "" {
+		return s, fmt.Errorf("missing itemId or path")
+	}
+
+	plReq := PlaylistRequest{ServerURL: req.ServerURL}
+	if req.ItemId != "" {
+		if s != nil && s.serverURL != "" && req.ServerURL != "" && normalizeServerURL(req.ServerURL) != s.serverURL {
+			return s, fmt.Errorf("the playlist belongs to %s", s.serverURL)
+		}
+		if s != nil && s.serverURL != "" {
+			plReq.ServerURL = s.serverURL
+		}
+		cred, ok := credentials.lookup(plReq.ServerURL)
+		if !ok {
+			return s, fmt.Errorf("no credentials stored for this server")
+		}
+		plReq.ServerURL, plReq.UserID, plReq.Token = cred.ServerURL, cred.UserId, cred.AccessToken
+
+		items, err := resolvePlaylistItems(&plReq, req.ItemId, req.MediaSourceId)
+		if err != nil {
+			return s, err
+		}
+		if items[0].ItemId == req.ItemId {
+			items[0].AudioStreamIndex = req.AudioStreamIndex
+			items[0].SubtitleStreamIndex = req.SubtitleStreamIndex
+		}
+		plReq.Items = items
+	} else {
+		plReq.Items = []PlaylistItem{{Path: req.Path}}
+	}
+
+	if s != nil {
+		return s, queueAdd(s, plReq.Items, next)
+	}
+
+	startMu.Lock()
+	defer startMu.Unlock()
+	if sessions.onDisplay(req.Display) != nil {
+		// Another request started a player in the meantime
+		return s, errPlayerBusy
+	}
+	plReq.Display = req.Display
+	return startPlaylist(plReq)
+}
+
+// writeQueue writes the playlist of a session as JSON
+func writeQueue(w http.ResponseWriter, s *playerSession) {
+	var plist []PlaylistItem
+	pos := 0
+	sessionID := ""
+	if s != nil {
+		sessionID = s.ID
+		s.mu.Lock()
+		plist = s.playlist
+		pos = s.playlistPosition
+		s.mu.Unlock()
+	}
+
+	items := make([]map[string]interface{}, 0, len(plist))
+	for i, item := range plist {
+		items = append(items, map[string]interface{}{
+			"index":   i,
+			"itemId":  item.ItemId,
+			"title":   item.Title,
+			"path":    item.Path,
+			"current": i == pos,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"session":  sessionID,
+		"playing":  s != nil,
+		"position": pos,
+		"items":    items,
+	})
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// File next to config.json that holds reports waiting to be resent
+	reportQueueFile = "report-queue.json"
+	// Delay before the first retry; doubled after each failed attempt
+	reportRetryMin = 30 * time.Second
+	// Longest delay between retries
+	reportRetryMax = 30 * time.Minute
+	// Reports older than this are dropped instead of retried
+	reportQueueMaxAge = 14 * 24 * time.Hour
+	// How far the server's clock may be ahead of ours when its
+	// LastPlayedDate is compared with the time a report was queued
+	reportClockSkew = 5 * time.Minute
+	// Difference in seconds from which the server's stored position counts
+	// as changed by another client
+	reportPositionTolerance = 1.0
+)
+
+// Fields of progress reports that stop reports do not carry
+var progressOnlyFields = []string{"IsPaused", "IsMuted", "VolumeLevel", "EventName"}
+
+// queuedReport is a stop report that could not be delivered. Failed
+// progress reports are queued as stop reports too: replaying a progress
+// report after playback ended would leave a phantom "Now Playing" session on
+// the server, while a stop report saves the position and ends the session.
+type queuedReport struct {
+	ID          string                 `json:"id"`
+	Endpoint    string                 `json:"endpoint"`
+	ServerURL   string                 `json:"server_url"`
+	UserId      string                 `json:"user_id,omitempty"`
+	Token       string                 `json:"token"`
+	ItemId      string                 `json:"item_id"`
+	Position    float64                `json:"position"`                  // Seconds
+	ServerPos   *float64               `json:"server_position,omitempty"` // Seconds the server stored for the item when queued, if known
+	MarkPlayed  bool                   `json:"mark_played,omitempty"`     // Mark the item played once delivered
+	Body        map[string]interface{} `json:"body"`
+	QueuedAt    time.Time              `json:"queued_at"`
+	Attempts    int                    `json:"attempts"`
+	NextAttempt time.Time              `json:"next_attempt"`
+	LastError   string                 `json:"last_error,omitempty"`
+
+	sending     bool // A retry is in progress
+	held        bool // Queued for a failed progress report; not sent while the item still plays
+	unreachable bool // The last attempt got no answer, rather than an error status
+}
+
+// asStopReport turns a progress report into the stop report sent in its
+// place, with the same PositionTicks
+func (e *queuedReport) asStopReport() {
+	if e.Endpoint != "/Sessions/Playing/Progress" {
+		return
+	}
+	e.Endpoint = "/Sessions/Playing/Stopped"
+	for _, field := range progressOnlyFields {
+		delete(e.Body, field)
+	}
+}
+
+// staleReason returns why a queued report must not overwrite what the
+// server stores for its item, or "" if it may be sent. The server's
+// position is compared with the one it stored when the report was queued,
+// which catches a newer position from another client even if that did not
+// update LastPlayedDate. LastPlayedDate comes from the server's clock, so it
+// only counts as later than the report with reportClockSkew allowed for.
+func (e *queuedReport) staleReason(data itemUserData) string {
+	if e.ServerPos != nil {
+		stored := data.PlaybackPositionTicks / 10000000
+		if math.Abs(stored-*e.ServerPos) > reportPositionTolerance {
+			return fmt.Sprintf("server position changed from %.1f to %.1f seconds after the report was queued", *e.ServerPos, stored)
+		}
+	}
+	if played, err := time.Parse(time.RFC3339Nano, data.LastPlayedDate); err == nil && played.After(e.QueuedAt.Add(reportClockSkew)) {
+		return "item was played again after the report was queued"
+	}
+	return ""
+}
+
+// reportRetryQueue keeps failed reports on disk and resends them with
+// exponential backoff. Only the newest report per item is kept, since
+// Jellyfin stores a single resume position per item.
+type reportRetryQueue struct {
+	mu      sync.Mutex
+	path    string
+	entries []*queuedReport
+	wake    chan struct{}
+}
+
+var reportQueue = &reportRetryQueue{wake: make(chan struct{}, 1)}
+
+// isRetryableStatus reports whether a failed HTTP status may succeed later.
+// Other 4xx responses (bad token, deleted item, ...) never will.
+func isRetryableStatus(code int) bool {
+	return code >= 500 || code == http.StatusRequestTimeout || code == http.StatusTooManyRequests
+}
+
+// start loads reports left over from the previous run and starts resending
+// them in the background
+func (q *reportRetryQueue) start(configDir string) {
+	q.mu.Lock()
+	q.path = filepath.Join(configDir, reportQueueFile)
+
+	data, err := os.ReadFile(q.path)
+	if err == nil {
+		if err := json.Unmarshal(data, &q.entries); err != nil {
+			log.Printf("Report queue: ignoring unreadable %s: %v", q.path, err)
+			q.entries = nil
+		}
+	} else if !os.IsNotExist(err) {
+		log.Printf("Report queue: failed to read %s: %v", q.path, err)
+	}
+
+	// Retry everything from the previous run right away. Older versions
+	// queued progress reports; their playback has ended, so they are sent
+	// as stop reports.
+	now := time.Now()
+	for _, e := range q.entries {
+		e.asStopReport()
+		e.NextAttempt = now
+	}
+	if len(q.entries) > 0 {
+		log.Printf("Report queue: %d report(s) pending from previous run", len(q.entries))
+	}
+	q.mu.Unlock()
+
+	go q.run()
+}
+
+// saveLocked writes the queue to disk, removing the file when it is empty.
+// The file holds access tokens, so it is only readable by the user.
+func (q *reportRetryQueue) saveLocked() {
+	if q.path == "" {
+		return
+	}
+	if len(q.entries) == 0 {
+		if err := os.Remove(q.path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Report queue: failed to remove %s: %v", q.path, err)
+		}
+		return
+	}
+	data, err := json.MarshalIndent(q.entries, "", "  ")
+	if err != nil {
+		log.Printf("Report queue: failed to encode: %v", err)
+		return
+	}
+	if err := os.WriteFile(q.path, data, 0600); err != nil {
+		log.Printf("Report queue: failed to write %s: %v", q.path, err)
+	}
+}
+
+// removeLocked drops the entries for which match returns true
+func (q *reportRetryQueue) removeLocked(match func(e *queuedReport) bool) int {
+	kept := q.entries[:0]
+	removed := 0
+	for _, e := range q.entries {
+		if match(e) {
+			removed++
+			continue
+		}
+		kept = append(kept, e)
+	}
+	q.entries = kept
+	return removed
+}
+
+// add queues a report, replacing any older report for the same item
+func (q *reportRetryQueue) add(r *queuedReport) {
+	r.asStopReport()
+	now := time.Now()
+	r.ID = strconv.FormatInt(now.UnixNano(), 36)
+	r.QueuedAt = now
+	r.NextAttempt = now.Add(reportRetryMin)
+
+	q.mu.Lock()
+	if n := q.removeLocked(func(e *queuedReport) bool {
+		return e.ServerURL == r.ServerURL && e.ItemId == r.ItemId
+	}); n > 0 {
+		debugLog("Report queue: replaced %d older report(s) for item %s", n, r.ItemId)
+	}
+	q.entries = append(q.entries, r)
+	q.saveLocked()
+	q.mu.Unlock()
+
+	log.Printf("Report queue: queued %s for item %s at %.1f seconds", r.Endpoint, r.ItemId, r.Position)
+	q.signal()
+}
+
+// supersede is called after a report for an item was delivered. Queued
+// reports for the item are older, so they are dropped. The server is
+// reachable again, so its reports that failed for lack of an answer are
+// retried now; those it answered with an error keep their backoff.
+func (q *reportRetryQueue) supersede(serverURL, itemId string) {
+	q.mu.Lock()
+	n := q.removeLocked(func(e *queuedReport) bool {
+		return e.ServerURL == serverURL && e.ItemId == itemId
+	})
+	due := false
+	now := time.Now()
+	for _, e := range q.entries {
+		if e.ServerURL == serverURL && e.unreachable && e.NextAttempt.After(now) {
+			e.NextAttempt = now
+			e.unreachable = false
+			due = true
+		}
+	}
+	if n > 0 {
+		log.Printf("Report queue: dropped %d report(s) for item %s superseded by a newer report", n, itemId)
+		q.saveLocked()
+	}
+	q.mu.Unlock()
+
+	if due {
+		q.signal()
+	}
+}
+
+// release lets the held report of an item be sent, once the item stopped
+// playing without a stop report that replaced or superseded it
+func (q *reportRetryQueue) release(serverURL, itemId string) {
+	released := false
+	q.mu.Lock()
+	for _, e := range q.entries {
+		if e.held && e.ServerURL == serverURL && e.ItemId == itemId {
+			e.held = false
+			e.NextAttempt = time.Now()
+			released = true
+		}
+	}
+	q.mu.Unlock()
+
+	if released {
+		q.signal()
+	}
+}
+
+// flushItem immediately sends the queued report for an item, if any
+func (q *reportRetryQueue) flushItem(serverURL, itemId string) {
+	q.mu.Lock()
+	var pending []*queuedReport
+	for _, e := range q.entries {
+		if !e.held && e.ServerURL == serverURL && e.ItemId == itemId {
+			pending = append(pending, e)
+		}
+	}
+	q.mu.Unlock()
+
+	for _, e := range pending {
+		q.retry(e)
+	}
+}
+
+// snapshot returns copies of the queued reports
+func (q *reportRetryQueue) snapshot() []queuedReport {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	out := make([]queuedReport, 0, len(q.entries))
+	for _, e := range q.entries {
+		out = append(out, *e)
+	}
+	return out
+}
+
+func (q *reportRetryQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run resends reports as they become due
+func (q *reportRetryQueue) run() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+		case <-q.wake:
+		}
+
+		now := time.Now()
+		var due []*queuedReport
+
+		q.mu.Lock()
+		if n := q.removeLocked(func(e *queuedReport) bool {
+			return now.Sub(e.QueuedAt) > reportQueueMaxAge
+		}); n > 0 {
+			log.Printf("Report queue: dropped %d report(s) older than %v", n, reportQueueMaxAge)
+			q.saveLocked()
+		}
+		for _, e := range q.entries {
+			if !e.held && !e.NextAttempt.After(now) {
+				due = append(due, e)
+			}
+		}
+		q.mu.Unlock()
+
+		for _, e := range due {
+			q.retry(e)
+		}
+
+		var next time.Duration
+		pending := false
+		q.mu.Lock()
+		for _, e := range q.entries {
+			if e.held {
+				continue
+			}
+			if d := time.Until(e.NextAttempt); !pending || d < next {
+				next, pending = d, true
+			}
+		}
+		q.mu.Unlock()
+		// An entry may still be in flight from flushItem; don't spin on it
+		if next < time.Second {
+			next = time.Second
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if pending {
+			timer.Reset(next)
+		}
+	}
+}
+
+// retry sends one queued report. It is dropped when delivered, when the
+// server rejects it for good, or when the item was played again after the
+// report was queued (on any device, see staleReason), so a stale position
+// never overwrites a newer one. Otherwise the next attempt is scheduled
+// with backoff.
+func (q *reportRetryQueue) retry(e *queuedReport) {
+	q.mu.Lock()
+	if e.sending {
+		q.mu.Unlock()
+		return
+	}
+	e.sending = true
+	q.mu.Unlock()
+	defer func() {
+		q.mu.Lock()
+		e.sending = false
+		q.mu.Unlock()
+	}()
+
+	drop := func(reason string) {
+		q.mu.Lock()
+		if q.removeLocked(func(x *queuedReport) bool { return x == e }) > 0 {
+			log.Printf("Report queue: %s for item %s %s", e.Endpoint, e.ItemId, reason)
+			q.saveLocked()
+		}
+		q.mu.Unlock()
+	}
+	fail := func(reason string, unreachable bool) {
+		q.mu.Lock()
+		e.Attempts++
+		e.LastError = reason
+		e.unreachable = unreachable
+		backoff := reportRetryMin << uint(min(e.Attempts-1, 16))
+		if backoff > reportRetryMax {
+			backoff = reportRetryMax
+		}
+		e.NextAttempt = time.Now().Add(backoff)
+		q.saveLocked()
+		q.mu.Unlock()
+		debugLog("Report queue: %s for item %s failed (%s), next attempt in %v", e.Endpoint, e.ItemId, reason, backoff)
+	}
+
+	if e.UserId != "" {
+		data, code, err := getUserData(e.ServerURL, e.UserId, e.Token, e.ItemId)
+		switch {
+		case err != nil && (code == 0 || isRetryableStatus(code)):
+			fail(err.Error(), code == 0)
+			return
+		case err != nil:
+			drop("dropped: " + err.Error())
+			return
+		}
+		if reason := e.staleReason(data); reason != "" {
+			drop("dropped: " + reason)
+			return
+		}
+	}
+
+	code, respBody, err := postEmbySession(e.ServerURL, e.Token, e.Endpoint, e.Body)
+	switch {
+	case err != nil:
+		fail(err.Error(), true)
+		return
+	case isRetryableStatus(code):
+		fail("server returned "+strconv.Itoa(code), false)
+		return
+	case code < 200 || code >= 300:
+		drop("rejected by server (" + strconv.Itoa(code) + "): " + string(respBody))
+		return
+	}
+
+	drop("delivered (position " + strconv.FormatFloat(e.Position, 'f', 1, 64) + " seconds)")
+	if e.MarkPlayed {
+		markPlayed(e.ServerURL, e.UserId, e.Token, e.ItemId)
+	}
+}
+
+// reportQueueHandler returns the reports waiting to be resent
+func reportQueueHandler(w http.ResponseWriter, r *http.Request) {
+	entries := reportQueue.snapshot()
+	reports := make([]map[string]interface{}, 0, len(entries))
+	for _, e := range entries {
+		// Never expose the access token
+		reports = append(reports, map[string]interface{}{
+			"id":          e.ID,
+			"endpoint":    e.Endpoint,
+			"serverUrl":   e.ServerURL,
+			"itemId":      e.ItemId,
+			"position":    e.Position,
+			"markPlayed":  e.MarkPlayed,
+			"held":        e.held,
+			"queuedAt":    e.QueuedAt,
+			"attempts":    e.Attempts,
+			"nextAttempt": e.NextAttempt,
+			"lastError":   e.LastError,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"pending": len(reports),
+		"reports": reports,
+	})
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Jellyfin media segment types, in the order shown on the config page
+var segmentTypes = []string{"Intro", "Recap", "Preview", "Outro", "Commercial"}
+
+// What to do when playback enters a media segment
+const (
+	segmentActionOff    = "off"
+	segmentActionSkip   = "skip"   // Seek past the segment
+	segmentActionPrompt = "prompt" // Show an OSD prompt; the skip key seeks past it
+)
+
+const (
+	// mpv key name that skips a prompted segment
+	defaultSkipKey = "TAB"
+	// How often the position is checked against the segments
+	segmentPollInterval = 500 * time.Millisecond
+	// Longest time a skip prompt stays on screen
+	segmentPromptMax = 8 * time.Second
+)
+
+// mediaSegment is one entry of /MediaSegments/{itemId}
+type mediaSegment struct {
+	Type       string `json:"Type"`
+	StartTicks int64  `json:"StartTicks"`
+	EndTicks   int64  `json:"EndTicks"`
+}
+
+func (s mediaSegment) start() float64 { return float64(s.StartTicks) / 10000000 }
+func (s mediaSegment) end() float64   { return float64(s.EndTicks) / 10000000 }
+
+// segmentController is implemented by players that can act on media segments
+type segmentController interface {
+	// Seek jumps to position seconds
+	Seek(position float64) error
+	// ShowSkipPrompt shows text on screen for d and binds key so pressing it
+	// publishes a playerEventSkip event, until HideSkipPrompt is called
+	ShowSkipPrompt(text, key string, d time.Duration) error
+	// HideSkipPrompt removes the prompt and its key binding
+	HideSkipPrompt() error
+}
+
+// getSegmentActions returns the configured action per segment type and the
+// skip key. Segment types without an action are left alone, so nothing is
+// skipped or prompted for until it is turned on.
+func getSegmentActions() (map[string]string, string) {
+	configMu.RLock()
+	defer configMu.RUnlock()
+
+	actions := make(map[string]string, len(config.SegmentActions))
+	for t, a := range config.SegmentActions {
+		actions[t] = a
+	}
+
+	key := config.SkipKey
+	if key == "" {
+		key = defaultSkipKey
+	}
+	return actions, key
+}
+
+// getMediaSegments fetches the media segments of an item. Servers older than
+// Jellyfin 10.10 do not have the endpoint and return 404.
+func getMediaSegments(serverURL, token, itemId string) ([]mediaSegment, error) {
+	apiURL := fmt.Sprintf("%s/MediaSegments/%s", serverURL, url.PathEscape(itemId))
+
+	req, err := http.NewRequest("GET", apiURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Emby-Token", token)
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("server returned %d", resp.StatusCode)
+	}
+
+	var data struct {
+		Items []mediaSegment `json:"Items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %v", err)
+	}
+	return data.Items, nil
+}
+
+// runSegmentSkipper skips or prompts for the media segments of the current
+// item while the player of a session runs. The segments are fetched again
+// whenever the playlist moves to another item. It returns when done is closed.
+func runSegmentSkipper(s *playerSession, done <-chan struct{}) {
+	ctl, ok := s.player.(segmentController)
+	if !ok {
+		debugLog("Media segments: player cannot seek or show prompts, not skipping segments")
+		return
+	}
+
+	actions, key := getSegmentActions()
+	enabled := false
+	for _, a := range actions {
+		if a == segmentActionSkip || a == segmentActionPrompt {
+			enabled = true
+		}
+	}
+	if !enabled {
+		return
+	}
+
+	events, unsubscribe := s.player.Subscribe()
+	defer unsubscribe()
+
+	ticker := time.NewTicker(segmentPollInterval)
+	defer ticker.Stop()
+
+	var (
+		itemId   string
+		segments []mediaSegment
+		handled  map[int]bool // Segments already skipped or prompted for
+		prompted = -1         // Index of the segment with a prompt on screen
+	)
+
+	for {
+		skipPressed := false
+
+		select {
+		case <-done:
+			return
+
+		case <-ticker.C:
+
+		case ev, ok := <-events:
+			if !ok {
+				events = nil // Control interface closed; wait for the process to exit
+				continue
+			}
+			if ev.Type != playerEventSkip {
+				continue
+			}
+			skipPressed = true
+		}
+
+		sess := s.current()
+		serverURL := s.serverURL
+		token := s.token
+		if sess == nil {
+			continue
+		}
+
+		// New item: fetch its segments
+		if sess.ItemId != itemId {
+			itemId = sess.ItemId
+			segments = nil
+			handled = map[int]bool{}
+			if prompted >= 0 {
+				ctl.HideSkipPrompt()
+				prompted = -1
+			}
+			if itemId != "" && serverURL != "" && token != "" {
+				all, err := getMediaSegments(serverURL, token, itemId)
+				if err != nil {
+					debugLog("Media segments: not available for item %s: %v", itemId, err)
+				}
+				for _, seg := range all {
+					if a := actions[seg.Type]; (a == segmentActionSkip || a == segmentActionPrompt) && seg.EndTicks > seg.StartTicks {
+						segments = append(segments, seg)
+					}
+				}
+				if len(segments) > 0 {
+					log.Printf("Media segments: %d to act on for item %s", len(segments), itemId)
+				}
+			}
+		}
+		if len(segments) == 0 {
+			continue
+		}
+
+		status, err := s.player.Status()
+		if err != nil {
+			continue
+		}
+		pos := status.Position
+
+		if prompted >= 0 {
+			seg := segments[prompted]
+			switch {
+			case skipPressed:
+				log.Printf("Media segments: skipping %s to %.1f seconds (key pressed)", seg.Type, seg.end())
+				ctl.HideSkipPrompt()
+				if err := ctl.Seek(seg.end()); err != nil {
+					log.Printf("Media segments: seek failed: %v", err)
+				}
+				prompted = -1
+				continue
+			case pos < seg.start() || pos >= seg.end():
+				ctl.HideSkipPrompt()
+				prompted = -1
+			}
+		}
+
+		for i, seg := range segments {
+			// Ignore the last second so a seek to the end doesn't trigger again
+			if handled[i] || pos < seg.start() || pos >= seg.end()-1 {
+				continue
+			}
+			// Each segment is acted on once per item, so seeking back into
+			// it plays it normally
+			handled[i] = true
+
+			switch actions[seg.Type] {
+			case segmentActionSkip:
+				log.Printf("Media segments: skipping %s to %.1f seconds", seg.Type, seg.end())
+				if err := ctl.Seek(seg.end()); err != nil {
+					log.Printf("Media segments: seek failed: %v", err)
+				}
+			case segmentActionPrompt:
+				d := time.Duration((seg.end() - pos) * float64(time.Second))
+				if d > segmentPromptMax {
+					d = segmentPromptMax
+				}
+				debugLog("Media segments: prompting to skip %s", seg.Type)
+				if err := ctl.ShowSkipPrompt(fmt.Sprintf("Skip %s: press %s", seg.Type, key), key, d); err != nil {
+					log.Printf("Media segments: failed to show prompt: %v", err)
+					continue
+				}
+				prompted = i
+			}
+			break
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// Jellyfin play methods
+const (
+	playMethodDirectPlay   = "DirectPlay"   // Player opens the media file itself (mapped path)
+	playMethodDirectStream = "DirectStream" // Player streams the original file from the server
+)
+
+// playbackSession holds the values that identify one launched item to
+// Jellyfin. They are fixed when the item starts and sent unchanged in its
+// start, progress and stop reports, so Jellyfin sees a single session.
+type playbackSession struct {
+	PlaySessionId       string
+	ItemId              string
+	MediaSourceId       string
+	AudioStreamIndex    *int
+	SubtitleStreamIndex *int
+	PlayMethod          string
+
+	// Position of the last delivered progress report, which the server now
+	// stores for the item; nil until one is delivered. Guarded by the
+	// playerSession's mu.
+	serverPosition *float64
+}
+
+// newPlaybackSession creates a session with a fresh PlaySessionId for an item
+func newPlaybackSession(itemId, mediaSourceId, playMethod string) *playbackSession {
+	// Single-version items use the item ID as their media source ID
+	if mediaSourceId == "" {
+		mediaSourceId = itemId
+	}
+	if playMethod == "" {
+		playMethod = playMethodDirectPlay
+	}
+	return &playbackSession{
+		PlaySessionId: newPlaySessionId(),
+		ItemId:        itemId,
+		MediaSourceId: mediaSourceId,
+		PlayMethod:    playMethod,
+	}
+}
+
+// withStreams records the Jellyfin audio and subtitle stream indexes the
+// item plays with (nil if the player picks)
+func (s *playbackSession) withStreams(audioIndex, subtitleIndex *int) *playbackSession {
+	s.AudioStreamIndex = audioIndex
+	s.SubtitleStreamIndex = subtitleIndex
+	return s
+}
+
+// newPlaySessionId returns a random 32-character hex ID, like the ones
+// Jellyfin's own clients use
+func newPlaySessionId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("jellyfin-external-player-%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// reportBody returns the fields shared by every report for this session
+func (s *playbackSession) reportBody() map[string]interface{} {
+	body := map[string]interface{}{
+		"ItemId":        s.ItemId,
+		"MediaSourceId": s.MediaSourceId,
+		"PlaySessionId": s.PlaySessionId,
+		"PlayMethod":    s.PlayMethod,
+		"CanSeek":       true,
+	}
+	if s.AudioStreamIndex != nil {
+		body["AudioStreamIndex"] = *s.AudioStreamIndex
+	}
+	if s.SubtitleStreamIndex != nil {
+		body["SubtitleStreamIndex"] = *s.SubtitleStreamIndex
+	}
+	return body
+}
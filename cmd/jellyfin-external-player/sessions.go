@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// What a play request does while a player is running
+const (
+	instancePolicyReplace = "replace" // Quit the running player and start a new one
+	instancePolicyEnqueue = "enqueue" // Add the items to the running playlist
+	instancePolicyReject  = "reject"  // Refuse the request
+)
+
+var instancePolicies = []string{instancePolicyReplace, instancePolicyEnqueue, instancePolicyReject}
+
+// How long a replaced player gets to quit and report its stop before it is
+// killed, and again before the new one starts anyway
+const playerStopTimeout = 5 * time.Second
+
+var errPlayerBusy = errors.New("a player is already running")
+
+// playerSession is one running player process and the state of what it
+// plays. Each has its own control interface, playlist and Jellyfin
+// credentials, so players on different displays, or a process that is being
+// replaced, keep reporting their own items until they exit.
+type playerSession struct {
+	ID      string
+	Display string // Display profile it plays on ("" = the player's own args only)
+	seq     int
+	cmd     *exec.Cmd
+	player  Player
+	subs    *subtitleCache // Subtitles downloaded for the playlist
+	paths   *pathChecker   // Checks the mapped files of the playlist
+	// Jellyfin server and user the reports go to
+	serverURL string
+	userId    string
+	token     string
+	// Closed once the process has exited and its last item is reported stopped
+	exited chan struct{}
+
+	mu               sync.Mutex
+	playback         *playbackSession // Jellyfin session for the item currently playing
+	lastPosition     float64          // Last known playback position in seconds
+	positionKnown    bool             // lastPosition was reported by the player, not the start offset
+	videoDuration    float64          // Total video duration in seconds
+	playlist         []PlaylistItem
+	playlistPosition int  // Current position in playlist (0-indexed)
+	playlistJumped   bool // The queue API jumped away from the current entry
+}
+
+// current returns the Jellyfin session of the item playing, or nil
+func (s *playerSession) current() *playbackSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.playback
+}
+
+// sessionRegistry keeps the running player sessions by ID
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*playerSession
+	seq      int
+}
+
+var sessions = &sessionRegistry{sessions: map[string]*playerSession{}}
+
+// startMu serializes starting players, so concurrent play requests apply
+// the instance policy one after another
+var startMu sync.Mutex
+
+// newID returns the ID for the next session
+func (r *sessionRegistry) newID() (string, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seq++
+	return strconv.Itoa(r.seq), r.seq
+}
+
+func (r *sessionRegistry) add(s *playerSession) {
+	r.mu.Lock()
+	r.sessions[s.ID] = s
+	r.mu.Unlock()
+}
+
+func (r *sessionRegistry) remove(s *playerSession) {
+	r.mu.Lock()
+	if r.sessions[s.ID] == s {
+		delete(r.sessions, s.ID)
+	}
+	r.mu.Unlock()
+}
+
+// get returns a session by ID. An empty ID selects the most recently
+// started session. It returns nil if there is none.
+func (r *sessionRegistry) get(id string) *playerSession {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if id != "" {
+		return r.sessions[id]
+	}
+	var latest *playerSession
+	for _, s := range r.sessions {
+		if latest == nil || s.seq > latest.seq {
+			latest = s
+		}
+	}
+	return latest
+}
+
+// onDisplay returns the most recently started session on a display, or nil
+func (r *sessionRegistry) onDisplay(display string) *playerSession {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var latest *playerSession
+	for _, s := range r.sessions {
+		if s.Display == display && (latest == nil || s.seq > latest.seq) {
+			latest = s
+		}
+	}
+	return latest
+}
+
+// list returns the sessions in the order they were started
+func (r *sessionRegistry) list() []*playerSession {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := make([]*playerSession, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].seq < list[j].seq })
+	return list
+}
+
+// isDisplay reports whether a display profile exists. The empty name is the
+// default display, which adds no args.
+func isDisplay(name string) bool {
+	if name == "" {
+		return true
+	}
+	configMu.RLock()
+	defer configMu.RUnlock()
+	_, ok := config.Displays[name]
+	return ok
+}
+
+// getInstancePolicy returns what a play request does while a player runs
+func getInstancePolicy() string {
+	configMu.RLock()
+	defer configMu.RUnlock()
+
+	switch config.InstancePolicy {
+	case instancePolicyEnqueue, instancePolicyReject:
+		return config.InstancePolicy
+	}
+	return instancePolicyReplace
+}
+
+// startWithPolicy plays the items of req on its display, following the
+// instance policy if a player is running there. Players on other displays
+// are left alone. It returns the session that plays the items, and true if
+// they were added to its running playlist instead of starting a player.
+func startWithPolicy(req PlaylistRequest) (*playerSession, bool, error) {
+	startMu.Lock()
+	defer startMu.Unlock()
+
+	running := sessions.onDisplay(req.Display)
+	if running == nil {
+		s, err := startPlaylist(req)
+		return s, false, err
+	}
+
+	switch getInstancePolicy() {
+	case instancePolicyReject:
+		return nil, false, errPlayerBusy
+	case instancePolicyEnqueue:
+		if running.serverURL != req.ServerURL {
+			log.Printf("Play: session %s plays from another server, replacing it", running.ID)
+			break
+		}
+		err := queueAdd(running, req.Items, false)
+		if err == nil {
+			log.Printf("Play: added %d item(s) to session %s", len(req.Items), running.ID)
+			return running, true, nil
+		}
+		if err != errQueueUnsupported && err != errNothingPlaying {
+			return nil, false, err
+		}
+		log.Printf("Play: cannot add to session %s (%v), replacing it", running.ID, err)
+	}
+
+	replacePlayer(running)
+	s, err := startPlaylist(req)
+	return s, false, err
+}
+
+// replacePlayer quits a running player and waits until it has reported its
+// stop, so the reports of the old and the new item do not overlap
+func replacePlayer(s *playerSession) {
+	log.Printf("Replacing player session %s", s.ID)
+	stopPlayer(s)
+
+	select {
+	case <-s.exited:
+		return
+	case <-time.After(playerStopTimeout):
+	}
+
+	log.Printf("Player session %s did not quit in time, killing it", s.ID)
+	if s.cmd.Process != nil {
+		s.cmd.Process.Kill()
+	}
+	select {
+	case <-s.exited:
+	case <-time.After(playerStopTimeout):
+		log.Printf("Player session %s has not exited, starting the new player anyway", s.ID)
+	}
+}
+
+// sessionsHandler lists the running player sessions and the display
+// profiles they can be started on
+func sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	list := sessions.list()
+	result := make([]map[string]interface{}, 0, len(list))
+	for _, s := range list {
+		s.mu.Lock()
+		var itemId, title string
+		if s.playback != nil {
+			itemId = s.playback.ItemId
+		}
+		if s.playlistPosition < len(s.playlist) {
+			title = s.playlist[s.playlistPosition].Title
+		}
+		entry := map[string]interface{}{
+			"session":          s.ID,
+			"display":          s.Display,
+			"serverUrl":        s.serverURL,
+			"itemId":           itemId,
+			"title":            title,
+			"position":         s.lastPosition,
+			"duration":         s.videoDuration,
+			"playlistPosition": s.playlistPosition,
+			"playlistLength":   len(s.playlist),
+		}
+		s.mu.Unlock()
+		result = append(result, entry)
+	}
+
+	configMu.RLock()
+	displays := make([]string, 0, len(config.Displays))
+	for name := range config.Displays {
+		displays = append(displays, name)
+	}
+	configMu.RUnlock()
+	sort.Strings(displays)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"sessions": result,
+		"displays": displays,
+	})
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// File extension to request external subtitles in, by Jellyfin codec.
+// Other text formats are converted to SRT by the server.
+var subtitleFormats = map[string]string{
+	"subrip": "srt",
+	"srt":    "srt",
+	"ass":    "ass",
+	"ssa":    "ssa",
+	"webvtt": "vtt",
+	"vtt":    "vtt",
+}
+
+// Image-based subtitle codecs, which the server cannot deliver as files
+var imageSubtitleCodecs = map[string]bool{
+	"pgssub": true,
+	"dvdsub": true,
+	"dvbsub": true,
+	"vobsub": true,
+}
+
+// Characters other than these are dropped from file names built from
+// server data
+var unsafeFileNameChars = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// safeFileName returns s with only letters, digits, '_' and '-'
+func safeFileName(s string) string {
+	return unsafeFileNameChars.ReplaceAllString(s, "")
+}
+
+// subtitleCache is a temporary directory holding the external subtitles
+// downloaded for one player launch. It is created on first use and removed
+// with cleanup once the player exits; downloads still under way then fail.
+type subtitleCache struct {
+	mu     sync.Mutex
+	dir    string
+	closed bool
+}
+
+// path returns the cache directory, creating it if needed
+func (c *subtitleCache) path() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return "", fmt.Errorf("player has exited")
+	}
+	if c.dir == "" {
+		dir, err := os.MkdirTemp("", "jellyfin-external-player-subs-")
+		if err != nil {
+			return "", err
+		}
+		c.dir = dir
+	}
+	return c.dir, nil
+}
+
+// cleanup removes the cache directory and everything in it
+func (c *subtitleCache) cleanup() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	dir := c.dir
+	c.dir = ""
+	c.closed = true
+	c.mu.Unlock()
+
+	if dir == "" {
+		return
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		log.Printf("Subtitles: failed to remove cache %s: %v", dir, err)
+		return
+	}
+	debugLog("Subtitles: removed cache %s", dir)
+}
+
+// download fetches the external text subtitles of a streamed item from the
+// server and returns their local paths by stream index
+func (c *subtitleCache) download(serverURL, token string, item PlaylistItem, streams []mediaStream) map[int]string {
+	files := map[int]string{}
+	if c == nil {
+		return files
+	}
+
+	mediaSourceId := item.MediaSourceId
+	if mediaSourceId == "" {
+		mediaSourceId = item.ItemId
+	}
+
+	for _, s := range streams {
+		if s.Type != "Subtitle" || !s.IsExternal {
+			continue
+		}
+		codec := strings.ToLower(s.Codec)
+		if imageSubtitleCodecs[codec] {
+			debugLog("Subtitles: skipping image subtitle %d (%s) of item %s", s.Index, codec, item.ItemId)
+			continue
+		}
+		ext := subtitleFormats[codec]
+		if ext == "" {
+			ext = "srt"
+		}
+
+		apiURL := serverURL + s.DeliveryUrl
+		if s.DeliveryUrl == "" {
+			apiURL = fmt.Sprintf("%s/Videos/%s/%s/Subtitles/%d/Stream.%s",
+				serverURL, url.PathEscape(item.ItemId), url.PathEscape(mediaSourceId), s.Index, ext)
+		}
+
+		dir, err := c.path()
+		if err != nil {
+			log.Printf("Subtitles: failed to create cache directory: %v", err)
+			return files
+		}
+		// The language in the name lets players label the track. The item
+		// ID and language come from the server, so only safe characters
+		// are kept.
+		name := fmt.Sprintf("%s.%d", safeFileName(item.ItemId), s.Index)
+		if lang := safeFileName(s.Language); lang != "" {
+			name += "." + lang
+		}
+		dest := filepath.Join(dir, name+"."+ext)
+		if rel, err := filepath.Rel(dir, dest); err != nil || rel != filepath.Base(dest) {
+			log.Printf("Subtitles: refusing to write subtitle %d of item %s outside %s", s.Index, item.ItemId, dir)
+			continue
+		}
+
+		if err := downloadFile(apiURL, token, dest); err != nil {
+			log.Printf("Subtitles: failed to download subtitle %d of item %s: %v", s.Index, item.ItemId, err)
+			continue
+		}
+		debugLog("Subtitles: downloaded subtitle %d of item %s to %s", s.Index, item.ItemId, dest)
+		files[s.Index] = dest
+	}
+
+	if len(files) > 0 {
+		log.Printf("Subtitles: downloaded %d external subtitle(s) for item %s", len(files), item.ItemId)
+	}
+	return files
+}
+
+// downloadFile saves the response of an authenticated GET to dest
+func downloadFile(apiURL, token, dest string) error {
+	req, err := http.NewRequest("GET", apiURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Emby-Token", token)
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("server returned %d", resp.StatusCode)
+	}
+
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		os.Remove(dest)
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// mediaStream is the subset of a Jellyfin MediaStream that we use
+type mediaStream struct {
+	Index       int    `json:"Index"`
+	Type        string `json:"Type"` // "Video", "Audio", "Subtitle", ...
+	Language    string `json:"Language"`
+	Codec       string `json:"Codec"`
+	IsExternal  bool   `json:"IsExternal"`
+	Path        string `json:"Path"`        // Server-side path of external streams
+	DeliveryUrl string `json:"DeliveryUrl"` // Server-relative URL of external subtitles
+}
+
+// parseStreamIndex parses an optional Jellyfin stream index parameter
+func parseStreamIndex(s string) *int {
+	if s == "" {
+		return nil
+	}
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		log.Printf("Ignoring invalid stream index %q", s)
+		return nil
+	}
+	return &i
+}
+
+// getMediaStreams returns the streams of one of an item's media sources,
+// or of its first one if mediaSourceId is empty
+func getMediaStreams(serverURL, userId, token, itemId, mediaSourceId string) ([]mediaStream, error) {
+	apiURL := fmt.Sprintf("%s/Users/%s/Items/%s", serverURL, userId, url.PathEscape(itemId))
+
+	req, err := http.NewRequest("GET", apiURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Emby-Token", token)
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("server returned %d", resp.StatusCode)
+	}
+
+	var data struct {
+		MediaSources []struct {
+			Id           string        `json:"Id"`
+			MediaStreams []mediaStream `json:"MediaStreams"`
+		} `json:"MediaSources"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %v", err)
+	}
+
+	for _, src := range data.MediaSources {
+		if mediaSourceId == "" || src.Id == mediaSourceId {
+			return src.MediaStreams, nil
+		}
+	}
+	return nil, fmt.Errorf("media source %q not found", mediaSourceId)
+}
+
+// embeddedStreams returns the streams of a type that are inside the media
+// file, in the order players number them
+func embeddedStreams(streams []mediaStream, streamType string) []mediaStream {
+	var out []mediaStream
+	for _, s := range streams {
+		if s.Type == streamType && !s.IsExternal {
+			out = append(out, s)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Index < out[j].Index })
+	return out
+}
+
+// resolveTracks maps Jellyfin stream indexes to player track numbers.
+// external maps the index of each external subtitle the player can open to
+// its local path; these are loaded as separate files, which players number
+// after the embedded subtitles. A subtitle index of -1 turns subtitles off.
+func resolveTracks(streams []mediaStream, audioIndex, subtitleIndex *int, external map[int]string) trackSelection {
+	var sel trackSelection
+
+	if audioIndex != nil {
+		for i, s := range embeddedStreams(streams, "Audio") {
+			if s.Index == *audioIndex {
+				sel.Audio = i + 1
+			}
+		}
+		if sel.Audio == 0 {
+			log.Printf("Audio stream %d not found, using player default", *audioIndex)
+		}
+	}
+
+	embedded := embeddedStreams(streams, "Subtitle")
+	sel.EmbeddedSubtitles = len(embedded)
+
+	// External subtitles are loaded in stream order
+	var externalIndexes []int
+	for index := range external {
+		externalIndexes = append(externalIndexes, index)
+	}
+	sort.Ints(externalIndexes)
+	for _, index := range externalIndexes {
+		sel.SubtitleFiles = append(sel.SubtitleFiles, external[index])
+	}
+
+	if subtitleIndex == nil {
+		return sel
+	}
+	if *subtitleIndex < 0 {
+		sel.Subtitle = -1
+		return sel
+	}
+
+	for i, s := range embedded {
+		if s.Index == *subtitleIndex {
+			sel.Subtitle = i + 1
+			return sel
+		}
+	}
+	for i, index := range externalIndexes {
+		if index == *subtitleIndex {
+			sel.Subtitle = len(embedded) + i + 1
+			return sel
+		}
+	}
+	log.Printf("Subtitle stream %d not available, using player default", *subtitleIndex)
+	return sel
+}
+
+// selectTracks looks up an item's streams and resolves its requested stream
+// indexes. When the item is streamed, its external subtitles are downloaded
+// into subs so the player can load them; otherwise a selected external
+// subtitle is opened through the path mappings. If there is nothing to do,
+// nothing is fetched and the player defaults apply.
+func selectTracks(serverURL, userId, token string, item PlaylistItem, subs *subtitleCache) trackSelection {
+	streaming := item.playMethod == playMethodDirectStream
+	audioIndex, subtitleIndex := item.AudioStreamIndex, item.SubtitleStreamIndex
+
+	if !tracksNeedLookup(item) {
+		if subtitleIndex != nil && *subtitleIndex < 0 {
+			return trackSelection{Subtitle: -1}
+		}
+		return trackSelection{}
+	}
+	if serverURL == "" || userId == "" || token == "" || item.ItemId == "" {
+		log.Printf("Track selection: skipping (no credentials)")
+		return trackSelection{}
+	}
+
+	streams, err := getMediaStreams(serverURL, userId, token, item.ItemId, item.MediaSourceId)
+	if err != nil {
+		log.Printf("Track selection: failed to get streams of item %s: %v", item.ItemId, err)
+		return trackSelection{}
+	}
+
+	external := map[int]string{}
+	if streaming {
+		external = subs.download(serverURL, token, item, streams)
+	} else if subtitleIndex != nil {
+		for _, s := range streams {
+			if s.Index != *subtitleIndex || s.Type != "Subtitle" || !s.IsExternal {
+				continue
+			}
+			translated, ok := translatePath(s.Path, mappingScope{ServerURL: serverURL, Library: item.library})
+			if !ok {
+				log.Printf("External subtitle %s has no path mapping", s.Path)
+				continue
+			}
+			configMu.RLock()
+			if config.URLEncode {
+				translated = url.PathEscape(translated)
+			}
+			configMu.RUnlock()
+			external[s.Index] = translated
+		}
+	}
+
+	sel := resolveTracks(streams, audioIndex, subtitleIndex, external)
+	debugLog("Track selection for item %s: audio %d, subtitle %d, %d subtitle file(s)",
+		item.ItemId, sel.Audio, sel.Subtitle, len(sel.SubtitleFiles))
+	return sel
+}
+
+// tracksNeedLookup reports whether selectTracks has to ask the server about
+// the streams of an item: it is streamed, or has an audio track or subtitle
+// picked other than subtitles off
+func tracksNeedLookup(item PlaylistItem) bool {
+	audioIndex, subtitleIndex := item.AudioStreamIndex, item.SubtitleStreamIndex
+	if audioIndex == nil && subtitleIndex == nil && item.playMethod != playMethodDirectStream {
+		return false
+	}
+	return !(subtitleIndex != nil && *subtitleIndex < 0 && audioIndex == nil)
+}
+
+// lateTracks is the track selection of a playlist entry that is looked up
+// after the player has started, so a long playlist does not hold up the
+// launch. It is resolved once, by the background lookup or by the entry
+// starting to play, whichever comes first.
+type lateTracks struct {
+	once sync.Once
+	sel  trackSelection
+}
+
+// resolve looks up the tracks of item, or waits for the lookup under way
+func (t *lateTracks) resolve(s *playerSession, item PlaylistItem) trackSelection {
+	t.once.Do(func() {
+		t.sel = selectTracks(s.serverURL, s.userId, s.token, item, s.subs)
+	})
+	return t.sel
+}
+
+// resolveLateTracks checks the mapped files and looks up the tracks of the
+// entries of a session that were launched without them, in playlist order,
+// until done is closed. An entry replaced after its check is added with its
+// tracks.
+func resolveLateTracks(s *playerSession, done <-chan struct{}) {
+	s.mu.Lock()
+	plist := s.playlist
+	s.mu.Unlock()
+
+	for _, item := range plist {
+		if item.late == nil && item.unchecked == nil {
+			continue
+		}
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if item.unchecked != nil && checkLatePath(s, item) {
+			continue
+		}
+		if item.late != nil {
+			item.late.resolve(s, item)
+		}
+	}
+}
+
+// applyLateTracks hands the player the tracks of the entry at index once its
+// file has loaded. Players that cannot take them keep their defaults.
+func applyLateTracks(s *playerSession, index int, item PlaylistItem) {
+	applier, ok := s.player.(trackApplier)
+	if !ok {
+		return
+	}
+	sel := item.late.resolve(s, item)
+	if pos, err := s.player.PlaylistIndex(); err != nil || pos != index {
+		return // Moved on while the tracks were looked up
+	}
+	if err := applier.ApplyTracks(sel); err != nil {
+		log.Printf("Track selection: failed to apply the tracks of entry %d: %v", index, err)
+		return
+	}
+	debugLog("Track selection: applied the tracks of entry %d", index)
+}
@@ -7,16 +7,24 @@
     const KIOSK_SERVER = '{{KIOSK_SERVER}}';
     const DEBUG = {{DEBUG}};
     const SCRIPT_VERSION = '{{SCRIPT_VERSION}}';
+    const API_SECRET = '{{API_SECRET}}'; // Set when loaded by the userscript stub
     const PREF_KEY_PREFIX = 'jellyfin-external-player-';
 
     function debugLog(...args) {
         if (DEBUG) console.log('JF External Player:', ...args);
     }
 
+    // Fetch from the local server, which refuses requests without the
+    // API secret
+    function localFetch(url, options = {}) {
+        const headers = Object.assign({}, options.headers, { '{{API_SECRET_HEADER}}': API_SECRET });
+        return fetch(url, Object.assign({}, options, { headers: headers }));
+    }
+
     // Check if script is outdated and notify user
     async function checkScriptVersion() {
         try {
-            const resp = await fetch(KIOSK_SERVER + '/api/script-version');
+            const resp = await localFetch(KIOSK_SERVER + '/api/script-version');
             const data = await resp.json();
             if (data.version && data.version !== SCRIPT_VERSION) {
                 alert('External player script is outdated. Please refresh the page to get the latest version.');
@@ -34,10 +42,13 @@
     let modalElement = null;
     let statusElement = null;
     let pollInterval = null;
+    let eventSource = null; // Event stream of the player session, replaces polling
     let currentItemId = null;
+    let currentSession = null; // Player session started from this page
     let lastKnownPosition = 0;
     let lastKnownDuration = 0;
     let bypassUntil = 0; // Timestamp until which we should not intercept
+    let registeredCredentials = null; // Server and token last sent to the local server
 
     // Create and show the modal overlay
     function showModal(message) {
@@ -78,6 +89,30 @@
                     color: #aaa;
                     margin-bottom: 30px;
                 }
+                #jellyfin-external-player-modal .modal-controls {
+                    display: flex;
+                    gap: 8px;
+                    justify-content: center;
+                    flex-wrap: wrap;
+                    margin-bottom: 24px;
+                }
+                #jellyfin-external-player-modal .modal-controls button {
+                    background: #2a2a2a;
+                    border: 1px solid #444;
+                    border-radius: 4px;
+                    color: #fff;
+                    font-size: 14px;
+                    padding: 6px 12px;
+                    cursor: pointer;
+                }
+                #jellyfin-external-player-modal .modal-controls button:hover {
+                    border-color: #00a4dc;
+                }
+                #jellyfin-external-player-modal .modal-route {
+                    font-size: 13px;
+                    color: #e0b84f;
+                    margin: -20px 0 24px;
+                }
                 #jellyfin-external-player-modal .modal-hint {
                     font-size: 13px;
                     color: #666;
@@ -102,11 +137,34 @@
                 <div class="spinner"></div>
                 <div class="modal-title">Playing in External Player</div>
                 <div class="modal-status">${message}</div>
+                <div class="modal-route" style="display: none;"></div>
+                <div class="modal-controls">
+                    <button data-action="previous" title="Previous item">&#x23EE;</button>
+                    <button data-action="seek-relative" data-value="-10" title="Back 10 seconds">-10s</button>
+                    <button data-action="toggle-pause" title="Pause / resume">&#x23EF;</button>
+                    <button data-action="seek-relative" data-value="30" title="Forward 30 seconds">+30s</button>
+                    <button data-action="next" title="Next item">&#x23ED;</button>
+                    <button data-action="chapter-prev" title="Previous chapter">Ch-</button>
+                    <button data-action="chapter-next" title="Next chapter">Ch+</button>
+                    <button data-action="toggle-mute" title="Mute">Mute</button>
+                    <button data-action="toggle-fullscreen" title="Fullscreen">Full</button>
+                    <button data-action="stop" title="Stop playback">Stop</button>
+                </div>
                 <div class="modal-hint">Press <strong>Escape</strong> to stop playback and return to Jellyfin</div>
             </div>
         `;
         document.body.appendChild(modalElement);
         statusElement = modalElement.querySelector('.modal-status');
+        modalElement.querySelectorAll('.modal-controls button').forEach(button => {
+            button.addEventListener('click', () => {
+                const action = button.dataset.action;
+                if (action === 'stop') {
+                    stopPlayback();
+                } else {
+                    sendControl(action, button.dataset.value);
+                }
+            });
+        });
 
         document.addEventListener('keydown', handleModalKeydown, true);
         startStatusPolling();
@@ -129,6 +187,10 @@
             clearInterval(pollInterval);
             pollInterval = null;
         }
+        if (eventSource) {
+            eventSource.close();
+            eventSource = null;
+        }
         document.removeEventListener('keydown', handleModalKeydown, true);
         if (modalElement) {
             modalElement.remove();
@@ -137,7 +199,7 @@
         }
         if (stopPlayer) {
             debugLog('Sending /api/stop request');
-            fetch(KIOSK_SERVER + '/api/stop', { method: 'POST' })
+            localFetch(KIOSK_SERVER + '/api/stop' + sessionQuery(), { method: 'POST' })
                 .then(() => debugLog('/api/stop succeeded'))
                 .catch(err => debugLog('/api/stop failed:', err));
         }
@@ -158,35 +220,97 @@
         hideModal(); // hideModal() will call /api/stop
     }
 
+    // Query string that selects the player session this page started, so
+    // players on other displays are left alone
+    function sessionQuery() {
+        return currentSession ? '?session=' + encodeURIComponent(currentSession) : '';
+    }
+
+    // Send a transport action such as "toggle-pause" to the player session
+    function sendControl(action, value) {
+        const body = { action: action };
+        if (value !== undefined) body.value = parseFloat(value);
+        debugLog('Sending control', body);
+        localFetch(KIOSK_SERVER + '/api/control' + sessionQuery(), {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify(body)
+        })
+            .then(async response => {
+                if (!response.ok) {
+                    debugLog('Control failed:', response.status, await response.text());
+                }
+            })
+            .catch(err => debugLog('Control failed:', err));
+    }
+
+    // Say when the player streams from the server instead of opening the
+    // file through a path mapping
+    function showRoute(route) {
+        const messages = {
+            'stream': 'Streaming from the server: no path mapping matches this file',
+            'stream-fallback': 'Streaming from the server: the mapped file is not available'
+        };
+        const element = modalElement && modalElement.querySelector('.modal-route');
+        if (!element || !messages[route]) return;
+        element.textContent = messages[route];
+        element.style.display = '';
+    }
+
+    // Show the playback position, e.g. "Playing... 1:23 / 45:00"
+    function showPosition(position, duration) {
+        if (position === undefined) return;
+        lastKnownPosition = position;
+        const format = (t) => `${Math.floor(t / 60)}:${Math.floor(t % 60).toString().padStart(2, '0')}`;
+        if (duration !== undefined) {
+            lastKnownDuration = duration;
+            updateModalStatus(`Playing... ${format(position)} / ${format(duration)}`);
+        } else {
+            updateModalStatus(`Playing... ${format(position)}`);
+        }
+    }
+
+    // Follow the player session through /api/events instead of polling
+    // /api/status. Polling goes on if the stream is not available.
+    function startEventStream() {
+        if (!currentSession || typeof EventSource === 'undefined' || !modalElement) return;
+        // EventSource cannot send headers, so the secret goes in the URL
+        const source = new EventSource(KIOSK_SERVER + '/api/events' + sessionQuery() + '&secret=' + encodeURIComponent(API_SECRET));
+        eventSource = source;
+        source.onopen = () => {
+            debugLog('Event stream open, stopping status polling');
+            if (pollInterval) {
+                clearInterval(pollInterval);
+                pollInterval = null;
+            }
+        };
+        source.addEventListener('position', (e) => {
+            const data = JSON.parse(e.data);
+            showPosition(data.position, data.duration);
+        });
+        source.addEventListener('paused', () => updateModalStatus('Paused'));
+        source.addEventListener('exited', (e) => {
+            debugLog('Player exited:', e.data);
+            hideModal(false); // Player already stopped
+        });
+        source.onerror = () => {
+            debugLog('Event stream failed, polling status instead');
+            source.close();
+            if (eventSource === source) eventSource = null;
+            if (modalElement && !pollInterval) startStatusPolling();
+        };
+    }
+
     function startStatusPolling() {
         pollInterval = setInterval(() => {
-            fetch(KIOSK_SERVER + '/api/status')
+            localFetch(KIOSK_SERVER + '/api/status' + sessionQuery())
                 .then(response => response.json())
                 .then(status => {
                     if (!status.playing) {
                         debugLog('Status poll: playing=false, closing modal');
                         hideModal(false); // Player already stopped
                     } else {
-                        if (status.position !== undefined) {
-                            lastKnownPosition = status.position;
-                        }
-                        if (status.duration !== undefined) {
-                            lastKnownDuration = status.duration;
-                        }
-
-                        if (status.position !== undefined && status.duration !== undefined) {
-                            const posMin = Math.floor(status.position / 60);
-                            const posSec = Math.floor(status.position % 60);
-                            const durMin = Math.floor(status.duration / 60);
-                            const durSec = Math.floor(status.duration % 60);
-                            const posStr = `${posMin}:${posSec.toString().padStart(2, '0')}`;
-                            const durStr = `${durMin}:${durSec.toString().padStart(2, '0')}`;
-                            updateModalStatus(`Playing... ${posStr} / ${durStr}`);
-                        } else if (status.position !== undefined) {
-                            const mins = Math.floor(status.position / 60);
-                            const secs = Math.floor(status.position % 60);
-                            updateModalStatus(`Playing... ${mins}:${secs.toString().padStart(2, '0')}`);
-                        }
+                        showPosition(status.position, status.duration);
                     }
                 })
                 .catch(err => {
@@ -196,176 +320,137 @@
         }, 1000);
     }
 
-    // Send play request to local kiosk server
-    function playInExternalPlayer(path, itemId, isResume) {
-        currentItemId = itemId;
-        lastKnownPosition = 0;
-        lastKnownDuration = 0;
-
-        showModal('Launching player...');
-
-        // Get Jellyfin credentials for progress reporting
+    // Send the Jellyfin access token to the local server, which keeps it so
+    // play requests only need to name the item. Only sent again when the
+    // user or token changes, or when force is set.
+    async function ensureCredentials(force) {
         const serverUrl = window.location.origin;
-        const userId = window.ApiClient && window.ApiClient.getCurrentUserId ? window.ApiClient.getCurrentUserId() : '';
         const token = window.ApiClient && window.ApiClient.accessToken ? window.ApiClient.accessToken() : '';
-
-        // Construct stream URL as fallback when no path mapping matches
-        const streamUrl = `${serverUrl}/Videos/${itemId}/stream?static=true&api_key=${encodeURIComponent(token)}`;
-
-        let url = KIOSK_SERVER + '/api/play?path=' + encodeURIComponent(path);
-        url += '&streamUrl=' + encodeURIComponent(streamUrl);
-        if (itemId) url += '&itemId=' + encodeURIComponent(itemId);
-        if (serverUrl) url += '&serverUrl=' + encodeURIComponent(serverUrl);
-        if (userId) url += '&userId=' + encodeURIComponent(userId);
-        if (token) url += '&token=' + encodeURIComponent(token);
-        if (isResume) url += '&resume=1';
-
-        fetch(url)
-            .then(response => {
-                if (response.ok) {
-                    console.log('JF External Player: Playing in external player');
-                    updateModalStatus('Playing...');
-                } else {
-                    console.error('JF External Player: Server error', response.status);
-                    updateModalStatus('Server error: ' + response.status, true);
-                    setTimeout(hideModal, 3000);
-                }
-            })
-            .catch(async error => {
-                console.error('JF External Player: Failed to connect', error);
-                updateModalStatus('Could not connect to server. Is jellyfin-external-player running?', true);
-                // Check if script is outdated
-                await checkScriptVersion();
-                setTimeout(hideModal, 3000);
-            });
-    }
-
-    // Check if this looks like a Jellyfin page
-    function isJellyfinPage() {
-        return document.querySelector('.skinHeader') !== null ||
-               document.querySelector('#indexPage') !== null ||
-               window.location.pathname.includes('/web/') ||
-               typeof window.ApiClient !== 'undefined';
-    }
-
-    // Video types we should intercept (everything else uses native Jellyfin)
-    const VIDEO_TYPES = ['Movie', 'Episode', 'MusicVideo', 'Video', 'Trailer'];
-    // Container types that should be expanded into playlists
-    const CONTAINER_TYPES = ['Season', 'Series', 'Playlist', 'BoxSet'];
-
-    // Fetch item details from Jellyfin API - returns {type, path} or null
-    async function getItemInfo(itemId) {
-        const userId = window.ApiClient && window.ApiClient.getCurrentUserId ? window.ApiClient.getCurrentUserId() : null;
-        const token = window.ApiClient && window.ApiClient.accessToken ? window.ApiClient.accessToken() : null;
-
-        if (!userId || !token) {
-            throw new Error('Not authenticated');
+        if (!token) {
+            return;
         }
-
-        const url = `${window.location.origin}/Users/${userId}/Items/${itemId}?api_key=${encodeURIComponent(token)}`;
-
-        const response = await fetch(url);
-        if (!response.ok) {
-            throw new Error(`API request failed: ${response.status}`);
+        const key = serverUrl + '|' + token;
+        if (!force && registeredCredentials === key) {
+            return;
         }
 
-        return await response.json();
-    }
-
-    // Legacy function for single video playback
-    async function getItemPath(itemId) {
-        const data = await getItemInfo(itemId);
-
-        // Only intercept video types
-        if (!VIDEO_TYPES.includes(data.Type)) {
-            debugLog('Skipping non-video type:', data.Type, 'for item:', itemId);
-            return null;
+        const resp = await localFetch(KIOSK_SERVER + '/api/credentials', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ serverUrl: serverUrl, token: token })
+        });
+        if (resp.ok) {
+            registeredCredentials = key;
+            debugLog('Credentials registered for', serverUrl);
+        } else {
+            registeredCredentials = null;
+            console.error('JF External Player: Credentials rejected', resp.status);
         }
-
-        return data.Path;
     }
 
-    // Fetch all child episodes for a container (Season, Series, etc.)
-    async function getChildEpisodes(itemId, itemType) {
-        const userId = window.ApiClient && window.ApiClient.getCurrentUserId ? window.ApiClient.getCurrentUserId() : null;
-        const token = window.ApiClient && window.ApiClient.accessToken ? window.ApiClient.accessToken() : null;
-
-        if (!userId || !token) {
-            throw new Error('Not authenticated');
+    // Fetch from the local server, registering credentials first and once
+    // more if the server no longer has them
+    async function kioskFetch(url, options) {
+        await ensureCredentials(false);
+        let resp = await localFetch(url, options);
+        if (resp.status === 401) {
+            await ensureCredentials(true);
+            resp = await localFetch(url, options);
         }
+        return resp;
+    }
 
-        // Build query to get child items
-        let url = `${window.location.origin}/Users/${userId}/Items?api_key=${encodeURIComponent(token)}`;
-        url += `&ParentId=${encodeURIComponent(itemId)}`;
-        url += `&IncludeItemTypes=Episode`;
-        url += `&Recursive=true`;
-        url += `&SortBy=SortName`;
-        url += `&SortOrder=Ascending`;
-        url += `&Fields=Path`;
-
-        const response = await fetch(url);
-        if (!response.ok) {
-            throw new Error(`API request failed: ${response.status}`);
+    // Get the user's audio and subtitle language preferences
+    async function getLanguagePreferences() {
+        try {
+            const user = await window.ApiClient.getCurrentUser();
+            const cfg = (user && user.Configuration) || {};
+            return {
+                audioLanguage: cfg.AudioLanguagePreference || '',
+                subtitleLanguage: cfg.SubtitleLanguagePreference || ''
+            };
+        } catch (err) {
+            debugLog('Could not get language preferences:', err);
+            return { audioLanguage: '', subtitleLanguage: '' };
         }
+    }
 
-        const data = await response.json();
-        debugLog('Found', data.Items.length, 'episodes for', itemType, itemId);
-
-        return data.Items.map(item => ({
-            path: item.Path,
-            itemId: item.Id,
-            streamUrl: `${window.location.origin}/Videos/${item.Id}/stream?static=true&api_key=${encodeURIComponent(token)}`
-        }));
+    // Read the version, audio and subtitle selection from the item details page
+    function getSelectedStreams() {
+        const pick = selector => {
+            const el = document.querySelector('.page:not(.hide) ' + selector);
+            return el && el.value !== '' ? el.value : null;
+        };
+        return {
+            mediaSourceId: pick('.selectSource'),
+            audioStreamIndex: pick('.selectAudio'),
+            subtitleStreamIndex: pick('.selectSubtitles')
+        };
     }
 
-    // Play a playlist via the server
-    async function playPlaylist(items, isResume) {
-        if (!items || items.length === 0) {
-            console.error('JF External Player: Empty playlist');
-            return;
-        }
+    // Send play request to local kiosk server, which looks the item up and
+    // expands seasons, series, playlists and collections. streams optionally
+    // holds the mediaSourceId, audioStreamIndex and subtitleStreamIndex to
+    // play with. Resolves to false if the item is not something the external
+    // player handles, so the caller can leave it to Jellyfin.
+    async function playInExternalPlayer(itemId, isResume, streams) {
+        currentItemId = itemId;
+        currentSession = null;
+        lastKnownPosition = 0;
+        lastKnownDuration = 0;
 
-        showModal(`Loading playlist (${items.length} items)...`);
+        showModal('Launching player...');
 
-        const serverUrl = window.location.origin;
-        const userId = window.ApiClient && window.ApiClient.getCurrentUserId ? window.ApiClient.getCurrentUserId() : '';
-        const token = window.ApiClient && window.ApiClient.accessToken ? window.ApiClient.accessToken() : '';
+        // The local server uses the credentials stored for this server
+        let url = KIOSK_SERVER + '/api/play?itemId=' + encodeURIComponent(itemId);
+        url += '&serverUrl=' + encodeURIComponent(window.location.origin);
+        if (isResume) url += '&resume=1';
 
-        // Ensure each item has a streamUrl fallback
-        const itemsWithStream = items.map(item => ({
-            ...item,
-            streamUrl: item.streamUrl || `${serverUrl}/Videos/${item.itemId}/stream?static=true&api_key=${encodeURIComponent(token)}`
-        }));
-
-        const payload = {
-            items: itemsWithStream,
-            serverUrl: serverUrl,
-            userId: userId,
-            token: token,
-            resume: isResume
-        };
+        streams = streams || {};
+        if (streams.mediaSourceId) url += '&mediaSourceId=' + encodeURIComponent(streams.mediaSourceId);
+        if (streams.audioStreamIndex != null) url += '&audioStreamIndex=' + encodeURIComponent(streams.audioStreamIndex);
+        if (streams.subtitleStreamIndex != null) url += '&subtitleStreamIndex=' + encodeURIComponent(streams.subtitleStreamIndex);
 
-        try {
-            const response = await fetch(KIOSK_SERVER + '/api/playlist', {
-                method: 'POST',
-                headers: { 'Content-Type': 'application/json' },
-                body: JSON.stringify(payload)
-            });
+        const prefs = await getLanguagePreferences();
+        if (prefs.audioLanguage) url += '&audioLanguage=' + encodeURIComponent(prefs.audioLanguage);
+        if (prefs.subtitleLanguage) url += '&subtitleLanguage=' + encodeURIComponent(prefs.subtitleLanguage);
 
-            if (!response.ok) {
-                throw new Error(`Server returned ${response.status}`);
+        try {
+            const response = await kioskFetch(url, { method: 'POST' });
+            if (response.status === 422) {
+                const result = await response.json();
+                debugLog('Not a video, leaving it to Jellyfin:', result.type);
+                hideModal(false);
+                return false;
             }
-
-            const result = await response.json();
-            debugLog('Playlist started:', result);
-            updateModalStatus(`Playing playlist (${items.length} items)...`);
-        } catch (err) {
-            console.error('JF External Player: Playlist error:', err);
-            updateModalStatus('Failed to start playlist: ' + err.message, true);
+            if (response.ok) {
+                const result = await response.json();
+                console.log('JF External Player: Playing in external player', result);
+                currentSession = result.session || null;
+                showRoute(result.route);
+                startEventStream();
+                updateModalStatus(result.items > 1 ? `Playing playlist (${result.items} items)...` : 'Playing...');
+            } else {
+                console.error('JF External Player: Server error', response.status);
+                updateModalStatus('Server error: ' + response.status, true);
+                setTimeout(hideModal, 3000);
+            }
+        } catch (error) {
+            console.error('JF External Player: Failed to connect', error);
+            updateModalStatus('Could not connect to server. Is jellyfin-external-player running?', true);
             // Check if script is outdated
             await checkScriptVersion();
-            setTimeout(() => hideModal(false), 3000);
+            setTimeout(hideModal, 3000);
         }
+        return true;
+    }
+
+    // Check if this looks like a Jellyfin page
+    function isJellyfinPage() {
+        return document.querySelector('.skinHeader') !== null ||
+               document.querySelector('#indexPage') !== null ||
+               window.location.pathname.includes('/web/') ||
+               typeof window.ApiClient !== 'undefined';
     }
 
     // Extract item ID from URL or element
@@ -454,26 +539,11 @@
         event.stopImmediatePropagation();
 
         try {
-            const itemInfo = await getItemInfo(itemId);
-            debugLog('Item info:', itemInfo.Type, itemInfo.Name);
-
-            if (VIDEO_TYPES.includes(itemInfo.Type)) {
-                // Single video - play directly
-                console.log('JF External Player: Playing', itemInfo.Path, 'isResume:', isResume);
-                playInExternalPlayer(itemInfo.Path, itemId, isResume);
-            } else if (CONTAINER_TYPES.includes(itemInfo.Type)) {
-                // Container (Season, Series, etc.) - get child episodes and play as playlist
-                debugLog('Expanding container:', itemInfo.Type);
-                const episodes = await getChildEpisodes(itemId, itemInfo.Type);
-                if (episodes.length > 0) {
-                    console.log('JF External Player: Playing playlist of', episodes.length, 'episodes');
-                    await playPlaylist(episodes, isResume);
-                } else {
-                    console.error('JF External Player: No episodes found in', itemInfo.Type);
-                }
-            } else {
+            console.log('JF External Player: Playing', itemId, 'isResume:', isResume);
+            const handled = await playInExternalPlayer(itemId, isResume, getSelectedStreams());
+            if (!handled) {
                 // Unknown type - let native Jellyfin handle it
-                debugLog('Re-triggering click for native handling, type:', itemInfo.Type);
+                debugLog('Re-triggering click for native handling');
                 const target = event.target;
                 target.dataset.jfExternalBypass = 'true';
                 target.click();
@@ -516,15 +586,8 @@
             if (event.key === 'k' && !event.target.matches('input, textarea')) {
                 const urlMatch = window.location.hash.match(/id=([a-f0-9]+)/i);
                 if (urlMatch && isPlayableItem()) {
-                    try {
-                        const path = await getItemPath(urlMatch[1]);
-                        if (path) {
-                            console.log('JF External Player: Playing via keyboard shortcut', path);
-                            playInExternalPlayer(path, urlMatch[1], true);
-                        }
-                    } catch (err) {
-                        console.error('JF External Player: Error', err);
-                    }
+                    console.log('JF External Player: Playing via keyboard shortcut', urlMatch[1]);
+                    playInExternalPlayer(urlMatch[1], true);
                 }
             }
         });
@@ -555,8 +618,14 @@
                         let isResume = true;
                         console.log('JF External Player: startPositionTicks =', startPositionTicks, 'isResume =', isResume);
 
+                        const streams = {
+                            mediaSourceId: options.mediaSourceId || null,
+                            audioStreamIndex: options.audioStreamIndex != null ? options.audioStreamIndex : null,
+                            subtitleStreamIndex: options.subtitleStreamIndex != null ? options.subtitleStreamIndex : null
+                        };
+
                         const event = new CustomEvent('jellyfin-external-player-play', {
-                            detail: { itemId: itemId, startPositionTicks: startPositionTicks, isResume: isResume }
+                            detail: { itemId: itemId, startPositionTicks: startPositionTicks, isResume: isResume, streams: streams }
                         });
                         document.dispatchEvent(event);
                         return;
@@ -614,15 +683,7 @@
             const startPositionTicks = e.detail.startPositionTicks || 0;
             const isResume = e.detail.isResume !== false;
             console.log('JF External Player: Received play event for', itemId, 'startPositionTicks:', startPositionTicks, 'isResume:', isResume);
-            try {
-                const path = await getItemPath(itemId);
-                if (path) {
-                    console.log('JF External Player: Playing externally', path);
-                    playInExternalPlayer(path, itemId, isResume);
-                }
-            } catch (err) {
-                console.error('JF External Player: Error getting path', err);
-            }
+            playInExternalPlayer(itemId, isResume, e.detail.streams);
         });
     }
 
@@ -641,17 +702,7 @@
                 history.back();
 
                 if (itemId) {
-                    try {
-                        const path = await getItemPath(itemId);
-                        console.log('JF External Player: Got path:', path);
-                        if (path) {
-                            playInExternalPlayer(path, itemId, true);
-                        } else {
-                            console.error('JF External Player: No path returned for item', itemId);
-                        }
-                    } catch (err) {
-                        console.error('JF External Player: Error getting path:', err);
-                    }
+                    playInExternalPlayer(itemId, true);
                 } else {
                     console.error('JF External Player: No itemId found to play');
                 }
@@ -748,7 +799,11 @@
 
         // Check if kiosk server is running
         try {
-            await fetch(KIOSK_SERVER + '/api/status');
+            const resp = await localFetch(KIOSK_SERVER + '/api/status');
+            if (resp.status === 403) {
+                console.error('JF External Player: Refused by the local server. Check that this server is in the server URLs and reinstall the userscript from', KIOSK_SERVER + '/install');
+                return;
+            }
         } catch {
             console.log('JF External Player: Server not available at', KIOSK_SERVER);
             return;